@@ -9,7 +9,7 @@ import uvicorn
 import os
 import requests
 
-from utils import get_latest_weights, decrypt_aes_ctr, save_file
+from utils import get_latest_weights, decrypt, save_file, AuthenticationError
 
 # Automatically get the latest best.pt weights path.
 try:
@@ -20,6 +20,9 @@ except Exception as e:
     print(f"Failed to get latest weights: {str(e)}")
     print("Falling back to default model:", model_path)
 
+# Reported with every prediction so that cached predictions can be traced back to the model that made them.
+model_version = os.getenv('MODEL_VERSION') or os.path.relpath(model_path)
+
 # Load the model using the latest weights
 model = YOLO(model_path)
 cuda = torch.cuda
@@ -77,7 +80,10 @@ async def predict(
     # If key is provided, decrypt the input data.
     if key:
         try:
-            data = decrypt_aes_ctr(data, key)
+            data = decrypt(data, key)
+        except AuthenticationError as e:
+            print("Authentication failed:", str(e))
+            return JSONResponse(content={"error": f"Authentication failed: {str(e)}"}, status_code=422)
         except Exception as e:
             print("Decryption failed:", str(e))
             return JSONResponse(content={"error": f"Decryption failed: {str(e)}"}, status_code=400)
@@ -103,7 +109,7 @@ async def predict(
         print(f"File saved to: {saved_path}")
 
     # Include the saved path in the response.
-    return JSONResponse(content=predictions)
+    return JSONResponse(content=predictions, headers={"X-Model-Version": model_version})
 
 
 # Gradio interface
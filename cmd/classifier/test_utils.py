@@ -0,0 +1,71 @@
+import os
+import unittest
+
+try:
+    import utils
+except ImportError:  # pycryptodome is only installed along with the classifier
+    utils = None
+
+# The files encrypted by the tests of lib.Crypto with the key "secret", which this has to decrypt.
+TESTDATA = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "..", "pkg", "lib", "testdata")
+KEY = "secret"
+
+
+def golden_plaintext(size: int) -> bytes:
+    """What the files in TESTDATA decrypt to, as written by goldenPlaintext in the tests of lib.Crypto."""
+    return bytes(i % 251 for i in range(size))
+
+
+def read_testdata(name: str) -> bytes:
+    with open(os.path.join(TESTDATA, name), "rb") as f:
+        return f.read()
+
+
+def flip(data: bytes, i: int) -> bytes:
+    """Returns a copy of data with a bit of the byte at i flipped."""
+    flipped = bytearray(data)
+    flipped[i] ^= 1
+    return bytes(flipped)
+
+
+@unittest.skipIf(utils is None, "pycryptodome is not installed")
+@unittest.skipUnless(os.path.isdir(TESTDATA), "the testdata of lib.Crypto is not available")
+class DecryptTest(unittest.TestCase):
+    def setUp(self):
+        self.stream = read_testdata("stream.enc")
+        self.sealed = utils.CHUNK_SIZE + utils.TAG_SIZE
+
+    def test_stream(self):
+        self.assertEqual(utils.decrypt(self.stream, KEY), golden_plaintext(utils.CHUNK_SIZE + 100))
+
+    def test_legacy(self):
+        self.assertEqual(utils.decrypt(read_testdata("legacy.enc"), KEY), golden_plaintext(100))
+
+    def test_no_key(self):
+        self.assertEqual(utils.decrypt(self.stream, ""), self.stream)
+
+    def test_authentication(self):
+        header = utils.HEADER_SIZE
+        for name, data, key, chunk in [
+            ("modified", flip(self.stream, header + self.sealed + 10), KEY, 1),
+            ("modified header", flip(self.stream, header - 1), KEY, 0),
+            ("truncated", self.stream[:-1], KEY, 1),
+            ("truncated chunks", self.stream[:header + self.sealed], KEY, 0),
+            ("header only", self.stream[:header], KEY, 0),
+            ("appended", self.stream + self.stream[header:header + self.sealed], KEY, 1),
+            ("reordered", self.stream[:header] + self.stream[header + self.sealed:] + self.stream[header:header + self.sealed], KEY, 0),
+            ("other key", self.stream, "other", 0),
+        ]:
+            with self.subTest(name):
+                with self.assertRaises(utils.AuthenticationError) as raised:
+                    utils.decrypt(data, key)
+                self.assertEqual(raised.exception.chunk, chunk)
+
+    def test_unsupported_version(self):
+        with self.assertRaises(ValueError) as raised:
+            utils.decrypt(flip(self.stream, len(utils.MAGIC)), KEY)
+        self.assertNotIsInstance(raised.exception, utils.AuthenticationError)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -42,9 +42,80 @@ def get_latest_weights(last: bool = False) -> str:
     return weight_files[-1]
 
 
+# Files encrypted by lib.Crypto start with MAGIC and the format VERSION, followed by a random nonce prefix.
+# They are then split in chunks of up to CHUNK_SIZE bytes sealed with AES-GCM, using the STREAM construction:
+# each nonce is the prefix, the big-endian chunk counter and 1 for the last chunk, and the header is the
+# additional data of every chunk. Data without MAGIC is legacy AES-CTR with a random IV prefix.
+MAGIC = b"CLSENC"
+VERSION = 2
+CHUNK_SIZE = 64 * 1024
+NONCE_PREFIX_SIZE = 7
+TAG_SIZE = 16
+HEADER_SIZE = len(MAGIC) + 1 + NONCE_PREFIX_SIZE
+
+
+class AuthenticationError(ValueError):
+    """
+    Raised when a chunk of encrypted data fails authentication, because it was modified,
+    truncated or encrypted with another key.
+    """
+
+    def __init__(self, chunk: int):
+        super().__init__(
+            f"chunk {chunk} could not be authenticated, the file was modified, truncated or encrypted with another key"
+        )
+        self.chunk = chunk
+
+
+def decrypt(encrypted_data: bytes, key: str) -> bytes:
+    """
+    Decrypt data encrypted by lib.Crypto, in either the chunked AES-GCM format or the legacy AES-CTR one.
+    Raises AuthenticationError if the data was not encrypted as it is with this key.
+    """
+    if not key:
+        return encrypted_data
+    if encrypted_data[:len(MAGIC)] == MAGIC:
+        return decrypt_aes_gcm_stream(encrypted_data, key)
+    return decrypt_aes_ctr(encrypted_data, key)
+
+
+def decrypt_aes_gcm_stream(encrypted_data: bytes, key: str) -> bytes:
+    """
+    Decrypt the chunked AES-GCM encrypted data, authenticating every chunk.
+    The encryption key is derived from the provided key string via SHA-256.
+    """
+    if len(encrypted_data) < HEADER_SIZE:
+        raise AuthenticationError(0)
+    header = encrypted_data[:HEADER_SIZE]
+    version = header[len(MAGIC)]
+    if version != VERSION:
+        raise ValueError(f"Unsupported encryption version {version}.")
+    prefix = header[len(MAGIC) + 1:]
+    derived_key = hashlib.sha256(key.encode()).digest()
+
+    sealed_size = CHUNK_SIZE + TAG_SIZE
+    body = encrypted_data[HEADER_SIZE:]
+    # A chunk is the last when nothing follows it, so that an empty file is still a single sealed chunk.
+    chunks = max(1, -(-len(body) // sealed_size))
+    decrypted = bytearray()
+    for counter in range(chunks):
+        chunk = body[counter * sealed_size:(counter + 1) * sealed_size]
+        if len(chunk) < TAG_SIZE:
+            raise AuthenticationError(counter)
+        last = counter == chunks - 1
+        nonce = prefix + counter.to_bytes(4, byteorder='big') + (b'\x01' if last else b'\x00')
+        cipher = AES.new(derived_key, AES.MODE_GCM, nonce=nonce)
+        cipher.update(header)
+        try:
+            decrypted += cipher.decrypt_and_verify(chunk[:-TAG_SIZE], chunk[-TAG_SIZE:])
+        except ValueError:
+            raise AuthenticationError(counter) from None
+    return bytes(decrypted)
+
+
 def decrypt_aes_ctr(encrypted_data: bytes, key: str) -> bytes:
     """
-    Decrypt the AES-CTR encrypted data.
+    Decrypt the legacy AES-CTR encrypted data, which is not authenticated.
     The first AES.block_size (16) bytes are assumed to be the IV.
     The encryption key is derived from the provided key string via SHA-256.
     """
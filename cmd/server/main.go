@@ -1,48 +1,195 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/charmbracelet/log"
 
 	"classifier/pkg/classify"
+	"classifier/pkg/config"
+	"classifier/pkg/health"
+	"classifier/pkg/label"
+	"classifier/pkg/lib"
+	"classifier/pkg/profile"
+	"classifier/pkg/sandbox"
 	"classifier/pkg/server"
+	"classifier/pkg/thumb"
 )
 
 func main() {
 	// Serve the home page and API endpoints.
-	http.HandleFunc("GET /", server.HomeHandler)
-	http.HandleFunc("GET /watch", server.Watcher)
-	http.HandleFunc("GET /walk", server.WalkHandler)
-	http.HandleFunc("GET /file/{path}", server.FileProxy)
+	server.Register(http.DefaultServeMux)
+
+	log.Default().SetLevel(log.DebugLevel)
+
+	// CONFIG_FILE is the server configuration, which is reloaded on SIGHUP. Without one,
+	// the defaults are used along with the PORT, PREDICT_URL and ALLOWED_ROOTS environment variables.
+	configFile := os.Getenv("CONFIG_FILE")
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	if err := server.Configure(cfg); err != nil {
+		log.Fatalf("Error applying configuration: %v", err)
+	}
+	defer server.AllowedRoots.Close()
+	log.Info("Serving files from", "roots", server.AllowedRoots.Paths())
 
 	if os.Getenv("SKIP_LOAD") != "true" {
-		classify.DefaultCache.Load("classifications.json")
+		classify.DefaultCache.Load(cfg.Cache.Classifications)
+	}
+	// MERGE_CLASSIFICATIONS lists classifications saved by other shards, separated by commas.
+	for name := range strings.SplitSeq(os.Getenv("MERGE_CLASSIFICATIONS"), ",") {
+		if name == "" {
+			continue
+		}
+		if err := classify.DefaultCache.Merge(name); err != nil {
+			log.Error("Error merging classifications", "name", name, "err", err)
+		}
 	}
-	defer classify.DefaultCache.Save("classifications.json")
+	defer func() {
+		if err := classify.DefaultCache.Save(cfg.Cache.Classifications); err != nil {
+			log.Error("Error saving classifications", "err", err)
+		}
+	}()
 
-	log.Default().SetLevel(log.DebugLevel)
+	if err := os.MkdirAll("inkbunny", 0755); err != nil {
+		log.Fatalf("Error creating inkbunny folder: %v", err)
+	}
+	server.InkbunnyRoot, err = sandbox.New("inkbunny")
+	if err != nil {
+		log.Fatalf("Error opening inkbunny folder: %v", err)
+	}
+	defer server.InkbunnyRoot.Close()
+
+	// THUMBNAIL_KEY encrypts cached thumbnails. Without it, a random key is used and the cache starts over on every restart.
+	thumbnailKey := os.Getenv("THUMBNAIL_KEY")
+	if thumbnailKey == "" {
+		thumbnailKey = rand.Text()
+	}
+	crypto, err := lib.NewCrypto(thumbnailKey)
+	if err != nil {
+		log.Fatalf("Error using THUMBNAIL_KEY: %v", err)
+	}
+	server.Thumbnails, err = thumb.NewCache(cfg.Cache.Thumbnails, crypto, int64(cfg.Cache.ThumbnailsMB)<<20)
+	if err != nil {
+		log.Fatalf("Error opening thumbnail cache: %v", err)
+	}
+
+	// Labels are kept apart from the classifications, so that they survive predictions being cleared or redone.
+	server.Labels, err = label.Open(cfg.Cache.Labels)
+	if err != nil {
+		log.Fatalf("Error opening labels: %v", err)
+	}
+	defer server.Labels.Close()
 
-	done := make(chan os.Signal, 1)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Artist galleries are cached apart from the classifications, so that profiles can be made again for other classes.
+	server.Profiles, err = profile.OpenCache(cfg.Cache.Profiles)
+	if err != nil {
+		log.Fatalf("Error opening profiles: %v", err)
 	}
-	p, err := strconv.Atoi(port)
+
+	// Jobs that were running when the server stopped are started again once the roots are set.
+	server.DefaultJobs, err = server.LoadJobs(cfg.Cache.Jobs)
 	if err != nil {
-		log.Fatalf("Error parsing PORT: %v", err)
+		log.Fatalf("Error loading jobs: %v", err)
+	}
+
+	// INKBUNNY_SID is optional, and only used to check that the session is still valid.
+	server.ReadyChecks = []health.Check{health.Classifier(), health.Writable(".")}
+	if sid := os.Getenv("INKBUNNY_SID"); sid != "" {
+		server.ReadyChecks = append(server.ReadyChecks, health.InkbunnySID(sid))
+	}
+
+	go reloadOnHangup(configFile, cfg)
+
+	// Every request's context is cancelled once the server shut down, or the drain is over,
+	// so that walks and watchers still running stop and flush.
+	base, stop := context.WithCancel(context.Background())
+	defer stop()
+	go classify.DefaultCache.Checkpoint(base, cfg.Cache.Classifications, time.Duration(cfg.Cache.CheckpointSeconds)*time.Second)
+
+	srv := &http.Server{
+		Addr:        cfg.Listen,
+		Handler:     server.Instrument(http.DefaultServeMux),
+		BaseContext: func(net.Listener) context.Context { return base },
 	}
-	log.Infof("Server starting on http://localhost:%d", p)
-	go func() { log.Print(http.ListenAndServe(fmt.Sprintf(":%d", p), nil)); close(done) }()
+	failed := make(chan error, 1)
+	log.Infof("Server listening on %s", cfg.Listen)
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
 
-	wait(done)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-failed:
+		log.Error("Server stopped", "err", err)
+	case sig := <-signals:
+		drain := time.Duration(cfg.DrainSeconds) * time.Second
+		log.Info("Shutting down, signal again to exit immediately", "signal", sig, "drain", drain)
+		go func() {
+			<-signals
+			log.Warn("Exiting without waiting for requests and jobs to finish")
+			os.Exit(1)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		if err := server.Shutdown(ctx, srv, stop); err != nil {
+			log.Error("Error shutting down", "err", err)
+		}
+	}
 }
 
-func wait(done chan os.Signal) {
-	signal.Notify(done, os.Interrupt)
-	<-done
+// defaultConfigFile is read when CONFIG_FILE is not set, if it exists.
+const defaultConfigFile = "config.json"
+
+// loadConfig reads the configuration file at name, or the defaults when name is empty and there is no config.json.
+func loadConfig(name string) (*config.Config, error) {
+	if name == "" {
+		if _, err := os.Stat(defaultConfigFile); err != nil {
+			cfg := config.Default()
+			return cfg, cfg.Validate()
+		}
+		name = defaultConfigFile
+	}
+	cfg, err := config.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Loaded configuration", "file", name)
+	return cfg, nil
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP. Invalid files are rejected as a whole,
+// and the listener is left as is, so that open streams are never dropped.
+func reloadOnHangup(name string, started *config.Config) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		cfg, err := loadConfig(name)
+		if err != nil {
+			log.Error("Keeping the current configuration", "err", err)
+			continue
+		}
+		if fields := cfg.RestartRequired(started); len(fields) > 0 {
+			log.Warn("Some changes only apply after a restart", "fields", fields)
+		}
+		if err := server.Configure(cfg); err != nil {
+			log.Error("Keeping the current configuration", "err", err)
+			continue
+		}
+		log.Info("Reloaded configuration", "roots", server.AllowedRoots.Paths())
+	}
 }
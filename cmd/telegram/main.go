@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 
 	"github.com/charmbracelet/log"
 
+	"classifier/pkg/metrics"
 	"classifier/pkg/telegram"
 	"classifier/pkg/utils"
 )
@@ -19,12 +22,17 @@ const (
 	EnvTelegramEncryptionKey = "TELEGRAM_ENCRYPT_KEY"
 	EnvTelegramClassify      = "TELEGRAM_CLASSIFY"
 	EnvTelegramClasses       = "TELEGRAM_CLASSES"
+	EnvTelegramWatchFolder   = "TELEGRAM_WATCH_FOLDER"
+	EnvTelegramMetricsPort   = "TELEGRAM_METRICS_PORT"
 )
 
 func main() {
 	defer utils.LogOutput(os.Stdout)()
 	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer done()
+	if port := os.Getenv(EnvTelegramMetricsPort); port != "" {
+		go serveMetrics(port)
+	}
 	b, err := bot.New(bot.Config{
 		Output:        os.Stdout,
 		Token:         os.Getenv(EnvTelegramBotToken),
@@ -34,6 +42,7 @@ func main() {
 		Classify:      os.Getenv(EnvTelegramClassify),
 		EncryptionKey: os.Getenv(EnvTelegramEncryptionKey),
 		Classes:       os.Getenv(EnvTelegramClasses),
+		WatchFolder:   os.Getenv(EnvTelegramWatchFolder),
 		Context:       ctx,
 	})
 	if err != nil {
@@ -48,3 +57,13 @@ func main() {
 		log.Fatalf("error shutting down bot: %v", err)
 	}
 }
+
+// serveMetrics exposes the metrics registry on its own port, since the bot has no HTTP server of its own.
+func serveMetrics(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	log.Info("Serving metrics", "addr", fmt.Sprintf("http://localhost:%s/metrics", port))
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
+		log.Error("error serving metrics", "err", err)
+	}
+}
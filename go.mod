@@ -5,6 +5,8 @@ go 1.24.2
 replace github.com/ellypaws/inkbunny/api => ./cmd/dataset/vendor/github.com/ellypaws/inkbunny/api
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/bmatcuk/doublestar/v4 v4.10.2
 	github.com/charmbracelet/log v0.4.1
 	github.com/ellypaws/inkbunny/api v0.0.0-20240523184311-b8d31bbdc865
 	github.com/joho/godotenv v1.5.1
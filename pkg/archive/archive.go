@@ -0,0 +1,403 @@
+// Package archive lets zip, cbz and tar archives be read as folders without extracting them.
+// Files inside an archive are addressed with a virtual path such as "comics/issue1.cbz!/page03.png".
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Separator divides the path of an archive from the path of an entry inside it.
+const Separator = "!/"
+
+// DefaultMaxSize is how much an archive entry, or a compressed tarball, is read into memory until SetMaxSize is called.
+const DefaultMaxSize = 256 << 20
+
+// ErrTooLarge is returned for an archive entry, or a compressed tarball, that decompresses to more than MaxSize,
+// so that a decompression bomb cannot exhaust the memory of the server.
+var ErrTooLarge = errors.New("archive is too large to read")
+
+var maxSize atomic.Int64
+
+func init() {
+	maxSize.Store(DefaultMaxSize)
+}
+
+// MaxSize returns how many bytes of an archive entry, or of a compressed tarball, are read into memory at most.
+func MaxSize() int64 {
+	return maxSize.Load()
+}
+
+// SetMaxSize sets how many bytes of an archive entry, or of a compressed tarball, are read into memory at most.
+func SetMaxSize(n int64) {
+	maxSize.Store(n)
+}
+
+// readAll reads r into memory, failing with ErrTooLarge once it reads more than MaxSize.
+func readAll(r io.Reader) ([]byte, error) {
+	limit := MaxSize()
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w, it has more than %d bytes", ErrTooLarge, limit)
+	}
+	return data, nil
+}
+
+// IsArchive reports whether path has the extension of a supported archive.
+func IsArchive(path string) bool {
+	return kind(path) != ""
+}
+
+func kind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"), strings.HasSuffix(name, ".cbz"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"), strings.HasSuffix(name, ".cbt"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	default:
+		return ""
+	}
+}
+
+// Join returns the virtual path of entry inside the archive at name.
+func Join(name, entry string) string {
+	return name + Separator + entry
+}
+
+// Split separates a virtual path into the archive path and the entry inside it.
+// It returns false if name does not point inside an archive.
+func Split(name string) (archive, entry string, ok bool) {
+	archive, entry, ok = strings.Cut(name, Separator)
+	if !ok || !IsArchive(archive) || entry == "" {
+		return name, "", false
+	}
+	return archive, entry, true
+}
+
+// Open opens the archive at name on the local disk as an fs.FS. The returned io.Closer must be closed when done.
+func Open(name string) (fs.FS, io.Closer, error) {
+	return OpenFS(os.DirFS(filepath.Dir(name)), filepath.Base(name))
+}
+
+// OpenFS opens the archive at name inside fsys as an fs.FS. The returned io.Closer must be closed when done.
+// Archives whose files cannot be read at random, such as compressed tarballs, are read into memory up to MaxSize.
+func OpenFS(fsys fs.FS, name string) (fs.FS, io.Closer, error) {
+	k := kind(name)
+	if k == "" {
+		return nil, nil, fmt.Errorf("%s is not a supported archive", name)
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	var (
+		r    io.ReaderAt
+		size = info.Size()
+	)
+	if ra, ok := f.(io.ReaderAt); ok && k != "tgz" {
+		r = ra
+	} else {
+		var source io.Reader = f
+		if k == "tgz" {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			defer gz.Close()
+			source = gz
+		}
+		data, err := readAll(source)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		r, size, f = bytes.NewReader(data), int64(len(data)), nil
+	}
+
+	var closer io.Closer = nopCloser{}
+	if f != nil {
+		closer = f
+	}
+	switch k {
+	case "zip":
+		z, err := zip.NewReader(r, size)
+		if err != nil {
+			closer.Close()
+			return nil, nil, err
+		}
+		return z, closer, nil
+	default:
+		t, err := newTarFS(r, info.ModTime())
+		if err != nil {
+			closer.Close()
+			return nil, nil, err
+		}
+		return t, closer, nil
+	}
+}
+
+// OpenFile opens name, which is either a regular path or a virtual path inside an archive.
+// Archive entries are read into memory so that they can be seeked.
+func OpenFile(name string) (io.ReadSeekCloser, error) {
+	archive, entry, ok := Split(name)
+	if !ok {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	dir := filepath.Dir(archive)
+	return OpenSeeker(FS{FS: os.DirFS(dir), Root: dir}, Join(filepath.Base(archive), entry))
+}
+
+// Stat returns the fs.FileInfo of name, which is either a regular path or a virtual path inside an archive.
+func Stat(name string) (fs.FileInfo, error) {
+	archive, entry, ok := Split(name)
+	if !ok {
+		return os.Stat(name)
+	}
+	dir := filepath.Dir(archive)
+	return fs.Stat(FS{FS: os.DirFS(dir), Root: dir}, Join(filepath.Base(archive), entry))
+}
+
+// FS wraps a file system so that virtual paths pointing inside archives can be opened directly.
+// Entries inside archives are read into memory when opened, up to MaxSize.
+type FS struct {
+	fs.FS
+	// Root is where FS is on the local disk. With it, archives that are held with Hold, such as while a walk
+	// reads their entries, are shared by every FS opening entries inside them instead of being opened again.
+	Root string
+}
+
+func (f FS) Open(name string) (fs.File, error) {
+	archive, entry, ok := Split(name)
+	if !ok {
+		return f.FS.Open(name)
+	}
+	fsys, release, err := f.Hold(archive)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer release()
+	file, err := fsys.Open(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MaxSize() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%w, it has %d bytes", ErrTooLarge, info.Size())}
+	}
+	data, err := readAll(file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return &memFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+// Stat returns the fs.FileInfo of name without reading entries inside archives.
+func (f FS) Stat(name string) (fs.FileInfo, error) {
+	archive, entry, ok := Split(name)
+	if !ok {
+		return fs.Stat(f.FS, name)
+	}
+	fsys, release, err := f.Hold(archive)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer release()
+	return fs.Stat(fsys, entry)
+}
+
+// memFile is an archive entry that was read into memory.
+type memFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (m *memFile) Stat() (fs.FileInfo, error) { return m.info, nil }
+func (m *memFile) Close() error               { return nil }
+
+// OpenSeeker opens name from fsys as an io.ReadSeekCloser, reading it into memory up to MaxSize if the file
+// cannot seek. The file keeps the Stat method of the fs.File it was opened as.
+func OpenSeeker(fsys fs.FS, name string) (io.ReadSeekCloser, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if rs, ok := file.(io.ReadSeekCloser); ok {
+		return rs, nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// tarFS is a read-only fs.FS over an indexed tar archive.
+type tarFS struct {
+	r       io.ReaderAt
+	modTime time.Time
+	files   map[string]*tarEntry
+}
+
+type tarEntry struct {
+	header  *tar.Header
+	offset  int64
+	entries []fs.DirEntry
+}
+
+// offsetReader counts how far the tar reader has read so that entries can be located later.
+type offsetReader struct {
+	r   io.ReaderAt
+	off int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.ReadAt(p, o.off)
+	o.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func newTarFS(r io.ReaderAt, modTime time.Time) (*tarFS, error) {
+	fsys := &tarFS{r: r, modTime: modTime, files: make(map[string]*tarEntry)}
+	fsys.files["."] = &tarEntry{header: &tar.Header{Name: ".", Typeflag: tar.TypeDir, Mode: 0555, ModTime: modTime}}
+
+	counter := &offsetReader{r: r}
+	tr := tar.NewReader(counter)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		default:
+			continue
+		}
+		header.Name = name
+		fsys.add(name, &tarEntry{header: header, offset: counter.off})
+	}
+
+	for _, entry := range fsys.files {
+		slices.SortFunc(entry.entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+	return fsys, nil
+}
+
+// add records entry and creates any parent folders that the archive did not list.
+func (t *tarFS) add(name string, entry *tarEntry) {
+	if existing, ok := t.files[name]; ok {
+		if existing.header.Typeflag == tar.TypeDir && entry.header.Typeflag == tar.TypeDir {
+			return
+		}
+		entry.entries = existing.entries
+		t.files[name] = entry
+		return
+	}
+	t.files[name] = entry
+
+	parent := path.Dir(name)
+	if _, ok := t.files[parent]; !ok {
+		t.add(parent, &tarEntry{header: &tar.Header{Name: parent, Typeflag: tar.TypeDir, Mode: 0555, ModTime: t.modTime}})
+	}
+	dir := t.files[parent]
+	dir.entries = append(dir.entries, fs.FileInfoToDirEntry(entry.header.FileInfo()))
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, ok := t.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if entry.header.Typeflag == tar.TypeDir {
+		return &tarDir{entry: entry}, nil
+	}
+	return &tarFile{entry: entry, SectionReader: io.NewSectionReader(t.r, entry.offset, entry.header.Size)}, nil
+}
+
+type tarFile struct {
+	entry *tarEntry
+	*io.SectionReader
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.entry.header.FileInfo(), nil }
+func (f *tarFile) Close() error               { return nil }
+
+type tarDir struct {
+	entry  *tarEntry
+	offset int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.entry.header.FileInfo(), nil }
+func (d *tarDir) Close() error               { return nil }
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.header.Name, Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entry.entries[d.offset:]
+	if n <= 0 {
+		d.offset += len(remaining)
+		return slices.Clone(remaining), nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.offset += n
+	return slices.Clone(remaining[:n]), nil
+}
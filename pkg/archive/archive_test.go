@@ -0,0 +1,196 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var entries = map[string]string{
+	"page01.png":        "first",
+	"extras/page02.png": "second",
+}
+
+func writeZip(t *testing.T, name string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for entry, content := range entries {
+		part, err := w.Create(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(part, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, name string, compress bool) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out io.Writer = f
+	if compress {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		out = gz
+	}
+	w := tar.NewWriter(out)
+	for entry, content := range entries {
+		if err := w.WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	root := t.TempDir()
+	archives := map[string]func(string){
+		"issue1.cbz":    func(name string) { writeZip(t, name) },
+		"issue2.tar":    func(name string) { writeTar(t, name, false) },
+		"issue3.tar.gz": func(name string) { writeTar(t, name, true) },
+	}
+	for base, write := range archives {
+		t.Run(base, func(t *testing.T) {
+			name := filepath.Join(root, base)
+			write(name)
+
+			fsys, closer, err := Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			var found []string
+			err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() {
+					found = append(found, path)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(found)
+			if !slices.Equal(found, []string{"extras/page02.png", "page01.png"}) {
+				t.Fatalf("unexpected entries %v", found)
+			}
+
+			for entry, content := range entries {
+				virtual := Join(name, entry)
+				if a, e, ok := Split(virtual); !ok || a != name || e != entry {
+					t.Fatalf("Split(%q) = %q, %q, %v", virtual, a, e, ok)
+				}
+				file, err := OpenFile(virtual)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(file)
+				file.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Fatalf("expected %q in %s, got %q", content, virtual, data)
+				}
+			}
+		})
+	}
+}
+
+// countingFS counts how many times each file is opened.
+type countingFS struct {
+	fs.FS
+	opens map[string]int
+}
+
+func (c countingFS) Open(name string) (fs.File, error) {
+	c.opens[name]++
+	return c.FS.Open(name)
+}
+
+func TestFS_Hold(t *testing.T) {
+	root := t.TempDir()
+	writeTar(t, filepath.Join(root, "issue.tgz"), true)
+	counter := countingFS{FS: os.DirFS(root), opens: make(map[string]int)}
+	fsys := FS{FS: counter, Root: root}
+
+	_, release, err := fsys.Hold("issue.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another FS over the same folder, as opened for another stage of a walk, shares the held archive.
+	other := FS{FS: counter, Root: root}
+	for range 3 {
+		for entry, content := range entries {
+			data, err := fs.ReadFile(other, Join("issue.tgz", entry))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != content {
+				t.Fatalf("got %q in %s, want %q", data, entry, content)
+			}
+		}
+	}
+	if info, err := fs.Stat(other, Join("issue.tgz", "page01.png")); err != nil || info.Size() != int64(len(entries["page01.png"])) {
+		t.Fatalf("got %v, %v", info, err)
+	}
+	if n := counter.opens["issue.tgz"]; n != 1 {
+		t.Fatalf("the archive was opened %d times while it was held, want once", n)
+	}
+
+	release()
+	release()
+	if _, err := fs.ReadFile(fsys, Join("issue.tgz", "page01.png")); err != nil {
+		t.Fatal(err)
+	}
+	if n := counter.opens["issue.tgz"]; n != 2 {
+		t.Fatalf("the archive was opened %d times, want it opened again once released", n)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	defer SetMaxSize(MaxSize())
+	root := t.TempDir()
+	zipName, tgzName := filepath.Join(root, "issue.cbz"), filepath.Join(root, "issue.tgz")
+	writeZip(t, zipName)
+	writeTar(t, tgzName, true)
+
+	SetMaxSize(int64(len("second")) - 1)
+	if _, err := OpenFile(Join(zipName, "extras/page02.png")); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge for an entry larger than MaxSize", err)
+	}
+	if _, err := OpenFile(Join(tgzName, "page01.png")); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge for a tarball that decompresses to more than MaxSize", err)
+	}
+
+	SetMaxSize(DefaultMaxSize)
+	if _, err := OpenFile(Join(tgzName, "page01.png")); err != nil {
+		t.Error(err)
+	}
+}
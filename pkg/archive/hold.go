@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// held is an archive kept open for as long as something holds it.
+type held struct {
+	ready  chan struct{}
+	fsys   fs.FS
+	closer io.Closer
+	err    error
+	refs   int
+}
+
+// opened are the archives that are held, keyed by their absolute path on the local disk.
+var opened = struct {
+	sync.Mutex
+	archives map[string]*held
+}{archives: make(map[string]*held)}
+
+// key returns what the archive at name is held under, or an empty string when FS has no Root.
+func (f FS) key(name string) string {
+	if f.Root == "" {
+		return ""
+	}
+	key, err := filepath.Abs(filepath.Join(f.Root, filepath.FromSlash(name)))
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// Hold opens the archive at name as an fs.FS, and keeps it open until release is called. While it is held,
+// entries opened through any FS with the archive at the same place on the local disk are read from it,
+// so that a compressed tarball is only decompressed once however many of its entries are read.
+// Without a Root, the archive is opened for this call alone.
+func (f FS) Hold(name string) (fsys fs.FS, release func(), err error) {
+	key := f.key(name)
+	if key == "" {
+		fsys, closer, err := OpenFS(f.FS, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fsys, func() { closer.Close() }, nil
+	}
+
+	opened.Lock()
+	h, ok := opened.archives[key]
+	if !ok {
+		h = &held{ready: make(chan struct{})}
+		opened.archives[key] = h
+	}
+	h.refs++
+	opened.Unlock()
+
+	if ok {
+		<-h.ready
+	} else {
+		h.fsys, h.closer, h.err = OpenFS(f.FS, name)
+		close(h.ready)
+	}
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			opened.Lock()
+			defer opened.Unlock()
+			h.refs--
+			if h.refs > 0 {
+				return
+			}
+			delete(opened.archives, key)
+			if h.closer != nil {
+				h.closer.Close()
+			}
+		})
+	}
+	if h.err != nil {
+		release()
+		return nil, nil, h.err
+	}
+	return h.fsys, release, nil
+}
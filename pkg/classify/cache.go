@@ -2,38 +2,131 @@ package classify
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"maps"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
 
 	"classifier/pkg/utils"
 )
 
 var DefaultCache = &cache{
 	RWMutex:     new(sync.RWMutex),
-	predictions: make(map[string]Prediction),
+	predictions: make(map[string]*Entry),
+}
+
+// Entry is a cached Prediction along with the model that made it and when.
+// Stale entries are still listed by Query, but are classified again by the next Predict.
+type Entry struct {
+	Prediction Prediction `json:"prediction"`
+	Model      string     `json:"model,omitempty"`
+	Time       time.Time  `json:"time,omitzero"`
+	Stale      bool       `json:"stale,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare Prediction, which is how entries were saved before they had any metadata.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if _, ok := fields["prediction"]; !ok {
+		*e = Entry{}
+		return json.Unmarshal(data, &e.Prediction)
+	}
+	type entry Entry
+	return json.Unmarshal(data, (*entry)(e))
 }
 
 type cache struct {
 	*sync.RWMutex
-	predictions map[string]Prediction
+	predictions map[string]*Entry
+	expiries    sync.Map // expiries maps name prefixes to how long their entries are kept.
+}
+
+// ExpireAfter keeps the entries whose name starts with prefix for ttl after they were classified.
+// Expired entries are classified again by the next Predict and are dropped when the cache is saved,
+// so that names that are never looked up again, such as uploads, do not grow the cache forever.
+func (c *cache) ExpireAfter(prefix string, ttl time.Duration) {
+	c.expiries.Store(prefix, ttl)
+}
+
+// expired reports whether the entry for name was kept for longer than its prefix allows.
+func (c *cache) expired(name string, entry *Entry, now time.Time) bool {
+	expired := false
+	c.expiries.Range(func(prefix, ttl any) bool {
+		if strings.HasPrefix(name, prefix.(string)) && now.Sub(entry.Time) > ttl.(time.Duration) {
+			expired = true
+			return false
+		}
+		return true
+	})
+	return expired
+}
+
+// expire removes every expired entry.
+func (c *cache) expire() {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	for name, entry := range c.predictions {
+		if c.expired(name, entry, now) {
+			delete(c.predictions, name)
+		}
+	}
 }
 
 func (c *cache) reset() {
 	c.RWMutex = new(sync.RWMutex)
-	c.predictions = make(map[string]Prediction)
+	c.predictions = make(map[string]*Entry)
 }
 
+// Save writes the cache to name, without the entries that expired. It is written to a temporary file first,
+// so that a crash while saving leaves the previous file intact.
 func (c *cache) Save(name string) error {
-	f, err := os.Create(name)
+	c.expire()
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 	c.RLock()
-	defer c.RUnlock()
-	return utils.EncodeIndent(f, c.predictions, "  ")
+	err = utils.EncodeIndent(f, c.predictions, "  ")
+	c.RUnlock()
+	err = errors.Join(err, f.Close())
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Checkpoint saves the cache to name every interval until ctx is done,
+// so that a crash loses at most the predictions of the last interval.
+func (c *cache) Checkpoint(ctx context.Context, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			if err := c.Save(name); err != nil {
+				log.Error("Error checkpointing classifications", "name", name, "err", err)
+				continue
+			}
+			log.Debug("Checkpointed classifications", "name", name, "took", time.Since(start))
+		}
+	}
 }
 
 func (c *cache) Load(name string) error {
@@ -41,7 +134,7 @@ func (c *cache) Load(name string) error {
 	if err != nil {
 		return err
 	}
-	predictions, err := utils.DecodeAndClose[map[string]Prediction](f)
+	predictions, err := utils.DecodeAndClose[map[string]*Entry](f)
 	if err != nil {
 		return err
 	}
@@ -51,44 +144,104 @@ func (c *cache) Load(name string) error {
 	return nil
 }
 
+// Merge loads the predictions saved at name, such as by another shard of the same walk,
+// and adds the ones that are not cached yet.
+func (c *cache) Merge(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	predictions, err := utils.DecodeAndClose[map[string]*Entry](f)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	for path, entry := range predictions {
+		if _, ok := c.predictions[path]; !ok {
+			c.predictions[path] = entry
+		}
+	}
+	c.Unlock()
+	return nil
+}
+
+// cached returns the prediction stored for name, unless it is missing or stale.
+func (c *cache) cached(name string) (Prediction, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if entry, ok := c.predictions[name]; ok && !entry.Stale && !c.expired(name, entry, time.Now()) {
+		cacheHits.Inc()
+		return maps.Clone(entry.Prediction), true
+	}
+	cacheMisses.Inc()
+	return nil, false
+}
+
+func (c *cache) store(name string, prediction Prediction, model string) {
+	c.Lock()
+	c.predictions[name] = &Entry{Prediction: prediction, Model: model, Time: time.Now()}
+	c.Unlock()
+}
+
 // Predict expects file to already be encrypted if needed, such as [classifier/pkg/lib.Crypto.Encrypt].
 // As such, it will not call these methods for you, and it is up to the caller to call them.
 func (c *cache) Predict(ctx context.Context, name, key string, file io.Reader) (Prediction, error) {
-	c.RLock()
-	if v, ok := c.predictions[name]; ok {
-		c.RUnlock()
-		return maps.Clone(v), nil
+	if v, ok := c.cached(name); ok {
+		return v, nil
 	}
-	c.RUnlock()
 
-	d, err := Predict(ctx, name, key, file)
+	d, model, err := predict(ctx, name, key, file)
 	if err != nil {
 		return nil, err
 	}
-
-	c.Lock()
-	c.predictions[name] = d
-	c.Unlock()
+	c.store(name, d, model)
 
 	return maps.Clone(d), nil
 }
 
 func (c *cache) PredictURL(ctx context.Context, path string) (Prediction, error) {
-	c.RLock()
-	if v, ok := c.predictions[path]; ok {
-		c.RUnlock()
+	if v, ok := c.cached(path); ok {
 		return v, nil
 	}
-	c.RUnlock()
 
-	d, err := PredictURL(ctx, path)
+	d, model, err := predictFromURL(ctx, path)
 	if err != nil {
 		return nil, err
 	}
+	c.store(path, d, model)
+
+	return maps.Clone(d), nil
+}
+
+// Get returns a copy of the entry cached for name.
+func (c *cache) Get(name string) (Entry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, ok := c.predictions[name]
+	if !ok {
+		return Entry{}, false
+	}
+	clone := *entry
+	clone.Prediction = maps.Clone(entry.Prediction)
+	return clone, true
+}
 
+// Delete removes the cached prediction for name, so that the next Predict classifies it again.
+func (c *cache) Delete(name string) {
 	c.Lock()
-	c.predictions[path] = d
+	delete(c.predictions, name)
 	c.Unlock()
+}
 
-	return d, nil
+// Rename moves the cached prediction from old to name, if any. It reports whether an entry was moved.
+func (c *cache) Rename(old, name string) bool {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.predictions[old]
+	if !ok {
+		return false
+	}
+	delete(c.predictions, old)
+	c.predictions[name] = v
+	return true
 }
@@ -15,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"slices"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -27,16 +28,27 @@ type Prediction map[string]float64
 
 var bodyPool = utils.NewPoolMake[*bytes.Buffer]()
 
-var predictURL = "http://localhost:7860/predict"
+// predictURL is where images are sent to be classified.
+var predictURL atomic.Pointer[string]
 
 func init() {
+	SetPredictURL("http://localhost:7860/predict")
 	predict := os.Getenv("PREDICT_URL")
 	if predict == "" {
 		return
 	}
-	if u, err := url.Parse(predict); err == nil {
-		predictURL = u.String()
+	SetPredictURL(predict)
+}
+
+// SetPredictURL changes where images are sent to be classified, including by requests that are already queued.
+func SetPredictURL(predict string) error {
+	u, err := url.Parse(predict)
+	if err != nil {
+		return err
 	}
+	s := u.String()
+	predictURL.Store(&s)
+	return nil
 }
 
 // Clone returns a copy of Prediction. This is a shallow clone: the new keys and values are set using ordinary assignment.
@@ -112,9 +124,24 @@ func Whitelist[V any](allow ...string) func(string, V) bool {
 	}
 }
 
+// ModelHeader is the response header the classifier service uses to report which model made a prediction.
+const ModelHeader = "X-Model-Version"
+
 // Predict expects file to already be encrypted if needed, such as [classifier/pkg/lib.Crypto.Encrypt].
 // As such, it will not call these methods for you, and it is up to the caller to call them.
 func Predict(ctx context.Context, name, key string, file io.Reader) (Prediction, error) {
+	prediction, _, err := predict(ctx, name, key, file)
+	return prediction, err
+}
+
+// predict is Predict that also returns the model version reported by the classifier service.
+func predict(ctx context.Context, name, key string, file io.Reader) (prediction Prediction, model string, err error) {
+	release, err := DefaultScheduler.Acquire(ctx, priorityOf(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	defer func(start time.Time) { observe("predict", start, err) }(time.Now())
 	body := bodyPool.Get()
 	body.Reset()
 	defer bodyPool.Put(body)
@@ -122,56 +149,70 @@ func Predict(ctx context.Context, name, key string, file io.Reader) (Prediction,
 	writer := multipart.NewWriter(body)
 	part, err := writer.CreateFormFile("file", name)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	_, err = io.Copy(part, file)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	err = writer.Close()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	predictURL := predictURL
+	predictURL := *predictURL.Load()
 	if key != "" {
 		predictURL = fmt.Sprintf("%s?key=%s", predictURL, key)
 	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, predictURL, body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
 	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("error in predicting %s: %s", name, string(body))
+		return nil, "", fmt.Errorf("error in predicting %s: %s", name, string(body))
 	}
 
-	return utils.DecodeAndClose[Prediction](resp.Body)
+	prediction, err = utils.DecodeAndClose[Prediction](resp.Body)
+	return prediction, resp.Header.Get(ModelHeader), err
 }
 
 func PredictURL(ctx context.Context, path string) (Prediction, error) {
+	prediction, _, err := predictFromURL(ctx, path)
+	return prediction, err
+}
+
+// predictFromURL is PredictURL that also returns the model version reported by the classifier service.
+func predictFromURL(ctx context.Context, path string) (prediction Prediction, model string, err error) {
+	release, err := DefaultScheduler.Acquire(ctx, priorityOf(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	defer func(start time.Time) { observe("predict_url", start, err) }(time.Now())
 	params := url.Values{"url": {path}}
-	requestURL := fmt.Sprintf("%s?%s", predictURL, params.Encode())
+	requestURL := fmt.Sprintf("%s?%s", *predictURL.Load(), params.Encode())
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return utils.DecodeAndClose[Prediction](resp.Body)
+	prediction, err = utils.DecodeAndClose[Prediction](resp.Body)
+	return prediction, resp.Header.Get(ModelHeader), err
 }
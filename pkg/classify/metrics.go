@@ -0,0 +1,27 @@
+package classify
+
+import (
+	"time"
+
+	"classifier/pkg/metrics"
+)
+
+var (
+	requestsTotal   = metrics.NewCounter("classifier_requests_total", "Requests sent to the classifier service.", "endpoint")
+	requestErrors   = metrics.NewCounter("classifier_request_errors_total", "Requests to the classifier service that failed.", "endpoint")
+	requestDuration = metrics.NewHistogram("classifier_request_duration_seconds", "Latency of requests to the classifier service.", nil, "endpoint")
+
+	cacheHits   = metrics.NewCounter("classifier_cache_hits_total", "Predictions served from the cache.")
+	cacheMisses = metrics.NewCounter("classifier_cache_misses_total", "Predictions that were missing or stale in the cache.")
+
+	schedulerWaiting = metrics.NewGauge("classifier_requests_waiting", "Requests waiting for a free slot to the classifier service, by priority.", "priority")
+)
+
+// observe records a request to the classifier service endpoint that started at start and ended with err.
+func observe(endpoint string, start time.Time, err error) {
+	requestsTotal.Inc(endpoint)
+	requestDuration.Since(start, endpoint)
+	if err != nil {
+		requestErrors.Inc(endpoint)
+	}
+}
@@ -0,0 +1,217 @@
+package classify
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// DefaultLimit and MaxLimit bound how many items Query returns per page.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Query filters the entries of the cache. Zero fields match everything.
+type Query struct {
+	// Class only matches entries whose most likely class is Class.
+	// With AnyRank, it matches every entry that has Class, whatever its rank.
+	Class   string
+	AnyRank bool
+	// MinConfidence and MaxConfidence bound the confidence of Class,
+	// or of the most likely class when Class is empty. A zero MaxConfidence means no upper bound.
+	MinConfidence float64
+	MaxConfidence float64
+	// Prefix only matches paths that start with it, such as "inkbunny/artist".
+	Prefix string
+	Model  string
+	// Cursor continues a previous Query from where its Page ended.
+	Cursor string
+	Limit  int
+}
+
+// Item is a cached Entry along with the path it is cached under.
+type Item struct {
+	Path string `json:"path"`
+	Entry
+}
+
+// UnmarshalJSON decodes the path along with the entry, which would otherwise decode the whole item
+// with the UnmarshalJSON method of Entry.
+func (i *Item) UnmarshalJSON(data []byte) error {
+	var path struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(data, &path); err != nil {
+		return err
+	}
+	i.Path = path.Path
+	return json.Unmarshal(data, &i.Entry)
+}
+
+// Page is one page of Query results. Next is empty on the last page.
+type Page struct {
+	Items []Item `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// Validate reports whether the confidence range and limit make sense.
+func (q Query) Validate() error {
+	if q.MinConfidence < 0 || q.MinConfidence > 1 || q.MaxConfidence < 0 || q.MaxConfidence > 1 {
+		return errors.New("confidence must be between 0 and 1")
+	}
+	if q.MaxConfidence > 0 && q.MinConfidence > q.MaxConfidence {
+		return fmt.Errorf("min confidence %v is greater than max confidence %v", q.MinConfidence, q.MaxConfidence)
+	}
+	if q.Limit < 0 || q.Limit > MaxLimit {
+		return fmt.Errorf("limit must be between 0 and %d", MaxLimit)
+	}
+	return nil
+}
+
+// Filtered reports whether q has any filter, as opposed to Cursor and Limit, which only page through the entries.
+func (q Query) Filtered() bool {
+	return q.Class != "" || q.MinConfidence > 0 || q.MaxConfidence > 0 || q.Prefix != "" || q.Model != ""
+}
+
+// Match reports whether the entry cached under path passes the filters of q, ignoring Cursor and Limit.
+func (q Query) Match(path string, entry *Entry) bool {
+	if !strings.HasPrefix(path, q.Prefix) {
+		return false
+	}
+	if q.Model != "" && entry.Model != q.Model {
+		return false
+	}
+	class, confidence := entry.Prediction.Max()
+	if q.Class != "" {
+		if !q.AnyRank && class != q.Class {
+			return false
+		}
+		var ok bool
+		if confidence, ok = entry.Prediction[q.Class]; !ok {
+			return false
+		}
+	}
+	if confidence < q.MinConfidence {
+		return false
+	}
+	if q.MaxConfidence > 0 && confidence > q.MaxConfidence {
+		return false
+	}
+	return true
+}
+
+// EncodeCursor and DecodeCursor convert the last path of a page to and from an opaque cursor.
+func EncodeCursor(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
+
+func DecodeCursor(cursor string) (string, error) {
+	path, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor: %w", err)
+	}
+	return string(path), nil
+}
+
+// Query returns the entries matching q, sorted by path.
+func (c *cache) Query(q Query) (Page, error) {
+	if err := q.Validate(); err != nil {
+		return Page{}, err
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultLimit
+	}
+	var after string
+	if q.Cursor != "" {
+		var err error
+		if after, err = DecodeCursor(q.Cursor); err != nil {
+			return Page{}, err
+		}
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	paths := slices.Sorted(maps.Keys(c.predictions))
+	start := 0
+	if q.Cursor != "" {
+		start, _ = slices.BinarySearch(paths, after)
+		if start < len(paths) && paths[start] == after {
+			start++
+		}
+	}
+
+	page := Page{Items: make([]Item, 0)}
+	for _, path := range paths[start:] {
+		entry := c.predictions[path]
+		if !q.Match(path, entry) {
+			continue
+		}
+		if len(page.Items) == q.Limit {
+			page.Next = EncodeCursor(page.Items[len(page.Items)-1].Path)
+			break
+		}
+		item := Item{Path: path, Entry: *entry}
+		item.Prediction = maps.Clone(entry.Prediction)
+		page.Items = append(page.Items, item)
+	}
+	return page, nil
+}
+
+// Matching returns every entry matching q in no particular order, ignoring Cursor and Limit,
+// for callers that need to look at all of them at once rather than page through them.
+func (c *cache) Matching(q Query) ([]Item, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	c.RLock()
+	defer c.RUnlock()
+	var items []Item
+	for path, entry := range c.predictions {
+		if q.Match(path, entry) {
+			item := Item{Path: path, Entry: *entry}
+			item.Prediction = maps.Clone(entry.Prediction)
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// DeleteMatching removes every entry matching q and returns how many were removed.
+func (c *cache) DeleteMatching(q Query) (int, error) {
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	var n int
+	for path, entry := range c.predictions {
+		if q.Match(path, entry) {
+			delete(c.predictions, path)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Invalidate marks every entry matching q as stale, so that it is classified again the next time it is seen,
+// and returns how many were marked.
+func (c *cache) Invalidate(q Query) (int, error) {
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	var n int
+	for path, entry := range c.predictions {
+		if !entry.Stale && q.Match(path, entry) {
+			entry.Stale = true
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,136 @@
+package classify
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// Priority decides which requests to the classifier service are sent first once it is busy.
+type Priority int
+
+const (
+	// Interactive requests are made while a client waits for them, such as walks and uploads.
+	Interactive Priority = iota
+	// Background requests are made by jobs that nobody is waiting on.
+	Background
+)
+
+func (p Priority) String() string {
+	if p == Background {
+		return "background"
+	}
+	return "interactive"
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose predictions are scheduled with p. Contexts without one are Interactive.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// DefaultScheduler limits the requests Predict and PredictURL send to the classifier service.
+var DefaultScheduler = NewScheduler(runtime.NumCPU(), 0.5)
+
+// Scheduler limits how many requests are sent to the classifier service at once, and divides them
+// between interactive and background requests. Each priority is guaranteed its share of the slots
+// and can borrow the other's while it is idle, so that neither can starve the other.
+type Scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	shares  [2]float64
+	active  [2]int
+	waiting [2][]chan struct{}
+}
+
+// NewScheduler allows limit requests at once, with background requests guaranteed the given share of them.
+func NewScheduler(limit int, background float64) *Scheduler {
+	s := new(Scheduler)
+	s.Resize(limit, background)
+	return s
+}
+
+// Resize changes the limit and the background share. Requests already sent are not interrupted.
+func (s *Scheduler) Resize(limit int, background float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = max(limit, 1)
+	background = min(max(background, 0), 1)
+	s.shares = [2]float64{1 - background, background}
+	s.dispatch()
+}
+
+// Acquire waits for a slot for a request with priority p, returning the function that frees it once the request is done.
+func (s *Scheduler) Acquire(ctx context.Context, p Priority) (release func(), err error) {
+	s.mu.Lock()
+	ready := make(chan struct{})
+	s.waiting[p] = append(s.waiting[p], ready)
+	s.dispatch()
+	s.mu.Unlock()
+	schedulerWaiting.Inc(p.String())
+	defer schedulerWaiting.Dec(p.String())
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if i := slices.Index(s.waiting[p], ready); i >= 0 {
+			s.waiting[p] = slices.Delete(s.waiting[p], i, i+1)
+			return nil, ctx.Err()
+		}
+		// The slot was handed over just as ctx was done.
+		s.active[p]--
+		s.dispatch()
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.active[p]--
+			s.dispatch()
+		})
+	}, nil
+}
+
+// dispatch hands free slots to waiting requests, picking the priority furthest below its share
+// whenever both are waiting. The caller must hold s.mu.
+func (s *Scheduler) dispatch() {
+	for s.active[Interactive]+s.active[Background] < s.limit {
+		var p Priority
+		switch {
+		case len(s.waiting[Interactive]) == 0 && len(s.waiting[Background]) == 0:
+			return
+		case len(s.waiting[Interactive]) == 0:
+			p = Background
+		case len(s.waiting[Background]) == 0:
+			p = Interactive
+		case s.usage(Background) < s.usage(Interactive):
+			p = Background
+		default:
+			p = Interactive
+		}
+		ready := s.waiting[p][0]
+		s.waiting[p] = s.waiting[p][1:]
+		s.active[p]++
+		close(ready)
+	}
+}
+
+// usage is how much of its share priority p is using.
+func (s *Scheduler) usage(p Priority) float64 {
+	if s.shares[p] == 0 {
+		return math.Inf(1) // only ever uses idle slots
+	}
+	return float64(s.active[p]) / (s.shares[p] * float64(s.limit))
+}
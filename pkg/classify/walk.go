@@ -3,6 +3,7 @@ package classify
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"os"
 
 	"github.com/charmbracelet/log"
@@ -15,31 +16,60 @@ import (
 type Result struct {
 	Path       string      `json:"path"`
 	Prediction *Prediction `json:"prediction,omitempty"`
+	Deleted    bool        `json:"deleted,omitempty"`
 }
 
 type Config struct {
 	Enabled   bool
 	Max       int
 	Skipper   func(path string) bool
+	Filter    walker.Filter
+	Archives  bool
 	Semaphore chan struct{}
 	Crypto    *lib.Crypto
+
+	// Manifest, when set, only classifies new or changed files and reports deleted ones.
+	Manifest *walker.Manifest
 }
 
 // WalkDir traverses the folder rooted at "root" and, for each image file,
 // spawns a goroutine (limited by a semaphore of size runtime.NumCPU by default)
 func WalkDir(ctx context.Context, root string, results chan<- Result, config Config) error {
-	return walker.WalkDir(ctx, root, results, walker.Config[Result, Config]{
+	return WalkFS(ctx, os.DirFS(root), root, results, config)
+}
+
+// WalkFS is like WalkDir, but walks any fs.FS such as an archive or an embedded file system.
+// Reported paths are joined with root.
+func WalkFS(ctx context.Context, fsys fs.FS, root string, results chan<- Result, config Config) error {
+	return walker.WalkFS(ctx, fsys, root, results, walker.Config[Result, Config]{
 		Enabled:   config.Enabled,
 		Max:       config.Max,
 		Semaphore: config.Semaphore,
 		Skipper:   walker.Skippers(utils.NotImage, config.Skipper),
+		Filter:    config.Filter,
+		Archives:  config.Archives,
 		Do:        Do,
 		Args:      config,
+		Manifest:  config.Manifest,
+		OnDelete:  Forget,
 	})
 }
 
+// Forget drops the cached prediction of a deleted file and reports it as a Result.
+func Forget(path string) (Result, error) {
+	DefaultCache.Delete(path)
+	return Result{Path: path, Deleted: true}, nil
+}
+
 func Do(args walker.Args[Config]) (Result, error) {
-	file, err := os.Open(args.Path)
+	switch args.Status {
+	case walker.Modified:
+		DefaultCache.Delete(args.Path)
+	case walker.Moved:
+		DefaultCache.Rename(args.Previous, args.Path)
+	}
+
+	file, err := args.Open()
 	if err != nil {
 		return Result{Path: args.Path}, err
 	}
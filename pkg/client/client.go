@@ -0,0 +1,99 @@
+// Package client calls the classifier server from Go, decoding its event streams into server.Result
+// and reconnecting to them when the connection drops.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"classifier/pkg/server"
+)
+
+// Client calls the server at BaseURL. Use New rather than the zero value.
+type Client struct {
+	BaseURL    *url.URL
+	HTTPClient *http.Client
+	// APIKey is sent in the X-API-Key header, so that the client shares its limits across addresses.
+	APIKey string
+	// Retries is how many times in a row a stream reconnects before giving up. Receiving an event resets it.
+	Retries int
+	// RetryDelay is how long to wait before reconnecting, unless the server asks for longer with Retry-After.
+	RetryDelay time.Duration
+}
+
+// New returns a Client for the server at baseURL, such as "http://localhost:8080".
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("base URL %q is not absolute", baseURL)
+	}
+	return &Client{
+		BaseURL:    u,
+		HTTPClient: http.DefaultClient,
+		Retries:    5,
+		RetryDelay: time.Second,
+	}, nil
+}
+
+// StatusError is returned for responses with an error status code.
+type StatusError struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the server asked to wait before trying again, if it did.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Temporary reports whether the request may succeed if it is sent again later,
+// such as once the client is back under its rate limit.
+func (e *StatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// newRequest builds a GET request for path relative to BaseURL.
+func (c *Client) newRequest(ctx context.Context, path string, query url.Values) (*http.Request, error) {
+	u := c.BaseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.APIKey != "" {
+		req.Header.Set(server.APIKeyHeader, c.APIKey)
+	}
+	return req, nil
+}
+
+// do sends req, returning a *StatusError for error status codes.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	statusErr := &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		statusErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return nil, statusErr
+}
@@ -0,0 +1,217 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"classifier/pkg/server"
+)
+
+func newClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryDelay = time.Millisecond
+	return c
+}
+
+func TestStream(t *testing.T) {
+	var connections atomic.Int32
+	c := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch connections.Add(1) {
+		case 1:
+			if got := r.URL.Query().Get("folder"); got != "images" {
+				t.Errorf("got folder %q", got)
+			}
+			fmt.Fprint(w, "id: s-1\ndata: {\"path\":\"a.png\",\"prediction\":{\"cat\":0.9}}\n\n")
+			fmt.Fprint(w, ": heartbeat\n\n")
+			fmt.Fprint(w, "id: s-2\ndata: {\"path\":\"b.png\"}\n\n")
+			// The connection drops before the exit event.
+		case 2:
+			if got := r.Header.Get("Last-Event-ID"); got != "s-2" {
+				t.Errorf("reconnected with Last-Event-ID %q, want s-2", got)
+			}
+			fmt.Fprint(w, "id: s-3\nevent: progress\ndata: {\"processed\":2}\n\n")
+			fmt.Fprint(w, "id: s-4\nevent: summary\ndata: {\"processed\":2,\"classes\":{\"cat\":1}}\n\n")
+			fmt.Fprint(w, "event: exit\ndata: exit\n\n")
+		default:
+			t.Error("reconnected after the exit event")
+		}
+	})
+
+	var events []Event
+	for event, err := range c.Walk(t.Context(), WalkRequest{Folder: "images", Max: 10, Classify: true}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4", len(events))
+	}
+	if r := events[0].Result; r == nil || r.Path != "a.png" || (*r.Prediction)["cat"] != 0.9 {
+		t.Errorf("got result %+v", r)
+	}
+	if events[1].Result == nil || events[1].Result.Path != "b.png" {
+		t.Errorf("got %+v", events[1])
+	}
+	if events[2].Progress == nil || events[2].Progress.Processed != 2 {
+		t.Errorf("got progress %+v", events[2].Progress)
+	}
+	if events[3].Summary == nil || events[3].Summary.Classes["cat"] != 1 {
+		t.Errorf("got summary %+v", events[3].Summary)
+	}
+}
+
+func TestStream_Server(t *testing.T) {
+	paths := []string{"a.png", "b.png", "c.png"}
+	c := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		server.Stream(w, r, func(ctx context.Context) iter.Seq[*server.Result] {
+			return func(yield func(*server.Result) bool) {
+				for _, path := range paths {
+					if !yield(&server.Result{Path: path}) {
+						return
+					}
+				}
+			}
+		})
+	})
+	var got []string
+	for event, err := range c.Stream(t.Context(), "/walk", nil) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(event.ID, "-") {
+			t.Errorf("got event id %q, want <stream>-<sequence>", event.ID)
+		}
+		got = append(got, event.Result.Path)
+	}
+	if !slices.Equal(got, paths) {
+		t.Errorf("got %v, want %v", got, paths)
+	}
+}
+
+func TestStream_Errors(t *testing.T) {
+	var connections atomic.Int32
+	c := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if connections.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "folder parameter is required", http.StatusBadRequest)
+	})
+	var statusErr *StatusError
+	for _, err := range c.Walk(t.Context(), WalkRequest{}) {
+		if !errors.As(err, &statusErr) {
+			t.Fatalf("got %v, want a *StatusError", err)
+		}
+	}
+	if statusErr.StatusCode != http.StatusBadRequest || statusErr.Message != "folder parameter is required" {
+		t.Errorf("got %v", statusErr)
+	}
+	if n := connections.Load(); n != 2 {
+		t.Errorf("connected %d times, want a retry after 429 and none after 400", n)
+	}
+
+	c = newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+	})
+	c.Retries = 2
+	for _, err := range c.Watch(t.Context(), WatchRequest{Classify: true}) {
+		if !errors.Is(err, errStreamEnded) {
+			t.Errorf("got %v after giving up, want errStreamEnded", err)
+		}
+	}
+}
+
+func TestStream_Cancel(t *testing.T) {
+	c := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"path\":\"a.png\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	var results int
+	for event, err := range c.WatchFolder(ctx, FolderRequest{Folder: "images", Classify: true}) {
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want context.Canceled", err)
+			}
+			continue
+		}
+		if event.Result != nil {
+			results++
+			cancel()
+		}
+	}
+	if results != 1 {
+		t.Errorf("got %d results, want 1", results)
+	}
+}
+
+// TestRequestsDocumented checks that every query parameter the requests send is documented for their endpoint.
+func TestRequestsDocumented(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Ref  string `json:"$ref"`
+				Name string `json:"name"`
+			} `json:"parameters"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(server.OpenAPI, &doc); err != nil {
+		t.Fatal(err)
+	}
+	distance := &Distance{Color: "#ff0000", Threshold: 0.2, Metric: "DistanceLab"}
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for path, request := range map[string]interface{ Values() url.Values }{
+		"/walk": WalkRequest{
+			Folder: "images", Max: 10, Classify: true, Distance: distance, EncryptKey: "key",
+			Incremental: true, Resume: true, Archives: true, Count: true, Shard: "0/2",
+			Include: []string{"*.png"}, Exclude: []string{"tmp/*"}, MinSize: 1, MaxSize: 2,
+			ModifiedAfter: day, ModifiedBefore: day, Progress: time.Second,
+		},
+		"/watch": WatchRequest{SID: "sid", EncryptKey: "key", Classify: true, Distance: distance, RefreshRate: time.Minute},
+		"/search": SearchRequest{
+			SID: "sid", Text: "dragon", Keywords: new(bool), Username: "artist", PoolID: "1", DaysLimit: 7,
+			Types: []int{1, 2}, OrderBy: "views", Max: 10, EncryptKey: "key", Classify: true, Distance: distance,
+		},
+		"/watch/folder": FolderRequest{Folder: "images", EncryptKey: "key", Classify: true, Distance: distance, Existing: true, RefreshRate: time.Second, Settle: time.Second},
+	} {
+		documented := make(map[string]bool)
+		for _, param := range doc.Paths[path]["get"].Parameters {
+			name := param.Name
+			if name == "" {
+				name = param.Ref[strings.LastIndex(param.Ref, "/")+1:]
+			}
+			documented[name] = true
+		}
+		if len(documented) == 0 {
+			t.Errorf("GET %s is not documented", path)
+		}
+		for key := range request.Values() {
+			if !documented[key] {
+				t.Errorf("%T sends %s, which GET %s does not document", request, key, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Distance finds images that have a pixel close to Color.
+type Distance struct {
+	// Color is a hex color such as "#ff0000".
+	Color string
+	// Threshold is the largest distance that matches. Zero uses the server's default.
+	Threshold float64
+	// Metric is one of distance.Metrics, such as "DistanceLab". Empty uses the server's default.
+	Metric string
+}
+
+func (d *Distance) set(values url.Values) {
+	if d == nil {
+		return
+	}
+	values.Set("distance", "true")
+	values.Set("color", d.Color)
+	if d.Threshold > 0 {
+		values.Set("threshold", strconv.FormatFloat(d.Threshold, 'f', -1, 64))
+	}
+	if d.Metric != "" {
+		values.Set("metric", d.Metric)
+	}
+}
+
+// WalkRequest walks a folder inside the server's allowed roots. At least one of Classify and Distance is needed.
+type WalkRequest struct {
+	Folder string
+	// Max is the most images to process, and must be set.
+	Max      int
+	Classify bool
+	Distance *Distance
+	// EncryptKey encrypts files before they are sent to the classifier.
+	EncryptKey string
+	// Incremental only processes images added or modified since the last incremental walk, and reports deleted ones.
+	Incremental bool
+	// Resume continues from the checkpoint of an interrupted walk.
+	Resume bool
+	// Archives looks inside zip and cbz archives.
+	Archives bool
+	// Count counts the images first, so that progress events have a total and an ETA.
+	Count bool
+	// Shard only processes the images of shard "i/n", such as "0/4".
+	Shard            string
+	Include, Exclude []string
+	MinSize, MaxSize int64
+	ModifiedAfter    time.Time
+	ModifiedBefore   time.Time
+	// Progress is how often progress events are sent. Zero uses the server's default of a second.
+	Progress time.Duration
+}
+
+// Values returns the query parameters of the request.
+func (r WalkRequest) Values() url.Values {
+	values := url.Values{"folder": {r.Folder}, "max": {strconv.Itoa(r.Max)}}
+	setBool(values, "classify", r.Classify)
+	r.Distance.set(values)
+	setString(values, "encrypt_key", r.EncryptKey)
+	setBool(values, "incremental", r.Incremental)
+	setBool(values, "resume", r.Resume)
+	setBool(values, "archives", r.Archives)
+	setBool(values, "count", r.Count)
+	setString(values, "shard", r.Shard)
+	for _, pattern := range r.Include {
+		values.Add("include", pattern)
+	}
+	for _, pattern := range r.Exclude {
+		values.Add("exclude", pattern)
+	}
+	if r.MinSize > 0 {
+		values.Set("min_size", strconv.FormatInt(r.MinSize, 10))
+	}
+	if r.MaxSize > 0 {
+		values.Set("max_size", strconv.FormatInt(r.MaxSize, 10))
+	}
+	if !r.ModifiedAfter.IsZero() {
+		values.Set("modified_after", r.ModifiedAfter.Format(time.RFC3339))
+	}
+	if !r.ModifiedBefore.IsZero() {
+		values.Set("modified_before", r.ModifiedBefore.Format(time.RFC3339))
+	}
+	setSeconds(values, "progress_seconds", r.Progress)
+	return values
+}
+
+// WatchRequest watches Inkbunny for new submissions. At least one of Classify and Distance is needed.
+// Clients watching with the same request share a single poller on the server.
+type WatchRequest struct {
+	SID        string
+	EncryptKey string
+	Classify   bool
+	Distance   *Distance
+	// RefreshRate is how often Inkbunny is searched, in whole seconds. Zero uses the server's default.
+	RefreshRate time.Duration
+}
+
+// Values returns the query parameters of the request.
+func (r WatchRequest) Values() url.Values {
+	values := make(url.Values)
+	setString(values, "sid", r.SID)
+	setString(values, "encrypt_key", r.EncryptKey)
+	setBool(values, "classify", r.Classify)
+	r.Distance.set(values)
+	if seconds := int(r.RefreshRate / time.Second); seconds > 0 {
+		values.Set("refresh_rate_seconds", strconv.Itoa(seconds))
+	}
+	return values
+}
+
+// SearchRequest scans every submission of an Inkbunny search once. At least one of Text, Username, PoolID
+// and DaysLimit is needed, along with one of Classify and Distance.
+type SearchRequest struct {
+	SID  string
+	Text string
+	// Keywords searches Text in keywords, which Inkbunny does by default.
+	Keywords  *bool
+	Username  string
+	PoolID    string
+	DaysLimit int
+	// Types are submission types, such as api.SubmissionTypePicturePinup.
+	Types []int
+	// OrderBy is how Inkbunny orders the results, such as "views".
+	OrderBy string
+	// Max is the most submissions to scan. Zero scans every one of them.
+	Max        int
+	EncryptKey string
+	Classify   bool
+	Distance   *Distance
+}
+
+// Values returns the query parameters of the request.
+func (r SearchRequest) Values() url.Values {
+	values := url.Values{"sid": {r.SID}}
+	setString(values, "text", r.Text)
+	if r.Keywords != nil {
+		values.Set("keywords", strconv.FormatBool(*r.Keywords))
+	}
+	setString(values, "username", r.Username)
+	setString(values, "pool_id", r.PoolID)
+	if r.DaysLimit > 0 {
+		values.Set("dayslimit", strconv.Itoa(r.DaysLimit))
+	}
+	if len(r.Types) > 0 {
+		types := make([]string, len(r.Types))
+		for i, t := range r.Types {
+			types[i] = strconv.Itoa(t)
+		}
+		values.Set("type", strings.Join(types, ","))
+	}
+	setString(values, "orderby", r.OrderBy)
+	if r.Max > 0 {
+		values.Set("max", strconv.Itoa(r.Max))
+	}
+	setString(values, "encrypt_key", r.EncryptKey)
+	setBool(values, "classify", r.Classify)
+	r.Distance.set(values)
+	return values
+}
+
+// FolderRequest watches a folder inside the server's allowed roots. At least one of Classify and Distance is needed.
+type FolderRequest struct {
+	Folder     string
+	EncryptKey string
+	Classify   bool
+	Distance   *Distance
+	// Existing also processes the images already in the folder.
+	Existing bool
+	// RefreshRate is how often the folder is polled, and Settle how long a file must be left unchanged
+	// before it is processed. Zero uses the server's defaults.
+	RefreshRate time.Duration
+	Settle      time.Duration
+}
+
+// Values returns the query parameters of the request.
+func (r FolderRequest) Values() url.Values {
+	values := url.Values{"folder": {r.Folder}}
+	setString(values, "encrypt_key", r.EncryptKey)
+	setBool(values, "classify", r.Classify)
+	r.Distance.set(values)
+	setBool(values, "existing", r.Existing)
+	setSeconds(values, "refresh_rate_seconds", r.RefreshRate)
+	setSeconds(values, "settle_seconds", r.Settle)
+	return values
+}
+
+func setString(values url.Values, key, value string) {
+	if value != "" {
+		values.Set(key, value)
+	}
+}
+
+func setBool(values url.Values, key string, value bool) {
+	if value {
+		values.Set(key, "true")
+	}
+}
+
+func setSeconds(values url.Values, key string, d time.Duration) {
+	if d > 0 {
+		values.Set(key, strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+	}
+}
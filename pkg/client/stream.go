@@ -0,0 +1,216 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"classifier/pkg/server"
+	"classifier/pkg/walker"
+)
+
+// Event is an event of a stream. Unnamed events carry a Result, while walks also send "progress" events
+// carrying Progress and end with a "summary" event carrying Summary. Searches end with a "summary" event
+// carrying SearchSummary instead. Data holds the event's JSON as sent.
+type Event struct {
+	ID            string
+	Name          string
+	Data          json.RawMessage
+	Result        *server.Result
+	Progress      *walker.Snapshot
+	Summary       *server.Summary
+	SearchSummary *server.SearchSummary
+}
+
+// decode unmarshals Data into the field that matches the event's name. Events it does not know are left as Data.
+func (e *Event) decode() error {
+	var v any
+	switch e.Name {
+	case "":
+		e.Result = new(server.Result)
+		v = e.Result
+	case "progress":
+		e.Progress = new(walker.Snapshot)
+		v = e.Progress
+	case "summary":
+		e.Summary = new(server.Summary)
+		v = e.Summary
+	default:
+		return nil
+	}
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return fmt.Errorf("invalid %q event %s: %w", e.Name, e.ID, err)
+	}
+	return nil
+}
+
+// Walk walks a folder, with the events described by Event.
+func (c *Client) Walk(ctx context.Context, r WalkRequest) iter.Seq2[Event, error] {
+	return c.Stream(ctx, "/walk", r.Values())
+}
+
+// Watch streams a Result for every new Inkbunny submission that matched, until ctx is done.
+func (c *Client) Watch(ctx context.Context, r WatchRequest) iter.Seq2[Event, error] {
+	return c.Stream(ctx, "/watch", r.Values())
+}
+
+// Search scans every submission of an Inkbunny search once, with the events described by Event.
+func (c *Client) Search(ctx context.Context, r SearchRequest) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		for event, err := range c.Stream(ctx, "/search", r.Values()) {
+			if err == nil && event.Name == "summary" {
+				event.Summary, event.SearchSummary = nil, new(server.SearchSummary)
+				if err = json.Unmarshal(event.Data, event.SearchSummary); err != nil {
+					err = fmt.Errorf("invalid \"summary\" event %s: %w", event.ID, err)
+					event = Event{}
+				}
+			}
+			if !yield(event, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// WatchFolder streams a Result for every image added to or modified in a folder, until ctx is done.
+// Folder watches cannot be resumed, so reconnecting starts watching again.
+func (c *Client) WatchFolder(ctx context.Context, r FolderRequest) iter.Seq2[Event, error] {
+	return c.Stream(ctx, "/watch/folder", r.Values())
+}
+
+// JobResults streams the results of a job from offset onwards, until the job finishes.
+func (c *Client) JobResults(ctx context.Context, id string, offset int) iter.Seq2[Event, error] {
+	query := url.Values{"stream": {"true"}, "offset": {strconv.Itoa(offset)}}
+	return c.Stream(ctx, "/jobs/"+url.PathEscape(id)+"/results", query)
+}
+
+// errStopped is returned by read once the caller stopped iterating.
+var errStopped = errors.New("stopped reading the stream")
+
+// errStreamEnded is returned by read when the connection was closed before the stream's exit event.
+var errStreamEnded = errors.New("stream ended before its exit event")
+
+// Stream reads the server-sent events of the GET endpoint at path until its exit event. When the connection drops,
+// or the server asks to retry later, it reconnects with Last-Event-ID so that the stream continues where it left off,
+// giving up after Retries attempts in a row. Errors end the sequence, and are yielded with an empty Event,
+// including the context's error once it is done.
+func (c *Client) Stream(ctx context.Context, path string, query url.Values) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		var lastID string
+		failures := 0
+		for {
+			received, err := c.read(ctx, path, query, &lastID, yield)
+			if err == nil || errors.Is(err, errStopped) {
+				return
+			}
+			if ctx.Err() != nil {
+				yield(Event{}, ctx.Err())
+				return
+			}
+			if received {
+				failures = 0
+			}
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && !statusErr.Temporary() || failures >= c.Retries {
+				yield(Event{}, err)
+				return
+			}
+			failures++
+			delay := c.RetryDelay
+			if statusErr != nil && statusErr.RetryAfter > delay {
+				delay = statusErr.RetryAfter
+			}
+			select {
+			case <-ctx.Done():
+				yield(Event{}, ctx.Err())
+				return
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// read connects to the stream once, yielding its events until the exit event, and updating lastID with the id
+// of every event received. It reports whether any event was received, and returns nil once the stream is over.
+func (c *Client) read(ctx context.Context, path string, query url.Values, lastID *string, yield func(Event, error) bool) (bool, error) {
+	req, err := c.newRequest(ctx, path, query)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// The server responds without a stream when the request has nothing to do, such as when neither classify
+	// nor distance is enabled.
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		return false, nil
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	received := false
+	var event Event
+	var data []byte
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errStreamEnded
+			}
+			return received, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		switch {
+		case line == "":
+			if event.Name == "" && data == nil {
+				continue
+			}
+			if event.Name == "exit" {
+				return received, nil
+			}
+			event.Data = data
+			if err := event.decode(); err != nil {
+				yield(Event{}, err)
+				return received, errStopped
+			}
+			if event.ID != "" {
+				*lastID = event.ID
+			}
+			received = true
+			if !yield(event, nil) {
+				return received, errStopped
+			}
+			event, data = Event{}, nil
+		case strings.HasPrefix(line, ":"):
+			// Comments such as heartbeats only keep the connection open.
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "id":
+				event.ID = value
+			case "event":
+				event.Name = value
+			case "data":
+				if data != nil {
+					data = append(data, '\n')
+				}
+				data = append(data, value...)
+			}
+		}
+	}
+}
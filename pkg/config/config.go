@@ -0,0 +1,233 @@
+// Package config reads the server configuration file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"classifier/pkg/distance"
+)
+
+// Config is the server configuration. Fields that are left out of the file keep their Default.
+type Config struct {
+	// Listen is the address the server listens on, such as ":8080".
+	Listen string `json:"listen"`
+	// AllowedRoots are the folders clients may walk and read files from.
+	AllowedRoots []string `json:"allowed_roots"`
+	// Distance holds the defaults for requests that do not set threshold or metric.
+	Distance Distance `json:"distance"`
+	// Concurrency is how many files each stage works on at once.
+	Concurrency Concurrency `json:"concurrency"`
+	// Classifier is where images are sent to be classified.
+	Classifier Classifier `json:"classifier"`
+	// Limits protect the server and the classifier from any single client.
+	Limits Limits `json:"limits"`
+	// Cache holds where the server keeps its files.
+	Cache Cache `json:"cache"`
+	// DrainSeconds is how long open requests, streams and jobs get to finish when the server shuts down.
+	DrainSeconds int `json:"drain_seconds"`
+
+	env error // env is the error reading the environment in Default, which Validate reports.
+}
+
+type Distance struct {
+	Threshold float64 `json:"threshold"`
+	Metric    string  `json:"metric"`
+}
+
+type Concurrency struct {
+	Distance int `json:"distance"`
+	Classify int `json:"classify"`
+	Download int `json:"download"` // Download is used for Inkbunny submissions, which are downloaded before they are classified.
+}
+
+type Classifier struct {
+	PredictURL string `json:"predict_url"`
+	// Concurrency is how many requests are sent to the classifier at once, across every client.
+	Concurrency int `json:"concurrency"`
+	// BackgroundShare is the part of Concurrency guaranteed to jobs, while interactive requests get the rest.
+	// Either can use the other's part while it is idle.
+	BackgroundShare float64 `json:"background_share"`
+}
+
+// Limits are applied to each client, identified by API key or else by IP address.
+type Limits struct {
+	// RequestsPerSecond is how fast a client can start walks, watches, uploads and jobs, with bursts of up to Burst.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	// Concurrent is how many walks, watches and uploads a client can have open at once.
+	Concurrent int `json:"concurrent"`
+	// Jobs is how many jobs a client can have running at once.
+	Jobs int `json:"jobs"`
+	// ArchiveMB is how much of an archive entry, or of a compressed tarball, is read into memory at most.
+	ArchiveMB int `json:"archive_mb"`
+	// APIKeys maps the keys clients send in the X-API-Key header to their names. Clients with a key
+	// share their limits across addresses, while unknown keys are ignored.
+	APIKeys map[string]string `json:"api_keys"`
+}
+
+type Cache struct {
+	Classifications string `json:"classifications"`
+	Jobs            string `json:"jobs"`
+	Thumbnails      string `json:"thumbnails"`
+	ThumbnailsMB    int    `json:"thumbnails_mb"`
+	// Labels is where the classes given by reviewers are kept, apart from the classifications.
+	Labels string `json:"labels"`
+	// Profiles is the folder the artist galleries scanned for profiles are kept in.
+	Profiles string `json:"profiles"`
+	// CheckpointSeconds is how often the classifications are saved while the server runs.
+	CheckpointSeconds int `json:"checkpoint_seconds"`
+}
+
+// Default returns the configuration used without a file. PORT, PREDICT_URL, ALLOWED_ROOTS
+// and THUMBNAIL_CACHE_MB are still read from the environment, as they were before there was a file.
+// Invalid values are reported by Validate.
+func Default() *Config {
+	c := &Config{
+		Listen:       ":8080",
+		AllowedRoots: []string{"."},
+		Distance:     Distance{Threshold: 0.1, Metric: "DistanceLab"},
+		Concurrency:  Concurrency{Distance: runtime.NumCPU(), Classify: runtime.NumCPU(), Download: 30},
+		Classifier:   Classifier{PredictURL: "http://localhost:7860/predict", Concurrency: runtime.NumCPU(), BackgroundShare: 0.5},
+		Limits:       Limits{RequestsPerSecond: 1, Burst: 10, Concurrent: 4, Jobs: 2, ArchiveMB: 256},
+		Cache: Cache{
+			Classifications:   "classifications.json",
+			Jobs:              "jobs",
+			Thumbnails:        "thumbnails",
+			ThumbnailsMB:      256,
+			Labels:            "labels.jsonl",
+			Profiles:          "profiles",
+			CheckpointSeconds: 300,
+		},
+		DrainSeconds: 30,
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		c.Listen = ":" + port
+	}
+	if predict := os.Getenv("PREDICT_URL"); predict != "" {
+		c.Classifier.PredictURL = predict
+	}
+	if roots := filepath.SplitList(os.Getenv("ALLOWED_ROOTS")); len(roots) > 0 {
+		c.AllowedRoots = roots
+	}
+	if mb := os.Getenv("THUMBNAIL_CACHE_MB"); mb != "" {
+		var err error
+		if c.Cache.ThumbnailsMB, err = strconv.Atoi(mb); err != nil {
+			c.env = fmt.Errorf("THUMBNAIL_CACHE_MB: %w", err)
+		}
+	}
+	return c
+}
+
+// Load reads the file at name over the Default configuration and validates it.
+// Unknown fields are rejected, so that typos are not silently ignored.
+func Load(name string) (*Config, error) {
+	c := Default()
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return c, nil
+}
+
+// Validate reports every invalid field at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.env != nil {
+		errs = append(errs, c.env)
+	}
+	if c.Listen == "" {
+		errs = append(errs, errors.New("listen is required"))
+	}
+	if len(c.AllowedRoots) == 0 {
+		errs = append(errs, errors.New("allowed_roots needs at least one folder"))
+	}
+	for _, root := range c.AllowedRoots {
+		if info, err := os.Stat(root); err != nil {
+			errs = append(errs, fmt.Errorf("allowed_roots: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("allowed_roots: %s is not a folder", root))
+		}
+	}
+	if c.Distance.Threshold < 0 {
+		errs = append(errs, fmt.Errorf("distance.threshold must not be negative, got %v", c.Distance.Threshold))
+	}
+	if _, ok := distance.Metrics[c.Distance.Metric]; !ok {
+		names := slices.Sorted(maps.Keys(distance.Metrics))
+		errs = append(errs, fmt.Errorf("distance.metric %q must be one of %s", c.Distance.Metric, strings.Join(names, ", ")))
+	}
+	for _, stage := range []struct {
+		name string
+		n    int
+	}{{"distance", c.Concurrency.Distance}, {"classify", c.Concurrency.Classify}, {"download", c.Concurrency.Download}} {
+		if stage.n < 1 {
+			errs = append(errs, fmt.Errorf("concurrency.%s must be at least 1, got %d", stage.name, stage.n))
+		}
+	}
+	if u, err := url.Parse(c.Classifier.PredictURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("classifier.predict_url %q is not an absolute URL", c.Classifier.PredictURL))
+	}
+	if c.Classifier.Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("classifier.concurrency must be at least 1, got %d", c.Classifier.Concurrency))
+	}
+	if c.Classifier.BackgroundShare < 0 || c.Classifier.BackgroundShare > 1 {
+		errs = append(errs, fmt.Errorf("classifier.background_share must be between 0 and 1, got %v", c.Classifier.BackgroundShare))
+	}
+	if c.Limits.RequestsPerSecond <= 0 {
+		errs = append(errs, fmt.Errorf("limits.requests_per_second must be positive, got %v", c.Limits.RequestsPerSecond))
+	}
+	for _, limit := range []struct {
+		name string
+		n    int
+	}{{"burst", c.Limits.Burst}, {"concurrent", c.Limits.Concurrent}, {"jobs", c.Limits.Jobs}, {"archive_mb", c.Limits.ArchiveMB}} {
+		if limit.n < 1 {
+			errs = append(errs, fmt.Errorf("limits.%s must be at least 1, got %d", limit.name, limit.n))
+		}
+	}
+	if c.Cache.Classifications == "" || c.Cache.Jobs == "" || c.Cache.Thumbnails == "" || c.Cache.Labels == "" || c.Cache.Profiles == "" {
+		errs = append(errs, errors.New("cache.classifications, cache.jobs, cache.thumbnails, cache.labels and cache.profiles are required"))
+	}
+	if c.Cache.ThumbnailsMB < 1 {
+		errs = append(errs, fmt.Errorf("cache.thumbnails_mb must be at least 1, got %d", c.Cache.ThumbnailsMB))
+	}
+	if c.Cache.CheckpointSeconds < 1 {
+		errs = append(errs, fmt.Errorf("cache.checkpoint_seconds must be at least 1, got %d", c.Cache.CheckpointSeconds))
+	}
+	if c.DrainSeconds < 0 {
+		errs = append(errs, fmt.Errorf("drain_seconds must not be negative, got %d", c.DrainSeconds))
+	}
+	return errors.Join(errs...)
+}
+
+// RestartRequired returns the fields that differ from old but are only read at startup.
+func (c *Config) RestartRequired(old *Config) []string {
+	var fields []string
+	if c.Listen != old.Listen {
+		fields = append(fields, "listen")
+	}
+	if c.Cache != old.Cache {
+		fields = append(fields, "cache")
+	}
+	if c.DrainSeconds != old.DrainSeconds {
+		fields = append(fields, "drain_seconds")
+	}
+	return fields
+}
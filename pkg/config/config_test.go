@@ -0,0 +1,76 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := Load(writeConfig(t, `{"allowed_roots": ["`+filepath.ToSlash(dir)+`"], "distance": {"threshold": 0.2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Distance.Threshold != 0.2 || cfg.Distance.Metric != "DistanceLab" {
+		t.Errorf("got distance %+v, want the threshold from the file and the default metric", cfg.Distance)
+	}
+	if len(cfg.AllowedRoots) != 1 || cfg.AllowedRoots[0] != filepath.ToSlash(dir) {
+		t.Errorf("got allowed roots %v", cfg.AllowedRoots)
+	}
+	if cfg.Cache != Default().Cache {
+		t.Errorf("got cache %+v, want the defaults", cfg.Cache)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		`{"lisen": ":8080"}`:                            "unknown field",
+		`{"distance": {"metric": "DistanceFoo"}}`:       "distance.metric",
+		`{"concurrency": {"classify": 0}}`:              "concurrency.classify",
+		`{"classifier": {"predict_url": "localhost"}}`:  "classifier.predict_url",
+		`{"allowed_roots": ["/does/not/exist"]}`:        "allowed_roots",
+		`{"cache": {"thumbnails_mb": 0, "jobs": ""}}`:   "cache.thumbnails_mb",
+		`{"distance": {"threshold": -1}, "listen": ""}`: "listen is required",
+	}
+	for content, want := range tests {
+		_, err := Load(writeConfig(t, content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load(%s) = %v, want an error about %s", content, err, want)
+		}
+	}
+}
+
+func TestDefaultInvalidEnv(t *testing.T) {
+	t.Setenv("THUMBNAIL_CACHE_MB", "lots")
+	if err := Default().Validate(); err == nil || !strings.Contains(err.Error(), "THUMBNAIL_CACHE_MB") {
+		t.Errorf("got %v, want an error about THUMBNAIL_CACHE_MB", err)
+	}
+	if _, err := Load(writeConfig(t, `{}`)); err == nil {
+		t.Error("Load accepted an invalid THUMBNAIL_CACHE_MB")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old, cfg := Default(), Default()
+	cfg.Distance.Threshold = 0.5
+	cfg.AllowedRoots = []string{"elsewhere"}
+	if fields := cfg.RestartRequired(old); len(fields) != 0 {
+		t.Errorf("got %v, want no fields", fields)
+	}
+	cfg.Listen = ":9090"
+	cfg.Cache.ThumbnailsMB = 1
+	if fields := cfg.RestartRequired(old); strings.Join(fields, ",") != "listen,cache" {
+		t.Errorf("got %v, want listen and cache", fields)
+	}
+}
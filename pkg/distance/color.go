@@ -15,6 +15,16 @@ import (
 	"github.com/lucasb-eyer/go-colorful"
 )
 
+// Metrics are the color distance functions that can be chosen by name.
+var Metrics = map[string]func(colorful.Color, colorful.Color) float64{
+	"DistanceRgb":       colorful.Color.DistanceRgb,
+	"DistanceLab":       colorful.Color.DistanceLab,
+	"DistanceLuv":       colorful.Color.DistanceLuv,
+	"DistanceCIE76":     colorful.Color.DistanceCIE76,
+	"DistanceCIE94":     colorful.Color.DistanceCIE94,
+	"DistanceCIEDE2000": colorful.Color.DistanceCIEDE2000,
+}
+
 // PixelDistance inspects the image at reader and returns the distance according to distanceFunc.
 // It returns the lowest distance found.
 func PixelDistance(ctx context.Context, name string, file io.Reader, target colorful.Color, distanceFunc func(colorful.Color, colorful.Color) float64) float64 {
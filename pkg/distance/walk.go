@@ -3,6 +3,7 @@ package distance
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"os"
 
 	"github.com/lucasb-eyer/go-colorful"
@@ -20,6 +21,8 @@ type Config struct {
 	Enabled   bool
 	Max       int
 	Skipper   func(path string) bool
+	Filter    walker.Filter
+	Archives  bool
 	Semaphore chan struct{}
 
 	Args
@@ -34,11 +37,19 @@ type Args struct {
 // WalkDir traverses the folder rooted at "root" and, for each image file,
 // spawns a goroutine (limited by a semaphore of size runtime.NumCPU by default)
 func WalkDir(ctx context.Context, root string, results chan<- Result, config Config) error {
-	return walker.WalkDir(ctx, root, results, walker.Config[Result, Args]{
+	return WalkFS(ctx, os.DirFS(root), root, results, config)
+}
+
+// WalkFS is like WalkDir, but walks any fs.FS such as an archive or an embedded file system.
+// Reported paths are joined with root.
+func WalkFS(ctx context.Context, fsys fs.FS, root string, results chan<- Result, config Config) error {
+	return walker.WalkFS(ctx, fsys, root, results, walker.Config[Result, Args]{
 		Enabled:   config.Enabled,
 		Max:       config.Max,
 		Semaphore: config.Semaphore,
 		Skipper:   walker.Skippers(utils.NotImage, config.Skipper),
+		Filter:    config.Filter,
+		Archives:  config.Archives,
 		Do:        Do,
 		Args:      config.Args,
 	})
@@ -49,7 +60,7 @@ func Do(args walker.Args[Args]) (Result, error) {
 		args.Args.Metric = colorful.Color.DistanceLab
 	}
 
-	file, err := os.Open(args.Path)
+	file, err := args.Open()
 	if err != nil {
 		return Result{Path: args.Path}, err
 	}
@@ -0,0 +1,66 @@
+package distance
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+func solid(t *testing.T, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := range 4 {
+		for x := range 4 {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWalkFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"red.png":        {Data: solid(t, color.RGBA{R: 255, A: 255})},
+		"nested/red.png": {Data: solid(t, color.RGBA{R: 250, A: 255})},
+		"blue.png":       {Data: solid(t, color.RGBA{B: 255, A: 255})},
+		"notes.txt":      {Data: []byte("not an image")},
+	}
+	red, _ := colorful.Hex("#ff0000")
+
+	tests := []struct {
+		name      string
+		threshold float64
+		want      int
+	}{
+		{"exact", 0.001, 1},
+		{"close", 0.1, 2},
+		{"everything", 10, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make(chan Result)
+			go WalkFS(context.Background(), fsys, "", results, Config{
+				Enabled: true,
+				Args:    Args{Target: red, Threshold: tt.threshold},
+			})
+			var got int
+			for result := range results {
+				if result.Color == nil {
+					t.Errorf("%s has no distance", result.Path)
+				}
+				got++
+			}
+			if got != tt.want {
+				t.Errorf("got %d results, want %d", got, tt.want)
+			}
+		})
+	}
+}
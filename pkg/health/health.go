@@ -0,0 +1,157 @@
+// Package health checks whether the classifier backend, the data folder and Inkbunny are ready to be used.
+package health
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/ellypaws/inkbunny/api"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/utils"
+)
+
+// Timeout is how long a single check may take.
+var Timeout = 10 * time.Second
+
+// Check is a named readiness check. Run returns nil once whatever it checks is ready.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of a Check.
+type Result struct {
+	Name     string  `json:"name"`
+	OK       bool    `json:"ok"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"` // in seconds
+}
+
+// Report holds the results of every check, and is only Ready when all of them passed.
+type Report struct {
+	Ready  bool     `json:"ready"`
+	Checks []Result `json:"checks"`
+}
+
+// Run runs every check concurrently, each limited to Timeout.
+func Run(ctx context.Context, checks ...Check) Report {
+	report := Report{Ready: true, Checks: make([]Result, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, Timeout)
+			defer cancel()
+			start := time.Now()
+			err := check.Run(ctx)
+			report.Checks[i] = Result{Name: check.Name, OK: err == nil, Duration: time.Since(start).Seconds()}
+			if err != nil {
+				report.Checks[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		report.Ready = report.Ready && result.OK
+	}
+	return report
+}
+
+// Wait runs the checks every interval until they all pass, or returns the context's error once it is done.
+func Wait(ctx context.Context, interval time.Duration, checks ...Check) error {
+	for {
+		report := Run(ctx, checks...)
+		if report.Ready {
+			return nil
+		}
+		for _, result := range report.Checks {
+			if !result.OK {
+				log.Warn("Waiting for readiness", "check", result.Name, "err", result.Error)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// testImage is a tiny PNG sent to the classifier backend.
+var testImage = sync.OnceValue(func() []byte {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 4)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+})
+
+// Classifier checks that the classifier backend has loaded its model by classifying a tiny built-in image.
+func Classifier() Check {
+	return Check{Name: "classifier", Run: func(ctx context.Context) error {
+		prediction, err := classify.Predict(ctx, "readyz.png", "", bytes.NewReader(testImage()))
+		if err != nil {
+			return err
+		}
+		if len(prediction) == 0 {
+			return errors.New("classifier returned no prediction")
+		}
+		return nil
+	}}
+}
+
+// Writable checks that files can be created in dir.
+func Writable(dir string) Check {
+	return Check{Name: "data", Run: func(context.Context) error {
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", dir, err)
+		}
+		name := f.Name()
+		_, err = f.Write([]byte("ok"))
+		err = errors.Join(err, f.Close(), os.Remove(name))
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", dir, err)
+		}
+		return nil
+	}}
+}
+
+// InkbunnySID checks that sid is a valid Inkbunny session, with a search that returns no submissions.
+func InkbunnySID(sid string) Check {
+	return Check{Name: "inkbunny", Run: func(ctx context.Context) error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := api.Credentials{Sid: sid}.SearchSubmissions(api.SubmissionSearchRequest{
+				SID:                sid,
+				SubmissionsPerPage: 1,
+				NoSubmissions:      true,
+			})
+			utils.CountInkbunnyCall("search", err)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				return fmt.Errorf("invalid sid: %w", err)
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+}
@@ -0,0 +1,62 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	ok := Check{Name: "ok", Run: func(context.Context) error { return nil }}
+	failing := Check{Name: "failing", Run: func(context.Context) error { return errors.New("down") }}
+
+	if report := Run(t.Context(), ok, Writable(t.TempDir())); !report.Ready {
+		t.Errorf("got %+v, want ready", report)
+	}
+	report := Run(t.Context(), ok, failing)
+	if report.Ready {
+		t.Errorf("got ready with a failing check")
+	}
+	if got := report.Checks[1]; got.Name != "failing" || got.OK || got.Error != "down" {
+		t.Errorf("got %+v for the failing check", got)
+	}
+}
+
+func TestWritable(t *testing.T) {
+	if err := Writable(filepath.Join(t.TempDir(), "missing")).Run(t.Context()); err == nil {
+		t.Error("a missing folder should not be writable")
+	}
+}
+
+func TestWait(t *testing.T) {
+	var calls int
+	flaky := Check{Name: "flaky", Run: func(context.Context) error {
+		if calls++; calls < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	}}
+	if err := Wait(t.Context(), time.Millisecond, flaky); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	never := Check{Name: "never", Run: func(context.Context) error { return errors.New("down") }}
+	if err := Wait(ctx, time.Millisecond, never); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestImage(t *testing.T) {
+	if _, err := png.Decode(bytes.NewReader(testImage())); err != nil {
+		t.Fatal(err)
+	}
+}
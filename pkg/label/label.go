@@ -0,0 +1,247 @@
+// Package label keeps the classes reviewers gave to images, apart from the predictions of the classifier,
+// so that both can be compared and the labels used as training data.
+package label
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"classifier/pkg/classify"
+)
+
+// Label is the class a reviewer gave to the image at Path.
+type Label struct {
+	Path     string    `json:"path"`
+	Class    string    `json:"class"`
+	Reviewer string    `json:"reviewer"`
+	Time     time.Time `json:"time"`
+	// Prediction and Model are what the classifier predicted for Path when it was labeled, if anything.
+	Prediction classify.Prediction `json:"prediction,omitempty"`
+	Model      string              `json:"model,omitempty"`
+}
+
+// classRegexp matches class names, which are used as folder names when exporting.
+var classRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Validate reports whether the label can be stored.
+func (l Label) Validate() error {
+	var errs []error
+	if l.Path == "" {
+		errs = append(errs, errors.New("path is required"))
+	}
+	if !classRegexp.MatchString(l.Class) {
+		errs = append(errs, fmt.Errorf("class %q must only have letters, digits, _ and -", l.Class))
+	}
+	if l.Reviewer == "" {
+		errs = append(errs, errors.New("reviewer is required"))
+	}
+	return errors.Join(errs...)
+}
+
+// Agrees reports whether the most likely class of the prediction made when labeling is the label's class.
+func (l Label) Agrees() bool {
+	if len(l.Prediction) == 0 {
+		return false
+	}
+	class, _ := l.Prediction.Max()
+	return class == l.Class
+}
+
+type lease struct {
+	reviewer string
+	until    time.Time
+}
+
+// Store appends every label to a JSON Lines file, so that the history of each path is kept,
+// and remembers the latest label of each path.
+type Store struct {
+	mu     sync.RWMutex
+	file   *os.File
+	latest map[string]Label
+	leases map[string]lease
+	// classes is every class ever given, including those only found in the history.
+	classes map[string]bool
+}
+
+// Open reads the labels saved at name and appends new ones to it.
+func Open(name string) (*Store, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{file: file, latest: make(map[string]Label), leases: make(map[string]lease), classes: make(map[string]bool)}
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 && data[len(data)-1] == '\n' {
+			var l Label
+			if err := json.Unmarshal(data, &l); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+			}
+			s.latest[l.Path] = l
+			s.classes[l.Class] = true
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Close closes the file labels are appended to.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Add saves l as the latest label of its path, and releases the path's lease.
+func (s *Store) Add(l Label) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.latest[l.Path] = l
+	s.classes[l.Class] = true
+	delete(s.leases, l.Path)
+	return nil
+}
+
+// Get returns the latest label of path.
+func (s *Store) Get(path string) (Label, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.latest[path]
+	return l, ok
+}
+
+// Latest returns the latest label of every path, sorted by path.
+func (s *Store) Latest() []Label {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	labels := make([]Label, 0, len(s.latest))
+	for _, path := range slices.Sorted(maps.Keys(s.latest)) {
+		labels = append(labels, s.latest[path])
+	}
+	return labels
+}
+
+// Classes returns every class ever given, sorted, including those no image is labeled as anymore.
+func (s *Store) Classes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Sorted(maps.Keys(s.classes))
+}
+
+// Lease reserves the unlabeled path for reviewer until d from now, so that reviewers working at the same time
+// are handed different images. It reports false if the path is labeled or leased to another reviewer.
+func (s *Store) Lease(path, reviewer string, d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.latest[path]; ok {
+		return false
+	}
+	now := time.Now()
+	if l, ok := s.leases[path]; ok && l.reviewer != reviewer && now.Before(l.until) {
+		return false
+	}
+	s.leases[path] = lease{reviewer: reviewer, until: now.Add(d)}
+	return true
+}
+
+// Split returns "val" for about fraction of the paths and "train" for the others.
+// The same path always lands in the same split, so exporting again does not mix them.
+func Split(path string, fraction float64) string {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	if float64(h.Sum32()%10000) < fraction*10000 {
+		return "val"
+	}
+	return "train"
+}
+
+// FileName is the name an image is exported as: a hash of its path, so that images with the same name
+// in different folders do not collide, followed by its extension.
+func FileName(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	name := p
+	if u, err := url.Parse(p); err == nil && u.Scheme != "" && u.Host != "" {
+		name = u.Path
+	}
+	ext := strings.ToLower(path.Ext(filepath.ToSlash(name)))
+	return hex.EncodeToString(sum[:8]) + ext
+}
+
+// Export copies the image of every label into dir in the folder layout of YOLO classification datasets,
+// dir/{train,val}/<class>/<image>, with fraction of them in val. open reads an image, create writes one
+// and remove deletes one. Copies left by an earlier export under any other split or any of classes,
+// such as those of images that were relabeled since, are removed so that each image is only in one folder.
+// It returns how many images were exported for each class, along with the errors of those that were skipped
+// or whose old copies could not be removed.
+func Export(labels []Label, classes []string, dir string, fraction float64, open func(path string) (io.ReadCloser, error), create func(name string) (io.WriteCloser, error), remove func(name string) error) (map[string]int, error) {
+	counts := make(map[string]int)
+	var errs []error
+	for _, l := range labels {
+		split, file := Split(l.Path, fraction), FileName(l.Path)
+		if err := copyImage(l.Path, filepath.Join(dir, split, l.Class, file), open, create); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.Path, err))
+			continue
+		}
+		counts[l.Class]++
+		for _, s := range []string{"train", "val"} {
+			for _, class := range classes {
+				if s == split && class == l.Class {
+					continue
+				}
+				if err := remove(filepath.Join(dir, s, class, file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					errs = append(errs, fmt.Errorf("%s: %w", l.Path, err))
+				}
+			}
+		}
+	}
+	return counts, errors.Join(errs...)
+}
+
+func copyImage(src, dst string, open func(string) (io.ReadCloser, error), create func(string) (io.WriteCloser, error)) error {
+	r, err := open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return errors.Join(err, w.Close())
+}
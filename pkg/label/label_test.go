@@ -0,0 +1,140 @@
+package label
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"classifier/pkg/classify"
+)
+
+func TestStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "labels.jsonl")
+	s, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(Label{Path: "a.png", Class: "bad class", Reviewer: "alice"}); err == nil {
+		t.Error("expected an error for a class with a space")
+	}
+	if !s.Lease("a.png", "alice", time.Minute) {
+		t.Error("expected to lease an unlabeled path")
+	}
+	if s.Lease("a.png", "bob", time.Minute) {
+		t.Error("leased a path that is leased to another reviewer")
+	}
+	for _, l := range []Label{
+		{Path: "a.png", Class: "cat", Reviewer: "alice", Prediction: classify.Prediction{"dog": 0.6, "cat": 0.4}},
+		{Path: "b.png", Class: "dog", Reviewer: "bob"},
+		{Path: "a.png", Class: "dog", Reviewer: "bob", Prediction: classify.Prediction{"dog": 0.6, "cat": 0.4}},
+	} {
+		if err := s.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Lease("a.png", "alice", time.Minute) {
+		t.Error("leased a labeled path")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	latest := s.Latest()
+	if len(latest) != 2 || latest[0].Path != "a.png" || latest[1].Path != "b.png" {
+		t.Fatalf("got %+v", latest)
+	}
+	if latest[0].Class != "dog" || latest[0].Reviewer != "bob" || !latest[0].Agrees() {
+		t.Errorf("got %+v, want the latest label of a.png, agreeing with its prediction", latest[0])
+	}
+	if latest[1].Agrees() {
+		t.Error("a label without a prediction agrees with it")
+	}
+	if classes := s.Classes(); !slices.Equal(classes, []string{"cat", "dog"}) {
+		t.Errorf("got classes %v, want cat from the history along with dog", classes)
+	}
+}
+
+func TestExport(t *testing.T) {
+	labels := []Label{
+		{Path: "cats/a.png", Class: "cat"},
+		{Path: "dogs/a.png", Class: "dog"},
+		{Path: "https://us.ib.metapix.net/files/full/1/1_artist_b.JPG?key=secret", Class: "dog"},
+		{Path: "missing.png", Class: "cat"},
+	}
+	open := func(path string) (io.ReadCloser, error) {
+		if path == "missing.png" {
+			return nil, fs.ErrNotExist
+		}
+		return io.NopCloser(bytes.NewReader([]byte(path))), nil
+	}
+	files := make(map[string]*bytes.Buffer)
+	create := func(name string) (io.WriteCloser, error) {
+		files[name] = new(bytes.Buffer)
+		return nopWriteCloser{files[name]}, nil
+	}
+	remove := func(name string) error {
+		if _, ok := files[name]; !ok {
+			return fs.ErrNotExist
+		}
+		delete(files, name)
+		return nil
+	}
+	// A copy left by an export made before cats/a.png was relabeled, and in the other split.
+	stale := filepath.Join("dataset", "val", "dog", FileName(labels[0].Path))
+	if Split(labels[0].Path, 0.5) == "val" {
+		stale = filepath.Join("dataset", "train", "dog", FileName(labels[0].Path))
+	}
+	files[stale] = new(bytes.Buffer)
+
+	counts, err := Export(labels, []string{"cat", "dog"}, "dataset", 0.5, open, create, remove)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want the error of the missing image", err)
+	}
+	if counts["cat"] != 1 || counts["dog"] != 2 {
+		t.Errorf("got %v", counts)
+	}
+	for _, l := range labels[:3] {
+		name := filepath.Join("dataset", Split(l.Path, 0.5), l.Class, FileName(l.Path))
+		if got := files[name]; got == nil || got.String() != l.Path {
+			t.Errorf("%s was not exported to %s", l.Path, name)
+		}
+	}
+	if _, ok := files[stale]; ok || len(files) != 3 {
+		t.Errorf("got %d files, want the stale copy %s to be removed", len(files), stale)
+	}
+	if ext := filepath.Ext(FileName(labels[2].Path)); ext != ".jpg" {
+		t.Errorf("got extension %q for a URL, want .jpg", ext)
+	}
+	if FileName(labels[0].Path) == FileName(labels[1].Path) {
+		t.Error("images with the same name in different folders collide")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	val := 0
+	for i := range 1000 {
+		if Split(filepath.Join("images", string(rune('a'+i%26)), time.Duration(i).String()), 0.2) == "val" {
+			val++
+		}
+	}
+	if val < 150 || val > 250 {
+		t.Errorf("got %d of 1000 images in val, want about 200", val)
+	}
+	if Split("a.png", 0) != "train" || Split("a.png", 1) != "val" {
+		t.Error("fractions of 0 and 1 should put every image in train and val")
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -1,17 +1,56 @@
 package lib
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"sync"
 )
 
+// Files are encrypted in chunks with AES-GCM, using the STREAM construction so that chunks cannot be reordered,
+// dropped or appended to. They start with a header of the magic, the format version and a random nonce prefix,
+// and every chunk is sealed with the header as additional data and a nonce of the prefix, the chunk counter
+// and whether it is the last chunk:
+//
+//	magic (6) | version (1) | nonce prefix (7) | chunk 0 | ... | chunk n
+//	chunk: ciphertext (up to ChunkSize) | tag (16)
+//
+// Files without the magic are LegacyVersion files, a random AES-CTR IV followed by the ciphertext, which
+// are still read but no longer written.
+const (
+	magic = "CLSENC"
+
+	LegacyVersion = 1
+	Version       = 2
+
+	// ChunkSize is how much plaintext is sealed in each chunk. Every chunk is full but the last.
+	ChunkSize = 64 << 10
+
+	noncePrefixSize = 7
+	headerSize      = len(magic) + 1 + noncePrefixSize
+)
+
+// AuthError is returned when a chunk of an encrypted file fails authentication, because the file was modified,
+// truncated or encrypted with another key. Nothing of a chunk is read before it is authenticated, but the chunks
+// before it were.
+type AuthError struct {
+	Chunk uint32
+	Err   error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("chunk %d could not be authenticated, the file was modified, truncated or encrypted with another key: %v", e.Chunk, e.Err)
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
 // deriveKey creates a 32-byte key from the input string using SHA-256.
 func deriveKey(key string) []byte {
 	hash := sha256.Sum256([]byte(key))
@@ -23,6 +62,7 @@ func deriveKey(key string) []byte {
 type Crypto struct {
 	key   string
 	block cipher.Block
+	aead  cipher.AEAD
 }
 
 // NewCrypto initializes a new Crypto instance using the provided key.
@@ -35,9 +75,14 @@ func NewCrypto(key string) (*Crypto, error) {
 	if err != nil {
 		return nil, err
 	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
 	return &Crypto{
 		key:   key,
 		block: block,
+		aead:  aead,
 	}, nil
 }
 
@@ -48,144 +93,332 @@ func (c *Crypto) Key() string {
 	return c.key
 }
 
-// cipherWriter wraps an io.Writer and a cipher.Stream.
-type cipherWriter struct {
-	cipher.StreamWriter
-	sync.Once
-	iv []byte
+// stream seals or opens the chunks of a file in order.
+type stream struct {
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	done    bool
+}
+
+// newStream makes a header with a random nonce prefix.
+func (c *Crypto) newStream() (*stream, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = Version
+	if _, err := rand.Read(header[len(magic)+1:]); err != nil {
+		return nil, err
+	}
+	return &stream{aead: c.aead, header: header}, nil
+}
+
+func (s *stream) nonce(last bool) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.header[len(magic)+1:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], s.counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// next moves on to the following chunk, as long as the counter does not wrap around.
+func (s *stream) next(last bool) error {
+	if last {
+		s.done = true
+		return nil
+	}
+	if s.counter == math.MaxUint32 {
+		return errors.New("too many chunks to encrypt")
+	}
+	s.counter++
+	return nil
+}
+
+// seal appends the sealed chunk of plaintext to dst.
+func (s *stream) seal(dst, plaintext []byte, last bool) ([]byte, error) {
+	if s.done {
+		return nil, errors.New("the last chunk was already sealed")
+	}
+	sealed := s.aead.Seal(dst, s.nonce(last), plaintext, s.header)
+	return sealed, s.next(last)
+}
+
+// open appends the opened chunk to dst, returning an AuthError if it was not sealed as this chunk.
+func (s *stream) open(dst, chunk []byte, last bool) ([]byte, error) {
+	opened, err := s.aead.Open(dst, s.nonce(last), chunk, s.header)
+	if err != nil {
+		return nil, &AuthError{Chunk: s.counter, Err: err}
+	}
+	return opened, s.next(last)
+}
+
+// readChunk reads the next chunk into buf, which it fills unless r ends, reporting whether it is the last one.
+// A chunk is the last when nothing follows it, so a full chunk is only the last one at the end of r.
+func readChunk(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+		if _, err := r.Peek(1); err == io.EOF {
+			return n, true, nil
+		} else if err != nil {
+			return n, false, err
+		}
+		return n, false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	default:
+		return n, false, err
+	}
+}
+
+// streamWriter encrypts what is written to it one chunk at a time. A full chunk is only sealed once more is written,
+// as the last chunk is sealed differently by Close.
+type streamWriter struct {
+	stream *stream
+	w      io.Writer
+	buf    []byte
+	wrote  bool
 }
 
-// Write encrypts data using the stream cipher and writes the resulting ciphertext
-// to the underlying writer. The first write will also write the IV of length aes.BlockSize.
-func (cw *cipherWriter) Write(p []byte) (n int, err error) {
-	cw.Once.Do(func() {
-		n, err = cw.StreamWriter.W.Write(cw.iv)
-	})
+func (sw *streamWriter) writeHeader() error {
+	if sw.wrote {
+		return nil
+	}
+	sw.wrote = true
+	_, err := sw.w.Write(sw.stream.header)
+	return err
+}
+
+// flush seals the buffered chunk in place and writes it.
+func (sw *streamWriter) flush(last bool) error {
+	sealed, err := sw.stream.seal(sw.buf[:0], sw.buf, last)
 	if err != nil {
-		return
+		return err
 	}
-	return cw.StreamWriter.Write(p)
+	sw.buf = sw.buf[:0]
+	_, err = sw.w.Write(sealed)
+	return err
 }
 
-// Encoder wraps an io.Writer into an encrypting writer. It writes a random IV
-// (initialization vector) as a prefix to the output so that the Decoder can decrypt.
-func (c *Crypto) Encoder(w io.Writer) (io.Writer, error) {
+func (sw *streamWriter) Write(p []byte) (n int, err error) {
+	if sw.stream.done {
+		return 0, errors.New("write after close")
+	}
+	if err := sw.writeHeader(); err != nil {
+		return 0, err
+	}
+	for len(p) > 0 {
+		if len(sw.buf) == ChunkSize {
+			if err := sw.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := min(ChunkSize-len(sw.buf), len(p))
+		sw.buf = append(sw.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (sw *streamWriter) Close() error {
+	if sw.stream.done {
+		return nil
+	}
+	if err := sw.writeHeader(); err != nil {
+		return err
+	}
+	return sw.flush(true)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Encoder wraps an io.Writer into an encrypting writer, which writes the header as a prefix to the output
+// so that the Decoder can decrypt. The writer must be closed to write the last chunk, or the file fails
+// authentication as if it was truncated.
+func (c *Crypto) Encoder(w io.Writer) (io.WriteCloser, error) {
 	if c == nil || c.key == "" {
-		return w, nil
+		return nopWriteCloser{w}, nil
 	}
-	iv := make([]byte, aes.BlockSize)
-	// Generate a random IV.
-	if _, err := rand.Read(iv); err != nil {
+	s, err := c.newStream()
+	if err != nil {
 		return nil, err
 	}
-	// Create a CTR stream cipher.
-	stream := cipher.NewCTR(c.block, iv)
-	return &cipherWriter{StreamWriter: cipher.StreamWriter{S: stream, W: w}, iv: iv}, nil
+	return &streamWriter{stream: s, w: w, buf: make([]byte, 0, ChunkSize+c.aead.Overhead())}, nil
 }
 
-// cipherReader wraps an io.Reader and a cipher.Stream.
-type cipherReader struct {
-	cipher.Block
-	cipher.StreamReader
-	sync.Once
+// streamReader decrypts a file one chunk at a time, or reads a legacy file once it saw it has no header.
+type streamReader struct {
+	crypto  *Crypto
+	r       *bufio.Reader
+	started bool
+	legacy  io.Reader
+	stream  *stream
+	buf     []byte
+	out     []byte
+	err     error
 }
 
-// Read decrypts data using the stream cipher and reads the resulting plaintext
-// from the underlying reader. The first read will also read the IV of length aes.BlockSize.
-func (cr *cipherReader) Read(p []byte) (n int, err error) {
-	cr.Once.Do(func() {
-		iv := make([]byte, aes.BlockSize)
-		// Read the IV from the beginning of the stream.
-		n, err = io.ReadFull(cr.StreamReader.R, iv)
-		if err == nil {
-			cr.StreamReader.S = cipher.NewCTR(cr.Block, iv)
+// start reads the header, or the IV of a legacy file.
+func (sr *streamReader) start() error {
+	prefix := make([]byte, len(magic)+1)
+	n, err := io.ReadFull(sr.r, prefix)
+	if err == nil && string(prefix[:len(magic)]) == magic {
+		if version := prefix[len(magic)]; version != Version {
+			return fmt.Errorf("unsupported encryption version %d", version)
+		}
+		header := make([]byte, headerSize)
+		copy(header, prefix)
+		if _, err := io.ReadFull(sr.r, header[len(prefix):]); err != nil {
+			return &AuthError{Err: fmt.Errorf("header: %w", io.ErrUnexpectedEOF)}
+		}
+		sr.stream = &stream{aead: sr.crypto.aead, header: header}
+		sr.buf = make([]byte, ChunkSize+sr.crypto.aead.Overhead())
+		return nil
+	}
+
+	// A legacy file starts with the IV of length aes.BlockSize.
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, prefix[:n])
+	if _, err := io.ReadFull(sr.r, iv[n:]); err != nil {
+		return err
+	}
+	sr.legacy = cipher.StreamReader{S: cipher.NewCTR(sr.crypto.block, iv), R: sr.r}
+	return nil
+}
+
+// begin starts reading the file the first time it is called, and returns the error it started with.
+func (sr *streamReader) begin() error {
+	if !sr.started {
+		sr.started = true
+		sr.err = sr.start()
+	}
+	return sr.err
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	if err := sr.begin(); err != nil {
+		return 0, err
+	}
+	if sr.legacy != nil {
+		return sr.legacy.Read(p)
+	}
+	for len(sr.out) == 0 {
+		if sr.stream.done {
+			return 0, io.EOF
+		}
+		n, last, err := readChunk(sr.r, sr.buf)
+		if err != nil {
+			sr.err = err
+			return 0, err
+		}
+		if sr.out, err = sr.stream.open(sr.buf[:0], sr.buf[:n], last); err != nil {
+			sr.err = err
+			return 0, err
 		}
-	})
-	if err != nil {
-		return
 	}
-	return cr.StreamReader.Read(p)
+	n := copy(p, sr.out)
+	sr.out = sr.out[n:]
+	return n, nil
 }
 
-// Decoder wraps an io.Reader so that the data is decrypted on the fly.
-// It expects the first aes.BlockSize bytes from the reader to be the IV.
+// Decoder wraps an io.Reader so that the data is decrypted on the fly. Files written before Version
+// are read as LegacyVersion, while chunks that fail authentication return an AuthError.
 func (c *Crypto) Decoder(r io.Reader) (io.Reader, error) {
 	if c == nil || c.key == "" {
 		return r, nil
 	}
-	return &cipherReader{Block: c.block, StreamReader: cipher.StreamReader{R: r}}, nil
+	return &streamReader{crypto: c, r: bufio.NewReader(r)}, nil
+}
+
+// encryptReader encrypts the plaintext it reads one chunk at a time.
+type encryptReader struct {
+	stream *stream
+	r      *bufio.Reader
+	buf    []byte
+	out    []byte
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.stream.done {
+			return 0, io.EOF
+		}
+		n, last, err := readChunk(er.r, er.buf[:ChunkSize])
+		if err != nil {
+			return 0, err
+		}
+		if er.out, err = er.stream.seal(er.buf[:0], er.buf[:n], last); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
 }
 
 // Encrypt returns an io.Reader that produces the encrypted version of data read
-// from the provided plaintext reader. The IV is generated and served as the first
-// aes.BlockSize bytes of the output.
+// from the provided plaintext reader, starting with the header.
 func (c *Crypto) Encrypt(r io.Reader) (io.Reader, error) {
 	if c == nil || c.key == "" {
 		return r, nil
 	}
-
-	iv := make([]byte, aes.BlockSize)
-	// Generate a random IV.
-	if _, err := rand.Read(iv); err != nil {
+	s, err := c.newStream()
+	if err != nil {
 		return nil, err
 	}
+	return &encryptReader{
+		stream: s,
+		r:      bufio.NewReader(r),
+		buf:    make([]byte, ChunkSize+c.aead.Overhead()),
+		out:    s.header,
+	}, nil
+}
 
-	// Create a CTR stream cipher with the IV.
-	stream := cipher.NewCTR(c.block, iv)
+// encryptedSize returns the size of plaintext once encrypted: the header, and a tag for every chunk,
+// with at least one chunk even when there is no plaintext.
+func encryptedSize(plaintext, overhead int64) int64 {
+	chunks := max(1, (plaintext+ChunkSize-1)/ChunkSize)
+	return int64(headerSize) + plaintext + chunks*overhead
+}
 
-	// Return the encrypter that prepends the IV header and then encrypts the rest
-	// of the data read from the underlying plaintext reader.
-	return io.MultiReader(bytes.NewReader(iv), &cipher.StreamReader{S: stream, R: r}), nil
+// decryptedSize returns the size of the plaintext of chunks, the ciphertext that follows the header,
+// without reading it. It returns an AuthError if chunks cannot be what was written, as when it was truncated.
+func decryptedSize(chunks, overhead int64) (int64, error) {
+	sealed := ChunkSize + overhead
+	n, rest := chunks/sealed, chunks%sealed
+	if rest > 0 || n == 0 {
+		if rest < overhead {
+			return 0, &AuthError{Chunk: uint32(n), Err: io.ErrUnexpectedEOF}
+		}
+		n++
+	}
+	return chunks - n*overhead, nil
 }
 
 // Open opens a file and returns a CryptoFile, which implements io.ReadSeekCloser
 func (c *Crypto) Open(path string) (*CryptoFile, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("error opening file: %w", err)
-	}
-
-	decoder, err := c.Decoder(file)
-	if err != nil {
-		return nil, fmt.Errorf("error making decoder: %w", err)
-	}
-
-	return &CryptoFile{decoder: decoder, file: file, encrypted: c != nil && c.key != ""}, nil
+	return c.OpenWith(openFile, c.Decoder)(path)
 }
 
+// CryptoFile reads a file through a method such as Decoder or Encrypt. Positions are those of what is read,
+// so seeking in an encrypted file starts reading it again and skips ahead to the position.
 type CryptoFile struct {
 	decoder   io.Reader
-	file      *os.File
-	once      sync.Once
+	file      io.ReadSeekCloser
+	method    func(io.Reader) (io.Reader, error)
+	pos       int64
 	encrypted bool
 }
 
 func (c *CryptoFile) Read(p []byte) (n int, err error) {
-	c.once.Do(func() {
-		if !c.encrypted {
-			return
-		}
-		var off int64
-		off, err = c.file.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return
-		}
-		_, err = c.file.Seek(0, io.SeekStart)
-		if err != nil {
-			return
-		}
-		n, err = c.decoder.Read(nil)
-		if err != nil {
-			return
-		}
-		if off > aes.BlockSize {
-			_, err = c.file.Seek(off, io.SeekStart)
-		}
-	})
-	if err != nil {
-		return
-	}
-	return c.decoder.Read(p)
+	n, err = c.decoder.Read(p)
+	c.pos += int64(n)
+	return n, err
 }
 
 func (c *CryptoFile) Seek(offset int64, whence int) (int64, error) {
@@ -194,33 +427,110 @@ func (c *CryptoFile) Seek(offset int64, whence int) (int64, error) {
 	}
 	switch whence {
 	case io.SeekStart:
-		offset += aes.BlockSize
 	case io.SeekCurrent:
-		break
+		offset += c.pos
 	case io.SeekEnd:
-		break
+		size, err := c.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
 	default:
 		return 0, fmt.Errorf("invalid whence: %d", whence)
 	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid seek: resulting decrypted position (%d) is negative", offset)
+	}
 
-	pos, err := c.file.Seek(offset, whence)
-	if err != nil {
+	if offset < c.pos {
+		if err := c.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.CopyN(io.Discard, c, offset-c.pos); err != nil && err != io.EOF {
 		return 0, err
 	}
+	return c.pos, nil
+}
 
-	if pos < aes.BlockSize {
-		return 0, fmt.Errorf("invalid seek: resulting decrypted position (%d) is negative", pos)
+// rewind starts reading the file again from its start.
+func (c *CryptoFile) rewind() error {
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	decoder, err := c.method(c.file)
+	if err != nil {
+		return fmt.Errorf("error making decoder: %w", err)
 	}
+	c.decoder, c.pos = decoder, 0
+	return nil
+}
 
-	return pos - aes.BlockSize, nil
+// size returns how much can be read from the file. For Decoder and Encrypt, it follows from the size of the file,
+// which is all that is looked at, so a file that was modified is only found out once its chunks are read.
+// For other methods, it reads the rest of the file, then goes back to where it was.
+func (c *CryptoFile) size() (int64, error) {
+	switch d := c.decoder.(type) {
+	case *streamReader:
+		if err := d.begin(); err != nil {
+			return 0, err
+		}
+		n, err := fileSize(c.file)
+		if err != nil {
+			return 0, err
+		}
+		if d.legacy != nil {
+			return n - aes.BlockSize, nil
+		}
+		return decryptedSize(n-int64(headerSize), int64(d.crypto.aead.Overhead()))
+	case *encryptReader:
+		n, err := fileSize(c.file)
+		if err != nil {
+			return 0, err
+		}
+		return encryptedSize(n, int64(d.stream.aead.Overhead())), nil
+	}
+
+	pos := c.pos
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		return 0, err
+	}
+	size := c.pos
+	if err := c.rewind(); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(io.Discard, c, pos); err != nil {
+		return 0, err
+	}
+	return size, nil
 }
 
 func (c *CryptoFile) Close() error { return c.file.Close() }
 
+// fileSize returns the size of f, leaving it where it was.
+func fileSize(f io.Seeker) (int64, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(pos, io.SeekStart)
+	return size, err
+}
+
 // OpenWithMethod returns an open function using a method such as Decoder or Encrypt, which implements io.ReadSeekCloser
 func (c *Crypto) OpenWithMethod(method func(io.Reader) (io.Reader, error)) func(string) (*CryptoFile, error) {
+	return c.OpenWith(openFile, method)
+}
+
+// OpenWith is like OpenWithMethod, but opens files using open instead of os.Open,
+// such as when reading from inside an archive.
+func (c *Crypto) OpenWith(open func(string) (io.ReadSeekCloser, error), method func(io.Reader) (io.Reader, error)) func(string) (*CryptoFile, error) {
 	return func(path string) (*CryptoFile, error) {
-		file, err := os.Open(path)
+		file, err := open(path)
 		if err != nil {
 			return nil, fmt.Errorf("error opening file: %w", err)
 		}
@@ -230,6 +540,14 @@ func (c *Crypto) OpenWithMethod(method func(io.Reader) (io.Reader, error)) func(
 			return nil, fmt.Errorf("error making decoder: %w", err)
 		}
 
-		return &CryptoFile{decoder: decoder, file: file, encrypted: c != nil && c.key != ""}, nil
+		return &CryptoFile{decoder: decoder, file: file, method: method, encrypted: c != nil && c.key != ""}, nil
+	}
+}
+
+func openFile(path string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	return file, nil
 }
@@ -2,19 +2,40 @@ package lib
 
 import (
 	"bytes"
-	_ "embed"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"image"
+	"image/png"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 )
 
 var crypto, _ = NewCrypto("secret")
 
-//go:embed image.png
-var file []byte
+// file is an image to encrypt, made here rather than kept alongside the tests.
+var file = func() []byte {
+	var buf bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}()
 
-func TestCrypto_Encoder(t *testing.T) {
-	encrypted, err := os.Create("encrypted.png")
+// encryptedFile writes file encrypted with the Encoder to a temporary folder, and returns its name.
+func encryptedFile(t *testing.T) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "encrypted.png")
+	encrypted, err := os.Create(name)
 	if err != nil {
 		t.Fatalf("error creating encrypted file: %v", err)
 	}
@@ -28,11 +49,27 @@ func TestCrypto_Encoder(t *testing.T) {
 	if err != nil {
 		t.Fatalf("encoder failed: %v", err)
 	}
+	if err := encoder.Close(); err != nil {
+		t.Fatalf("encoder failed: %v", err)
+	}
+	if err := encrypted.Close(); err != nil {
+		t.Fatalf("error closing encrypted file: %v", err)
+	}
+	return name
+}
+
+func TestCrypto_Encoder(t *testing.T) {
+	data, err := os.ReadFile(encryptedFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, file[:16]) {
+		t.Error("the encrypted file starts like the image")
+	}
 }
 
 func TestCrypto_Decoder(t *testing.T) {
-	t.Run("encrypted file", TestCrypto_Encoder)
-	encrypted, err := os.Open("encrypted.png")
+	encrypted, err := os.Open(encryptedFile(t))
 	if err != nil {
 		t.Fatalf("error opening encrypted file: %v", err)
 	}
@@ -42,21 +79,17 @@ func TestCrypto_Decoder(t *testing.T) {
 	if err != nil {
 		t.Fatalf("decoder failed: %v", err)
 	}
-
-	decrypted, err := os.Create("decrypted.png")
-	if err != nil {
-		t.Fatalf("error creating encrypted file: %v", err)
-	}
-	defer decrypted.Close()
-	_, err = io.Copy(decrypted, decoder)
+	decrypted, err := io.ReadAll(decoder)
 	if err != nil {
 		t.Fatalf("decrypt failed: %v", err)
 	}
+	if _, err := png.Decode(bytes.NewReader(decrypted)); err != nil {
+		t.Errorf("the decrypted image does not decode: %v", err)
+	}
 }
 
 func TestCrypto_Seek(t *testing.T) {
-	t.Run("encrypted file", TestCrypto_Encoder)
-	encrypted, err := crypto.Open("encrypted.png")
+	encrypted, err := crypto.Open(encryptedFile(t))
 	if err != nil {
 		t.Fatalf("error opening encrypted file: %v", err)
 	}
@@ -66,12 +99,305 @@ func TestCrypto_Seek(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error seeking encrypted file: %v", err)
 	}
+	decrypted, err := io.ReadAll(encrypted)
+	if err != nil {
+		t.Fatalf("error reading after seek: %v", err)
+	}
+	if !bytes.Equal(decrypted, file) {
+		t.Error("read the wrong data after seeking")
+	}
+}
+
+// encrypt encrypts data with the Encoder.
+func encrypt(t *testing.T, c *Crypto, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	encoder, err := c.Encoder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(c *Crypto, data []byte) ([]byte, error) {
+	decoder, err := c.Decoder(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(decoder)
+}
+
+func TestCrypto_RoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 7} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		encrypted := encrypt(t, crypto, plaintext)
+		if !bytes.HasPrefix(encrypted, []byte(magic)) || encrypted[len(magic)] != Version {
+			t.Fatalf("size %d: missing header", size)
+		}
+		decrypted, err := decrypt(crypto, encrypted)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("size %d: decrypted data does not match", size)
+		}
+
+		reader, err := crypto.Encrypt(bytes.NewReader(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err = io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encrypted) != len(encrypt(t, crypto, plaintext)) {
+			t.Errorf("size %d: Encrypt and Encoder wrote %d and %d bytes", size, len(encrypted), len(encrypt(t, crypto, plaintext)))
+		}
+		decrypted, err = decrypt(crypto, encrypted)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("size %d: could not decrypt what Encrypt read: %v", size, err)
+		}
+	}
+}
+
+func TestCrypto_Legacy(t *testing.T) {
+	plaintext := []byte("written before files were authenticated")
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(iv)
+	legacy := append([]byte{}, iv...)
+	legacy = append(legacy, make([]byte, len(plaintext))...)
+	cipher.NewCTR(crypto.block, iv).XORKeyStream(legacy[aes.BlockSize:], plaintext)
+
+	decrypted, err := decrypt(crypto, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("got %q, want %q", decrypted, plaintext)
+	}
+}
+
+func TestCrypto_Authentication(t *testing.T) {
+	plaintext := make([]byte, 2*ChunkSize+100)
+	rand.Read(plaintext)
+	encrypted := encrypt(t, crypto, plaintext)
+	sealed := ChunkSize + crypto.aead.Overhead()
+	other, _ := NewCrypto("other")
+
+	for name, test := range map[string]struct {
+		data   []byte
+		crypto *Crypto
+		chunk  uint32
+	}{
+		"modified":         {data: flip(encrypted, headerSize+sealed+10), crypto: crypto, chunk: 1},
+		"modified header":  {data: flip(encrypted, headerSize-1), crypto: crypto},
+		"truncated":        {data: encrypted[:len(encrypted)-1], crypto: crypto, chunk: 2},
+		"truncated chunks": {data: encrypted[:headerSize+2*sealed], crypto: crypto, chunk: 1},
+		"header only":      {data: encrypted[:headerSize], crypto: crypto},
+		"appended":         {data: append(append([]byte{}, encrypted...), encrypted[headerSize:headerSize+sealed]...), crypto: crypto, chunk: 2},
+		"reordered":        {data: slices.Concat(encrypted[:headerSize], encrypted[headerSize+sealed:headerSize+2*sealed], encrypted[headerSize:headerSize+sealed], encrypted[headerSize+2*sealed:]), crypto: crypto},
+		"other key":        {data: encrypted, crypto: other},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := decrypt(test.crypto, test.data)
+			var authErr *AuthError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("got %v, want an AuthError", err)
+			}
+			if authErr.Chunk != test.chunk {
+				t.Errorf("got chunk %d, want %d", authErr.Chunk, test.chunk)
+			}
+		})
+	}
 
-	decryptedAfterSeek, err := os.Create("decrypted_after_seek.png")
+	unsupported := flip(encrypted, len(magic))
+	if _, err := decrypt(crypto, unsupported); err == nil || errors.As(err, new(*AuthError)) {
+		t.Errorf("got %v, want an error for an unsupported version", err)
+	}
+}
+
+// flip returns a copy of data with a bit of the byte at i flipped.
+func flip(data []byte, i int) []byte {
+	data = bytes.Clone(data)
+	data[i] ^= 1
+	return data
+}
+
+func TestCryptoFile_Seek(t *testing.T) {
+	plaintext := make([]byte, 2*ChunkSize+100)
+	rand.Read(plaintext)
+	name := filepath.Join(t.TempDir(), "encrypted")
+	if err := os.WriteFile(name, encrypt(t, crypto, plaintext), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := crypto.Open(name)
 	if err != nil {
-		t.Fatalf("error creating decrypted after seek: %v", err)
+		t.Fatal(err)
 	}
-	defer decryptedAfterSeek.Close()
+	defer f.Close()
 
-	_, err = io.Copy(decryptedAfterSeek, encrypted)
+	for _, seek := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{ChunkSize + 5, io.SeekStart, ChunkSize + 5},
+		{-20, io.SeekCurrent, ChunkSize - 5},
+		{-100, io.SeekEnd, 2 * ChunkSize},
+		{0, io.SeekStart, 0},
+	} {
+		pos, err := f.Seek(seek.offset, seek.whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != seek.want {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", seek.offset, seek.whence, pos, seek.want)
+		}
+		got := make([]byte, 10)
+		if _, err := io.ReadFull(f, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext[pos:pos+10]) {
+			t.Fatalf("read the wrong data after Seek(%d, %d)", seek.offset, seek.whence)
+		}
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected an error seeking before the start")
+	}
+}
+
+// countingFile counts how much is read from a file.
+type countingFile struct {
+	io.ReadSeeker
+	read int64
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.ReadSeeker.Read(p)
+	f.read += int64(n)
+	return n, err
+}
+
+func (f *countingFile) Close() error { return nil }
+
+func TestCryptoFile_SeekEnd(t *testing.T) {
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(iv)
+	legacy := append(iv, make([]byte, 100)...)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 7} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		encrypted := encrypt(t, crypto, plaintext)
+		if got := encryptedSize(int64(size), int64(crypto.aead.Overhead())); got != int64(len(encrypted)) {
+			t.Errorf("size %d: got an encrypted size of %d, want %d", size, got, len(encrypted))
+		}
+
+		for _, open := range []struct {
+			name   string
+			data   []byte
+			method func(io.Reader) (io.Reader, error)
+			want   int
+		}{
+			{"Decoder", encrypted, crypto.Decoder, size},
+			{"Encrypt", plaintext, crypto.Encrypt, len(encrypted)},
+			{"legacy", legacy, crypto.Decoder, 100},
+		} {
+			counted := &countingFile{ReadSeeker: bytes.NewReader(open.data)}
+			f, err := crypto.OpenWith(func(string) (io.ReadSeekCloser, error) { return counted, nil }, open.method)("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			end, err := f.Seek(0, io.SeekEnd)
+			if err != nil {
+				t.Fatalf("size %d, %s: %v", size, open.name, err)
+			}
+			if end != int64(open.want) {
+				t.Errorf("size %d, %s: got the end at %d, want %d", size, open.name, end, open.want)
+			}
+			// The end follows from the size of the file, so it is only read once, to skip ahead to the end.
+			if counted.read > int64(len(open.data)) {
+				t.Errorf("size %d, %s: read %d bytes of %d to seek to the end", size, open.name, counted.read, len(open.data))
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != open.want {
+				t.Errorf("size %d, %s: read %d bytes, want %d", size, open.name, len(data), open.want)
+			}
+		}
+	}
+
+	truncated := encrypt(t, crypto, make([]byte, ChunkSize+10))
+	truncated = truncated[:headerSize+ChunkSize+crypto.aead.Overhead()+5]
+	f, err := crypto.OpenWith(func(string) (io.ReadSeekCloser, error) {
+		return &countingFile{ReadSeeker: bytes.NewReader(truncated)}, nil
+	}, crypto.Decoder)("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var authErr *AuthError
+	if _, err := f.Seek(0, io.SeekEnd); !errors.As(err, &authErr) || authErr.Chunk != 1 {
+		t.Errorf("got %v, want an AuthError for chunk 1 of a truncated file", err)
+	}
+}
+
+var update = flag.Bool("update", false, "write the files in testdata again")
+
+// goldenPlaintext is what the files in testdata decrypt to with crypto. They are also read by the tests
+// of the classifier, to make sure it decrypts what is encrypted here.
+func goldenPlaintext(size int) []byte {
+	plaintext := make([]byte, size)
+	for i := range plaintext {
+		plaintext[i] = byte(i % 251)
+	}
+	return plaintext
+}
+
+func TestCrypto_Golden(t *testing.T) {
+	for _, golden := range []struct {
+		name string
+		size int
+	}{
+		{"stream.enc", ChunkSize + 100},
+		{"legacy.enc", 100},
+	} {
+		name := filepath.Join("testdata", golden.name)
+		plaintext := goldenPlaintext(golden.size)
+		if *update {
+			encrypted := encrypt(t, crypto, plaintext)
+			if golden.name == "legacy.enc" {
+				iv := make([]byte, aes.BlockSize)
+				rand.Read(iv)
+				encrypted = append(iv, make([]byte, len(plaintext))...)
+				cipher.NewCTR(crypto.block, iv).XORKeyStream(encrypted[aes.BlockSize:], plaintext)
+			}
+			if err := os.WriteFile(name, encrypted, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		encrypted, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := decrypt(crypto, encrypted)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%s does not decrypt to what it was written with", name)
+		}
+	}
 }
@@ -0,0 +1,330 @@
+// Package metrics keeps counters, gauges and histograms in a Registry and exposes them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Default is the registry every New function registers with, and the one Handler serves.
+var Default = NewRegistry()
+
+// DefaultBuckets are the upper bounds in seconds used for latency histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Registry holds metrics by name.
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w io.Writer, name string) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	r.metrics[name] = m
+}
+
+// Write writes every metric sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	slices.Sort(names)
+
+	buf := bufio.NewWriter(w)
+	for _, name := range names {
+		r.mu.RLock()
+		m := r.metrics[name]
+		r.mu.RUnlock()
+		if err := m.write(buf, name); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// Handler serves the registry in the Prometheus text exposition format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.Write(w); err != nil {
+			log.Error("error writing metrics", "err", err)
+		}
+	})
+}
+
+// Handler serves the Default registry.
+func Handler() http.Handler { return Default.Handler() }
+
+// series holds the values of a metric by their label values.
+type series[V any] struct {
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.RWMutex
+	values map[string]*V
+	new    func() *V
+}
+
+func newSeries[V any](help, kind string, labels []string, newValue func() *V) *series[V] {
+	return &series[V]{help: help, kind: kind, labels: labels, values: make(map[string]*V), new: newValue}
+}
+
+// get returns the value for the label values, creating it on first use.
+func (s *series[V]) get(values []string) *V {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels %v", len(values), len(s.labels), s.labels))
+	}
+	key := strings.Join(values, "\xff")
+	s.mu.RLock()
+	v, ok := s.values[key]
+	s.mu.RUnlock()
+	if ok {
+		return v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	v = s.new()
+	s.values[key] = v
+	return v
+}
+
+// each calls fn for every label set in a stable order, formatted as the inside of the braces.
+func (s *series[V]) each(fn func(labels []string, v *V) error) error {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	slices.Sort(keys)
+	for _, key := range keys {
+		s.mu.RLock()
+		v := s.values[key]
+		s.mu.RUnlock()
+		var values []string
+		if len(s.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		pairs := make([]string, len(values))
+		for i, value := range values {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, s.labels[i], labelEscaper.Replace(value))
+		}
+		if err := fn(pairs, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func (s *series[V]) header(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(s.help), name, s.kind)
+	return err
+}
+
+// value is a float64 that can be updated concurrently.
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(delta float64) {
+	v.mu.Lock()
+	v.v += delta
+	v.mu.Unlock()
+}
+
+func (v *value) set(f float64) {
+	v.mu.Lock()
+	v.v = f
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+func writeSample(w io.Writer, name string, labels []string, v float64) error {
+	if len(labels) > 0 {
+		name += "{" + strings.Join(labels, ",") + "}"
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a value that only goes up, such as the number of requests served.
+type Counter struct{ s *series[value] }
+
+// NewCounter registers a counter with Default. Every update takes one value for each of labels, in order.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newSeries(help, "counter", labels, func() *value { return new(value) })}
+	Default.register(name, c)
+	return c
+}
+
+// Inc adds one to the counter with the label values.
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+// Add adds delta, which must not be negative, to the counter with the label values.
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.s.get(labels).add(delta)
+}
+
+// Value returns the current value of the counter with the label values.
+func (c *Counter) Value(labels ...string) float64 { return c.s.get(labels).get() }
+
+func (c *Counter) write(w io.Writer, name string) error {
+	if err := c.s.header(w, name); err != nil {
+		return err
+	}
+	return c.s.each(func(labels []string, v *value) error { return writeSample(w, name, labels, v.get()) })
+}
+
+// Gauge is a value that can go up and down, such as the number of connected clients.
+type Gauge struct{ s *series[value] }
+
+// NewGauge registers a gauge with Default. Every update takes one value for each of labels, in order.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newSeries(help, "gauge", labels, func() *value { return new(value) })}
+	Default.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labels ...string)     { g.s.get(labels).set(v) }
+func (g *Gauge) Add(delta float64, labels ...string) { g.s.get(labels).add(delta) }
+func (g *Gauge) Inc(labels ...string)                { g.Add(1, labels...) }
+func (g *Gauge) Dec(labels ...string)                { g.Add(-1, labels...) }
+
+// Value returns the current value of the gauge with the label values.
+func (g *Gauge) Value(labels ...string) float64 { return g.s.get(labels).get() }
+
+func (g *Gauge) write(w io.Writer, name string) error {
+	if err := g.s.header(w, name); err != nil {
+		return err
+	}
+	return g.s.each(func(labels []string, v *value) error { return writeSample(w, name, labels, v.get()) })
+}
+
+// Histogram counts observations, such as request latencies, into buckets.
+type Histogram struct {
+	buckets []float64
+	s       *series[histogram]
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with Default, using DefaultBuckets when buckets is nil.
+// Every observation takes one value for each of labels, in order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Sorted(slices.Values(buckets))
+	h := &Histogram{buckets: buckets}
+	h.s = newSeries(help, "histogram", labels, func() *histogram {
+		return &histogram{counts: make([]uint64, len(buckets))}
+	})
+	Default.register(name, h)
+	return h
+}
+
+// Observe adds v to the histogram with the label values.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	hist := h.s.get(labels)
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// Since observes the seconds elapsed since start.
+func (h *Histogram) Since(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) write(w io.Writer, name string) error {
+	if err := h.s.header(w, name); err != nil {
+		return err
+	}
+	return h.s.each(func(labels []string, hist *histogram) error {
+		hist.mu.Lock()
+		counts := slices.Clone(hist.counts)
+		count, sum := hist.count, hist.sum
+		hist.mu.Unlock()
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += counts[i]
+			le := fmt.Sprintf(`le="%s"`, formatFloat(bound))
+			if err := writeSample(w, name+"_bucket", append(slices.Clip(labels), le), float64(cumulative)); err != nil {
+				return err
+			}
+		}
+		if err := writeSample(w, name+"_bucket", append(slices.Clip(labels), `le="+Inf"`), float64(count)); err != nil {
+			return err
+		}
+		if err := writeSample(w, name+"_sum", labels, sum); err != nil {
+			return err
+		}
+		return writeSample(w, name+"_count", labels, float64(count))
+	})
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	requests := NewCounter("test_requests_total", "Requests served.", "endpoint", "code")
+	requests.Inc("GET /walk", "200")
+	requests.Add(2, "GET /walk", "200")
+	requests.Inc(`GET /"quoted"`, "500")
+
+	clients := NewGauge("test_clients", "Connected clients.")
+	clients.Inc()
+	clients.Inc()
+	clients.Dec()
+
+	latency := NewHistogram("test_latency_seconds", "Request latency.", []float64{1, 0.1}, "endpoint")
+	latency.Observe(0.05, "predict")
+	latency.Observe(0.5, "predict")
+	latency.Observe(5, "predict")
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", got)
+	}
+
+	want := `# HELP test_clients Connected clients.
+# TYPE test_clients gauge
+test_clients 1
+# HELP test_latency_seconds Request latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{endpoint="predict",le="0.1"} 1
+test_latency_seconds_bucket{endpoint="predict",le="1"} 2
+test_latency_seconds_bucket{endpoint="predict",le="+Inf"} 3
+test_latency_seconds_sum{endpoint="predict"} 5.55
+test_latency_seconds_count{endpoint="predict"} 3
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{endpoint="GET /\"quoted\"",code="500"} 1
+test_requests_total{endpoint="GET /walk",code="200"} 3
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	counter := NewCounter("test_label_count_total", "Labels.", "a")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for missing label values")
+		}
+	}()
+	counter.Inc()
+}
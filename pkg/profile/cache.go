@@ -0,0 +1,123 @@
+package profile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"classifier/pkg/utils"
+)
+
+// artistRegexp matches Inkbunny usernames, which name the files galleries are cached in.
+var artistRegexp = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// ValidateArtist reports whether artist can be an Inkbunny username.
+func ValidateArtist(artist string) error {
+	if !artistRegexp.MatchString(artist) {
+		return fmt.Errorf("invalid artist %q, expected an Inkbunny username", artist)
+	}
+	return nil
+}
+
+// Cache keeps the galleries that were scanned in a folder, one JSON file per artist, so that profiles
+// survive restarts and are only scanned again when they are refreshed or more submissions are asked for.
+type Cache struct {
+	dir string
+
+	mu      sync.Mutex
+	artists map[string]*sync.Mutex
+}
+
+// OpenCache keeps galleries in dir, creating it if needed.
+func OpenCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, artists: make(map[string]*sync.Mutex)}, nil
+}
+
+// path returns where the gallery of artist is saved. Usernames are not case-sensitive on Inkbunny.
+func (c *Cache) path(artist string) string {
+	return filepath.Join(c.dir, strings.ToLower(artist)+".json")
+}
+
+// Get returns the cached gallery of artist, or an error wrapping [fs.ErrNotExist] if it was never scanned.
+func (c *Cache) Get(artist string) (*Gallery, error) {
+	if err := ValidateArtist(artist); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(c.path(artist))
+	if err != nil {
+		return nil, err
+	}
+	gallery, err := utils.DecodeAndClose[*Gallery](f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the cached gallery of %s: %w", artist, err)
+	}
+	return gallery, nil
+}
+
+// Put saves gallery, replacing the one cached for its artist.
+func (c *Cache) Put(gallery *Gallery) error {
+	if err := ValidateArtist(gallery.Artist); err != nil {
+		return err
+	}
+	name := c.path(gallery.Artist)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := utils.Encode(f, gallery); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Gallery returns the gallery of artist with its most recent submissions, or all of them when recent is zero.
+// The cached gallery is used unless refresh is set or it does not have the submissions asked for, in which case
+// the gallery is scanned again and cached. Scans of the same artist wait for each other, so that a refresh
+// asked for while one is running uses its gallery instead of downloading everything again.
+func (c *Cache) Gallery(ctx context.Context, scanner Scanner, artist string, recent int, refresh bool) (*Gallery, error) {
+	if err := ValidateArtist(artist); err != nil {
+		return nil, err
+	}
+	asked := time.Now()
+
+	c.mu.Lock()
+	lock, ok := c.artists[strings.ToLower(artist)]
+	if !ok {
+		lock = new(sync.Mutex)
+		c.artists[strings.ToLower(artist)] = lock
+	}
+	c.mu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	cached, err := c.Get(artist)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if cached != nil && cached.Covers(recent) && (!refresh || cached.Scanned.After(asked)) {
+		return cached.Trim(recent), nil
+	}
+
+	gallery, err := scanner.Scan(ctx, artist, recent)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Put(gallery); err != nil {
+		return nil, fmt.Errorf("error caching the gallery of %s: %w", artist, err)
+	}
+	return gallery, nil
+}
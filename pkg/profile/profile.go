@@ -0,0 +1,192 @@
+// Package profile scans the gallery of an Inkbunny artist and summarizes how much of it the classifier flagged,
+// so that moderators can tell at a glance whether an artist needs a closer look.
+package profile
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"classifier/pkg/classify"
+)
+
+// DefaultClasses and DefaultThreshold flag submissions when no classes or threshold are given,
+// the same as the Telegram bot does by default.
+var DefaultClasses = []string{"cub"}
+
+const DefaultThreshold = 0.75
+
+// Buckets is how many ranges of confidence Profile.Confidence is split into.
+const Buckets = 10
+
+// Gallery is what a Scan found in the gallery of an artist. It is what gets cached, so that
+// profiles with other classes or thresholds can be made from it without downloading anything again.
+type Gallery struct {
+	Artist string `json:"artist"`
+	// Total is how many submissions the gallery had when it was scanned.
+	Total int `json:"total"`
+	// Recent is how many of the most recent submissions were scanned, or zero for all of them.
+	Recent  int       `json:"recent,omitempty"`
+	Scanned time.Time `json:"scanned"`
+	// Failed is how many images could not be downloaded or classified.
+	Failed int `json:"failed"`
+	// Submissions are sorted from the most recent.
+	Submissions []Submission `json:"submissions"`
+}
+
+// Submission is a scanned submission with a prediction for every image that was classified.
+type Submission struct {
+	ID          string                `json:"id"`
+	Title       string                `json:"title"`
+	Created     time.Time             `json:"created"`
+	Files       int                   `json:"files"`
+	Predictions []classify.Prediction `json:"predictions,omitempty"`
+	// Pages are which file of the submission each prediction is for, counting from 1, as images that were
+	// skipped or failed have none.
+	Pages []int `json:"pages,omitempty"`
+}
+
+// page returns which file of the submission prediction i is for. Galleries cached before Pages was kept
+// number them by prediction instead.
+func (s Submission) page(i int) int {
+	if i < len(s.Pages) {
+		return s.Pages[i]
+	}
+	return i + 1
+}
+
+// URL links to the submission on Inkbunny.
+func (s Submission) URL() string {
+	return fmt.Sprintf("https://inkbunny.net/s/%s", s.ID)
+}
+
+// Covers reports whether the gallery has the most recent submissions asked for, where zero asks for all of them.
+func (g *Gallery) Covers(recent int) bool {
+	return g.Recent == 0 || (recent > 0 && recent <= g.Recent)
+}
+
+// Trim returns the gallery with only its most recent submissions, or g itself when it has no more than that.
+func (g *Gallery) Trim(recent int) *Gallery {
+	if recent <= 0 || recent >= len(g.Submissions) {
+		return g
+	}
+	trimmed := *g
+	trimmed.Recent = recent
+	trimmed.Submissions = g.Submissions[:recent]
+	return &trimmed
+}
+
+// Profile summarizes a Gallery for the classes that are flagged.
+type Profile struct {
+	Artist      string    `json:"artist"`
+	Total       int       `json:"total"`
+	Recent      int       `json:"recent,omitempty"`
+	Scanned     time.Time `json:"scanned"`
+	Submissions int       `json:"submissions"`
+	Files       int       `json:"files"`
+	// Classified is how many submissions had at least one image classified, and Failed how many images were not.
+	Classified int `json:"classified"`
+	Failed     int `json:"failed"`
+
+	FlaggedClasses []string `json:"flagged_classes"`
+	Threshold      float64  `json:"threshold"`
+
+	// Classes counts the classified submissions by the most likely class of their images.
+	Classes map[string]int `json:"classes"`
+	// Confidence counts the classified submissions by how confident the classifier is that they are of the
+	// flagged classes, from 0-10% in the first bucket to 90-100% in the last.
+	Confidence [Buckets]int `json:"confidence"`
+
+	// Flagged are the submissions at or above the threshold, from the most recent.
+	Flagged      []Flag    `json:"flagged"`
+	FirstFlagged time.Time `json:"first_flagged,omitzero"`
+	LastFlagged  time.Time `json:"last_flagged,omitzero"`
+}
+
+// Flag is a flagged submission. Confidence is the summed confidence of the flagged classes for its most
+// confident image, the page of the submission it is on, and Class the most likely of them.
+type Flag struct {
+	ID         string    `json:"id"`
+	Title      string    `json:"title"`
+	URL        string    `json:"url"`
+	Created    time.Time `json:"created"`
+	Page       int       `json:"page"`
+	Class      string    `json:"class"`
+	Confidence float64   `json:"confidence"`
+}
+
+// Rate returns the fraction of classified submissions that were flagged.
+func (p *Profile) Rate() float64 {
+	if p.Classified == 0 {
+		return 0
+	}
+	return float64(len(p.Flagged)) / float64(p.Classified)
+}
+
+// Summarize makes the profile of the gallery, flagging submissions whose summed confidence of classes
+// is at least threshold for any of their images.
+func (g *Gallery) Summarize(classes []string, threshold float64) *Profile {
+	p := &Profile{
+		Artist:         g.Artist,
+		Total:          g.Total,
+		Recent:         g.Recent,
+		Scanned:        g.Scanned,
+		Submissions:    len(g.Submissions),
+		Failed:         g.Failed,
+		FlaggedClasses: slices.Clone(classes),
+		Threshold:      threshold,
+		Classes:        make(map[string]int),
+		Flagged:        []Flag{},
+	}
+	for _, submission := range g.Submissions {
+		p.Files += submission.Files
+		if len(submission.Predictions) == 0 {
+			continue
+		}
+		p.Classified++
+
+		var (
+			class      string
+			likeliest  float64
+			page       int
+			confidence float64
+		)
+		for i, prediction := range submission.Predictions {
+			if c, max := prediction.Max(); i == 0 || max > likeliest {
+				class, likeliest = c, max
+			}
+			if sum := prediction.Clone().Whitelist(classes...).Sum(); i == 0 || sum > confidence {
+				page, confidence = i, sum
+			}
+		}
+		p.Classes[class]++
+		p.Confidence[bucket(confidence)]++
+
+		if confidence < threshold {
+			continue
+		}
+		flagged, _ := submission.Predictions[page].Clone().Whitelist(classes...).Max()
+		p.Flagged = append(p.Flagged, Flag{
+			ID:         submission.ID,
+			Title:      submission.Title,
+			URL:        submission.URL(),
+			Created:    submission.Created,
+			Page:       submission.page(page),
+			Class:      flagged,
+			Confidence: confidence,
+		})
+		if p.FirstFlagged.IsZero() || submission.Created.Before(p.FirstFlagged) {
+			p.FirstFlagged = submission.Created
+		}
+		if submission.Created.After(p.LastFlagged) {
+			p.LastFlagged = submission.Created
+		}
+	}
+	return p
+}
+
+// bucket returns which of the Buckets confidence falls in.
+func bucket(confidence float64) int {
+	return min(max(int(math.Floor(confidence*Buckets)), 0), Buckets-1)
+}
@@ -0,0 +1,152 @@
+package profile
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"classifier/pkg/classify"
+)
+
+func date(day int) time.Time {
+	return time.Date(2024, time.January, day, 0, 0, 0, 0, time.UTC)
+}
+
+func testGallery() *Gallery {
+	return &Gallery{
+		Artist:  "Artist",
+		Total:   5,
+		Scanned: date(31),
+		Failed:  1,
+		Submissions: []Submission{
+			{ID: "5", Created: date(5), Files: 2, Predictions: []classify.Prediction{
+				{"safe": 0.9, "cub": 0.1},
+				{"cub": 0.5, "young": 0.4, "safe": 0.1},
+			}},
+			{ID: "4", Created: date(4), Files: 1},
+			{ID: "3", Created: date(3), Files: 1, Predictions: []classify.Prediction{{"safe": 0.95, "cub": 0.05}}},
+			{ID: "2", Created: date(2), Files: 1, Predictions: []classify.Prediction{{"cub": 0.8, "safe": 0.2}}},
+			{ID: "1", Created: date(1), Files: 1, Predictions: []classify.Prediction{{"safe": 0.7, "cub": 0.3}}},
+		},
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	p := testGallery().Summarize([]string{"cub", "young"}, 0.75)
+	if p.Submissions != 5 || p.Files != 6 || p.Classified != 4 || p.Failed != 1 {
+		t.Errorf("got %d submissions, %d files, %d classified and %d failed, want 5, 6, 4 and 1", p.Submissions, p.Files, p.Classified, p.Failed)
+	}
+	if p.Classes["safe"] != 3 || p.Classes["cub"] != 1 || len(p.Classes) != 2 {
+		t.Errorf("got classes %v, want 3 safe and 1 cub", p.Classes)
+	}
+	if want := [Buckets]int{0: 1, 3: 1, 8: 1, 9: 1}; p.Confidence != want {
+		t.Errorf("got confidence %v, want %v", p.Confidence, want)
+	}
+	if len(p.Flagged) != 2 {
+		t.Fatalf("got %d flagged, want 2: %+v", len(p.Flagged), p.Flagged)
+	}
+	if f := p.Flagged[0]; f.ID != "5" || f.Page != 2 || f.Class != "cub" || f.URL != "https://inkbunny.net/s/5" {
+		t.Errorf("got %+v, want the second page of submission 5 flagged as cub", f)
+	}
+	if !p.FirstFlagged.Equal(date(2)) || !p.LastFlagged.Equal(date(5)) {
+		t.Errorf("got first flagged %v and last flagged %v", p.FirstFlagged, p.LastFlagged)
+	}
+	if p.Rate() != 0.5 {
+		t.Errorf("got rate %v, want 0.5", p.Rate())
+	}
+
+	p = testGallery().Summarize([]string{"cub"}, 0.75)
+	if len(p.Flagged) != 1 || p.Flagged[0].ID != "2" {
+		t.Errorf("got %+v, want only submission 2 flagged without young", p.Flagged)
+	}
+	if !p.FirstFlagged.Equal(p.LastFlagged) {
+		t.Errorf("got first flagged %v and last flagged %v, want the same date", p.FirstFlagged, p.LastFlagged)
+	}
+}
+
+func TestSummarize_Skipped(t *testing.T) {
+	// The second file could not be classified, so the flagged prediction is of the third.
+	g := &Gallery{Artist: "Artist", Submissions: []Submission{
+		{ID: "7", Created: date(7), Files: 3, Pages: []int{1, 3}, Predictions: []classify.Prediction{
+			{"safe": 0.9, "cub": 0.1},
+			{"cub": 0.85, "safe": 0.15},
+		}},
+	}}
+	p := g.Summarize([]string{"cub"}, 0.75)
+	if len(p.Flagged) != 1 || p.Flagged[0].Page != 3 {
+		t.Errorf("got %+v, want the third page of submission 7 flagged", p.Flagged)
+	}
+}
+
+func TestGallery_Trim(t *testing.T) {
+	g := testGallery()
+	if !g.Covers(0) || !g.Covers(10) {
+		t.Error("a whole gallery should cover any number of recent submissions")
+	}
+	trimmed := g.Trim(2)
+	if len(trimmed.Submissions) != 2 || trimmed.Submissions[1].ID != "4" || trimmed.Recent != 2 {
+		t.Fatalf("got %+v, want the 2 most recent submissions", trimmed)
+	}
+	if len(g.Submissions) != 5 {
+		t.Error("trimming changed the gallery")
+	}
+	if !trimmed.Covers(1) || trimmed.Covers(3) || trimmed.Covers(0) {
+		t.Error("a trimmed gallery should only cover up to its recent submissions")
+	}
+	if g.Trim(0) != g || g.Trim(5) != g {
+		t.Error("trimming to all submissions should return the gallery itself")
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	for s, want := range map[string]time.Time{
+		"2010-12-04 05:22:48.235454+00": time.Date(2010, time.December, 4, 5, 22, 48, 235454000, time.UTC),
+		"2010-12-04 05:22:48+02":        time.Date(2010, time.December, 4, 3, 22, 48, 0, time.UTC),
+		"":                              {},
+		"yesterday":                     {},
+	} {
+		if got := parseDate(s); !got.Equal(want) {
+			t.Errorf("parseDate(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestSortSubmissions(t *testing.T) {
+	submissions := []Submission{{ID: "9", Created: date(1)}, {ID: "10", Created: date(1)}, {ID: "2", Created: date(2)}}
+	sortSubmissions(submissions)
+	for i, want := range []string{"2", "10", "9"} {
+		if submissions[i].ID != want {
+			t.Fatalf("got %+v, want IDs 2, 10 and 9", submissions)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	c, err := OpenCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("artist"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist for an artist that was never scanned", err)
+	}
+	if _, err := c.Get("../artist"); err == nil {
+		t.Error("expected an error for an invalid artist")
+	}
+	if err := c.Put(testGallery()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached gallery covers what is asked, so the scanner, which has no sid, is never used.
+	g, err := c.Gallery(context.Background(), Scanner{}, "ARTIST", 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Submissions) != 3 || g.Total != 5 || !g.Scanned.Equal(date(31)) {
+		t.Errorf("got %+v, want the 3 most recent cached submissions", g)
+	}
+	if g.Submissions[0].Predictions[1]["cub"] != 0.5 {
+		t.Errorf("got %+v, want the predictions to be cached", g.Submissions[0])
+	}
+}
@@ -0,0 +1,157 @@
+package profile
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ellypaws/inkbunny/api"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/utils"
+)
+
+// Predict downloads and classifies the images of submission, returning the prediction of every image it
+// could classify along with which file of the submission it is, counting from 1, and how many it could not.
+type Predict func(ctx context.Context, submission api.Submission) (predictions []classify.Prediction, pages []int, failed int)
+
+// Scanner scans the galleries of artists with the sid of a logged-in user.
+type Scanner struct {
+	SID     string
+	Predict Predict
+	// Workers is how many submissions are downloaded and classified at once.
+	Workers int
+}
+
+// scanned is a Submission along with how many of its images could not be classified.
+type scanned struct {
+	Submission
+	failed int
+}
+
+// Scan classifies every submission in the gallery of artist, or only its most recent ones when recent is positive.
+// The first page of the gallery is read with [api.Credentials.UserSubmissions], and the pages after it by repeating
+// the same search. The scan fails if any page cannot be read, as a profile missing part of the gallery would
+// understate it.
+func (s Scanner) Scan(ctx context.Context, artist string, recent int) (*Gallery, error) {
+	response, err := api.Credentials{Sid: s.SID}.UserSubmissions(artist)
+	utils.CountInkbunnyCall("search", err)
+	if err != nil {
+		return nil, fmt.Errorf("error searching the submissions of %s: %w", artist, err)
+	}
+
+	gallery := &Gallery{
+		Artist:      artist,
+		Total:       int(response.ResultsCountAll),
+		Scanned:     time.Now(),
+		Submissions: []Submission{},
+	}
+	if recent > 0 && recent < gallery.Total {
+		gallery.Recent = recent
+	}
+	if len(response.Submissions) > 0 {
+		gallery.Artist = response.Submissions[0].Username
+	}
+
+	worker := utils.NewWorkerPool(max(s.Workers, 1), func(submission api.Submission) scanned {
+		result := scanned{Submission: Submission{
+			ID:      submission.SubmissionID,
+			Title:   submission.Title,
+			Created: parseDate(submission.CreateDateSystem),
+		}}
+		for _, file := range submission.Files {
+			if utils.IsImage(file.FileURLFull) {
+				result.Files++
+			}
+		}
+		result.Predictions, result.Pages, result.failed = s.Predict(ctx, submission)
+		return result
+	})
+	worker.Work()
+
+	var pageErr error
+	go func() {
+		defer worker.Close()
+		pageErr = s.pages(ctx, artist, response, gallery.Recent, func(submissions []api.Submission) {
+			worker.Add(submissions...)
+		})
+	}()
+	for result := range worker.Iter() {
+		gallery.Submissions = append(gallery.Submissions, result.Submission)
+		gallery.Failed += result.failed
+	}
+	if pageErr != nil {
+		return nil, pageErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sortSubmissions(gallery.Submissions)
+	return gallery, nil
+}
+
+// pages reads the details of the submissions on every page of the gallery, starting with response,
+// and hands them to add until recent submissions were read, if it is positive.
+func (s Scanner) pages(ctx context.Context, artist string, response api.SubmissionSearchResponse, recent int, add func([]api.Submission)) error {
+	user := api.Credentials{Sid: s.SID}
+	read := 0
+	for page := 1; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if page > 1 {
+			var err error
+			response, err = user.SearchSubmissions(api.SubmissionSearchRequest{SID: s.SID, Username: artist, Page: api.IntString(page)})
+			utils.CountInkbunnyCall("search", err)
+			if err != nil {
+				return fmt.Errorf("error reading page %d of the submissions of %s: %w", page, artist, err)
+			}
+		}
+
+		ids := make([]string, 0, len(response.Submissions))
+		for _, submission := range response.Submissions {
+			ids = append(ids, submission.SubmissionID)
+		}
+		if recent > 0 {
+			ids = ids[:min(len(ids), recent-read)]
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		details, err := user.SubmissionDetails(api.SubmissionDetailsRequest{SID: s.SID, SubmissionIDs: strings.Join(ids, ",")})
+		utils.CountInkbunnyCall("submissions", err)
+		if err != nil {
+			return fmt.Errorf("error getting the details of page %d of the submissions of %s: %w", page, artist, err)
+		}
+		add(details.Submissions)
+
+		read += len(ids)
+		if page >= int(response.PagesCount) || (recent > 0 && read >= recent) {
+			return nil
+		}
+	}
+}
+
+// parseDate reads the dates Inkbunny gives submissions, such as "2010-12-04 05:22:48.235454+00".
+// Dates that cannot be read are left zero.
+func parseDate(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04:05-07", s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// sortSubmissions sorts submissions from the most recent, as the gallery shows them.
+func sortSubmissions(submissions []Submission) {
+	slices.SortFunc(submissions, func(a, b Submission) int {
+		return cmp.Or(
+			b.Created.Compare(a.Created),
+			cmp.Compare(len(b.ID), len(a.ID)),
+			strings.Compare(b.ID, a.ID),
+		)
+	})
+}
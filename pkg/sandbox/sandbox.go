@@ -0,0 +1,309 @@
+// Package sandbox restricts file access to a set of allowed root folders.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/archive"
+)
+
+// ErrForbidden is returned for paths outside every allowed root, including paths that only
+// escape through ".." or a symlink.
+var ErrForbidden = errors.New("path is outside of the allowed roots")
+
+// Roots is a set of allowed root folders. Files are opened through os.Root,
+// so that symlinks pointing outside a root are rejected when the file is opened.
+type Roots struct {
+	mu  sync.RWMutex
+	set *rootSet
+}
+
+// rootSet holds the opened roots. Once Replace swapped it out, it is closed as soon as nothing uses it.
+type rootSet struct {
+	paths []string
+	roots []*os.Root
+	users sync.WaitGroup
+}
+
+// New opens the allowed root folders. Each path is made absolute and has its symlinks resolved.
+func New(paths ...string) (*Roots, error) {
+	r := &Roots{set: new(rootSet)}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if abs, err = filepath.EvalSymlinks(abs); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid root %s: %w", path, err)
+		}
+		root, err := os.OpenRoot(abs)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid root %s: %w", path, err)
+		}
+		r.set.paths = append(r.set.paths, abs)
+		r.set.roots = append(r.set.roots, root)
+	}
+	return r, nil
+}
+
+// Paths returns the absolute paths of the allowed roots.
+func (r *Roots) Paths() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.set.paths
+}
+
+// acquire returns the current roots, which stay open until release is called even once Replace swapped them.
+func (r *Roots) acquire() (set *rootSet, release func()) {
+	if r == nil {
+		return new(rootSet), func() {}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.set.users.Add(1)
+	return r.set, r.set.users.Done
+}
+
+// Replace opens paths like New and makes them the allowed roots, keeping the current ones on error.
+// The roots that are replaced stay open for the file systems FS handed out, such as those of running walks,
+// and are closed once every one of them was released.
+func (r *Roots) Replace(paths ...string) error {
+	next, err := New(paths...)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.set
+	r.set = next.set
+	r.mu.Unlock()
+	go func() {
+		old.users.Wait()
+		if err := old.close(); err != nil {
+			log.Warn("Error closing replaced roots", "roots", old.paths, "err", err)
+		}
+	}()
+	return nil
+}
+
+// Close closes every root, including those still in use.
+func (r *Roots) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.set.close()
+}
+
+func (s *rootSet) close() error {
+	var errs []error
+	for _, root := range s.roots {
+		errs = append(errs, root.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Resolve finds the root that name belongs to, and returns name relative to that root.
+// Relative names are looked up in each root in order, falling back to the first root.
+// Names that leave every root, either lexically or by resolving symlinks, return ErrForbidden.
+// The root may be closed once Replace swapped it out, so it is not meant to be kept.
+func (r *Roots) Resolve(name string) (*os.Root, string, error) {
+	set, release := r.acquire()
+	defer release()
+	return set.resolve(name)
+}
+
+func (s *rootSet) resolve(name string) (*os.Root, string, error) {
+	paths, roots := s.paths, s.roots
+	if len(roots) == 0 {
+		return nil, "", fmt.Errorf("%w: no roots are configured", ErrForbidden)
+	}
+	if name == "" {
+		return nil, "", fmt.Errorf("%w: empty path", ErrForbidden)
+	}
+
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = candidates[:0]
+		for _, path := range paths {
+			candidates = append(candidates, filepath.Join(path, name))
+		}
+	}
+	var (
+		first    *os.Root
+		firstRel string
+		firstErr error
+	)
+	for i, candidate := range candidates {
+		root, rel, err := resolve(paths, roots, candidate)
+		if i == 0 {
+			first, firstRel, firstErr = root, rel, err
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := root.Stat(rel); err == nil {
+			return root, rel, nil
+		}
+	}
+	return first, firstRel, firstErr
+}
+
+// resolve matches the absolute path name against the roots at paths. The existing part of name has its symlinks
+// resolved first, so that a symlink can neither escape a root nor reach one through an alias.
+func resolve(paths []string, roots []*os.Root, name string) (*os.Root, string, error) {
+	name = filepath.Clean(name)
+	resolved, err := evalExisting(name)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, path := range paths {
+		rel, err := filepath.Rel(path, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+			continue
+		}
+		return roots[i], rel, nil
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrForbidden, name)
+}
+
+// evalExisting resolves the symlinks of the longest part of name that exists, and appends the rest as is.
+func evalExisting(name string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return filepath.Join(append([]string{name}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(name)}, rest...)
+		name = parent
+	}
+}
+
+// FS returns the file system rooted at the folder name. Its root stays open until release is called,
+// even once Replace swapped it out.
+func (r *Roots) FS(name string) (fsys fs.FS, release func(), err error) {
+	set, done := r.acquire()
+	defer func() {
+		if err != nil {
+			done()
+		}
+	}()
+	root, rel, err := set.resolve(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := root.Stat(rel)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.IsDir() {
+		return nil, nil, fmt.Errorf("%s is not a folder", name)
+	}
+	if fsys, err = fs.Sub(root.FS(), filepath.ToSlash(rel)); err != nil {
+		return nil, nil, err
+	}
+	return fsys, done, nil
+}
+
+// Open opens name inside the roots, which may be a virtual path inside an archive such as
+// "comics/issue1.cbz!/page03.png".
+func (r *Roots) Open(name string) (io.ReadSeekCloser, error) {
+	set, release := r.acquire()
+	defer release()
+	fsys, virtual, err := set.archiveFS(name)
+	if err != nil {
+		return nil, err
+	}
+	return archive.OpenSeeker(fsys, virtual)
+}
+
+// Stat returns the fs.FileInfo of name inside the roots, which may be a virtual path inside an archive.
+func (r *Roots) Stat(name string) (fs.FileInfo, error) {
+	set, release := r.acquire()
+	defer release()
+	fsys, virtual, err := set.archiveFS(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(fsys, virtual)
+}
+
+// Create creates or truncates the file name inside the roots, along with any missing parent folders.
+func (r *Roots) Create(name string) (*os.File, error) {
+	set, release := r.acquire()
+	defer release()
+	root, rel, err := set.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := ""
+	for part := range strings.SplitSeq(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		if err := root.Mkdir(dir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+	}
+	return root.Create(rel)
+}
+
+// Remove removes the file or empty folder name inside the roots.
+func (r *Roots) Remove(name string) error {
+	set, release := r.acquire()
+	defer release()
+	root, rel, err := set.resolve(name)
+	if err != nil {
+		return err
+	}
+	return root.Remove(rel)
+}
+
+// archiveFS resolves name and returns the file system of its root, along with the slash separated path
+// of name inside it. Only the path of the archive itself is resolved, as entries never leave their archive.
+// Archives are opened from the folder they are in, so that they share what a walk of that folder holds.
+func (s *rootSet) archiveFS(name string) (fs.FS, string, error) {
+	outer, entry, inArchive := archive.Split(name)
+	if !inArchive {
+		outer = name
+	}
+	root, rel, err := s.resolve(outer)
+	if err != nil {
+		return nil, "", err
+	}
+	if !inArchive {
+		return archive.FS{FS: root.FS()}, filepath.ToSlash(rel), nil
+	}
+	dir, err := fs.Sub(root.FS(), filepath.ToSlash(filepath.Dir(rel)))
+	if err != nil {
+		return nil, "", err
+	}
+	return archive.FS{FS: dir, Root: filepath.Dir(outer)}, archive.Join(filepath.Base(rel), entry), nil
+}
@@ -0,0 +1,170 @@
+package sandbox
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoots_Open(t *testing.T) {
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "allowed")
+	secret := filepath.Join(dir, "secret.txt")
+	write := func(name, content string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(allowed, "images", "a.png"), "a")
+	write(secret, "secret")
+	if err := os.Symlink(secret, filepath.Join(allowed, "escape.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(allowed, "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(allowed, "comic.cbz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	part, _ := w.Create("page01.png")
+	io.WriteString(part, "page")
+	w.Close()
+	f.Close()
+
+	roots, err := New(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roots.Close()
+
+	tests := []struct {
+		name      string
+		want      string
+		forbidden bool
+	}{
+		{name: filepath.Join(allowed, "images", "a.png"), want: "a"},
+		{name: filepath.Join("images", "a.png"), want: "a"},
+		{name: filepath.Join(allowed, "comic.cbz") + "!/page01.png", want: "page"},
+		{name: secret, forbidden: true},
+		{name: filepath.Join(allowed, "..", "secret.txt"), forbidden: true},
+		{name: filepath.Join("..", "secret.txt"), forbidden: true},
+		{name: filepath.Join(allowed, "parent", "secret.txt"), forbidden: true},
+		{name: filepath.Join(allowed, "escape.png"), forbidden: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := roots.Open(tt.name)
+			if tt.forbidden {
+				if !errors.Is(err, ErrForbidden) {
+					t.Fatalf("expected ErrForbidden, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			data, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("got %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoots_Replace(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	for _, dir := range []string{first, second} {
+		if err := os.WriteFile(filepath.Join(dir, "a.png"), []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots, err := New(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roots.Close()
+	fsys, release, err := roots.FS(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := roots.Replace(filepath.Join(second, "missing")); err == nil {
+		t.Fatal("expected an error for a missing root")
+	}
+	if err := roots.Replace(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roots.Open(filepath.Join(first, "a.png")); !errors.Is(err, ErrForbidden) {
+		t.Errorf("got %v opening a file of the replaced root, want ErrForbidden", err)
+	}
+	if _, err := roots.Open(filepath.Join(second, "a.png")); err != nil {
+		t.Errorf("got %v opening a file of the new root", err)
+	}
+	// File systems handed out before keep working until they are released, after which the root is closed.
+	if _, err := fs.ReadFile(fsys, "a.png"); err != nil {
+		t.Errorf("got %v reading through the replaced root", err)
+	}
+	release()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := fs.ReadFile(fsys, "a.png"); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the replaced root was not closed once it was released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoots_Create(t *testing.T) {
+	dir := t.TempDir()
+	roots, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roots.Close()
+
+	name := filepath.Join(dir, "export", "train", "cat", "a.png")
+	f, err := roots.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(name); err != nil || string(data) != "png" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if _, err := roots.Create(filepath.Join(dir, "..", "escape.png")); !errors.Is(err, ErrForbidden) {
+		t.Errorf("got %v creating a file outside the roots, want ErrForbidden", err)
+	}
+
+	if err := roots.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want the file to be removed", err)
+	}
+	if err := roots.Remove(filepath.Join(dir, "..", "escape.png")); !errors.Is(err, ErrForbidden) {
+		t.Errorf("got %v removing a file outside the roots, want ErrForbidden", err)
+	}
+}
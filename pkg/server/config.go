@@ -0,0 +1,39 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"classifier/pkg/archive"
+	"classifier/pkg/classify"
+	"classifier/pkg/config"
+	"classifier/pkg/sandbox"
+)
+
+// settings is the configuration requests read their defaults from. It is replaced as a whole by Configure.
+var settings atomic.Pointer[config.Config]
+
+func init() {
+	settings.Store(config.Default())
+}
+
+// Configure applies cfg, opening AllowedRoots the first time and replacing them in place afterwards.
+// Requests started from now on use its defaults and concurrency, while streams that are already
+// running keep the settings they started with, apart from the classifier URL and concurrency.
+func Configure(cfg *config.Config) error {
+	if AllowedRoots == nil {
+		roots, err := sandbox.New(cfg.AllowedRoots...)
+		if err != nil {
+			return err
+		}
+		AllowedRoots = roots
+	} else if err := AllowedRoots.Replace(cfg.AllowedRoots...); err != nil {
+		return err
+	}
+	if err := classify.SetPredictURL(cfg.Classifier.PredictURL); err != nil {
+		return err
+	}
+	classify.DefaultScheduler.Resize(cfg.Classifier.Concurrency, cfg.Classifier.BackgroundShare)
+	archive.SetMaxSize(int64(cfg.Limits.ArchiveMB) << 20)
+	settings.Store(cfg)
+	return nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/lib"
+	"classifier/pkg/utils"
+	"classifier/pkg/walker"
+)
+
+// FolderWatcher polls a local folder and streams a Result for every image that is
+// added or modified, once its writes have settled.
+func FolderWatcher(w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	encryptKey := r.URL.Query().Get("encrypt_key")
+	shouldClassify := r.URL.Query().Get("classify") == "true"
+	existing := r.URL.Query().Get("existing") == "true"
+
+	if folder == "" {
+		http.Error(w, "folder parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// The folder is watched through its root, so that it stays inside the allowed roots.
+	fsys, release, err := AllowedRoots.FS(folder)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+
+	interval, err := parseSeconds(r.URL.Query().Get("refresh_rate_seconds"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	settle, err := parseSeconds(r.URL.Query().Get("settle_seconds"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	distanceConfig, err := newDistanceConfig(r.URL.Query(), nil) // local files are expected to be unencrypted
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var plain *lib.Crypto
+	distanceConfig.method = plain.OpenWith(AllowedRoots.Open, plain.Decoder)
+
+	crypto, err := lib.NewCrypto(encryptKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	classifyConfig := classifyConfig[*lib.CryptoFile]{
+		enabled: shouldClassify,
+		crypto:  crypto,
+		method:  crypto.OpenWith(AllowedRoots.Open, crypto.Encrypt),
+	}
+
+	if !distanceConfig.enabled && !classifyConfig.enabled {
+		return
+	}
+
+	distanceWorker := distanceConfig.worker(r.Context())
+	classifyWorker := classifyConfig.worker(r.Context())
+	distanceWorker.Work()
+	classifyWorker.Work()
+
+	concurrency := settings.Load().Concurrency
+	worker := utils.NewWorkerPool(max(concurrency.Distance, concurrency.Classify), func(change walker.Change) *Result {
+		if change.Status == walker.Modified {
+			classify.DefaultCache.Delete(change.Path)
+		}
+		result, err := Collect(r.Context(), change.Path, distanceWorker.Promise(change.Path), classifyWorker.Promise(change.Path))
+		if err != nil {
+			log.Errorf("Error processing %s: %v", change.Path, err)
+			return nil
+		}
+		return result
+	})
+
+	changes := make(chan walker.Change)
+	go walker.Watch(r.Context(), fsys, folder, changes, walker.WatchConfig{
+		Interval: interval,
+		Settle:   settle,
+		Skipper:  utils.NotImage,
+		Existing: existing,
+	})
+	go worker.AddAndCloseIter(utils.Iter(changes))
+
+	worker.Work()
+	log.Info("Starting folder watcher", "folder", folder, "distance", distanceConfig.enabled, "classify", classifyConfig.enabled)
+	Respond(w, r, worker.Iter())
+	distanceWorker.Close()
+	classifyWorker.Close()
+	log.Info("Finished watching folder", "folder", folder)
+}
+
+// parseSeconds parses an optional number of seconds, returning zero when s is empty.
+func parseSeconds(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s + "s")
+	if err != nil {
+		return 0, err
+	}
+	return d, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFolderWatcher(t *testing.T) {
+	folder := testImages(t, 0)
+	writeImage := func(name string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A relative folder is inside the roots, whatever the working directory holds under the same name.
+	writeImage(filepath.Join(folder, "sub", "inside.png"))
+	cwd := t.TempDir()
+	writeImage(filepath.Join(cwd, "sub", "outside.png"))
+	t.Chdir(cwd)
+
+	srv := httptest.NewServer(http.HandlerFunc(FolderWatcher))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	query := "?folder=sub&existing=true&distance=true&color=%23000000&threshold=100&refresh_rate_seconds=0.02&settle_seconds=0.01"
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var result Result
+		if err := json.Unmarshal([]byte(data), &result); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if want := filepath.Join("sub", "inside.png"); result.Path != want {
+			t.Fatalf("got %s, want %s", result.Path, want)
+		}
+		return
+	}
+	t.Fatalf("no result before the stream ended: %v", scanner.Err())
+}
+
+func TestFolderWatcher_Forbidden(t *testing.T) {
+	testImages(t, 0)
+	for _, folder := range []string{"..", t.TempDir()} {
+		w := httptest.NewRecorder()
+		FolderWatcher(w, httptest.NewRequest("GET", "/watch/folder?distance=true&color=%23000000&folder="+folder, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", folder, w.Code)
+		}
+	}
+}
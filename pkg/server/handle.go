@@ -8,8 +8,9 @@ import (
 	"io"
 	"iter"
 	"net/http"
-	"runtime"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/lucasb-eyer/go-colorful"
@@ -20,51 +21,106 @@ import (
 	"classifier/pkg/utils"
 )
 
+// Event is a server-sent event. Events without a Name are delivered as plain messages,
+// while named events such as "progress" are only seen by clients listening for them.
+// Events with an ID let clients resume from them after reconnecting with Last-Event-ID.
+type Event struct {
+	ID   string
+	Name string
+	Data any
+}
+
+// heartbeatInterval is how often a comment is sent to idle streams, so that proxies keep the connection open.
+var heartbeatInterval = 15 * time.Second
+
 // Respond sends any results from the worker to the client.
 func Respond[P ~*T, T any](w http.ResponseWriter, r *http.Request, worker iter.Seq[P]) {
+	RespondEvents(w, r, results(worker))
+}
+
+// results turns every non-nil result into an unnamed event.
+func results[P ~*T, T any](worker iter.Seq[P]) iter.Seq[Event] {
+	return func(yield func(Event) bool) {
+		for res := range worker {
+			if res == nil {
+				continue
+			}
+			if !yield(Event{Data: res}) {
+				return
+			}
+		}
+	}
+}
+
+// RespondEvents streams events to the client, followed by an exit event, sending a heartbeat whenever
+// no event was sent for heartbeatInterval. Clients that cannot be streamed to receive the data
+// of every unnamed event as one JSON array. Events are always read until the end, even once the client left.
+func RespondEvents(w http.ResponseWriter, r *http.Request, events iter.Seq[Event]) {
 	enc := json.NewEncoder(w)
 	if flusher, ok := w.(http.Flusher); ok {
 		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
-		for res := range worker {
-			if res == nil {
-				continue
+		w.Header().Set("X-Accel-Buffering", "no")
+		flusher.Flush()
+		sseClients.Inc()
+		defer sseClients.Dec()
+
+		ch := make(chan Event)
+		go func() {
+			defer close(ch)
+			for event := range events {
+				select {
+				case ch <- event:
+				case <-r.Context().Done(): // interrupt detected, keep reading without sending
+				}
 			}
+		}()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		var err error
+		for {
 			select {
-			case <-r.Context().Done():
-				break // interrupt detected
-			default:
-				if _, err := w.Write([]byte("data: ")); err != nil {
-					log.Error("error writing data:", "err", err)
+			case event, ok := <-ch:
+				if !ok {
+					if err == nil {
+						if _, err := w.Write([]byte("event: exit\ndata: exit\n\n")); err != nil {
+							log.Error("error sending exit event", "err", err)
+						}
+					}
 					return
 				}
-				if err := enc.Encode(res); err != nil {
-					log.Error("error writing data:", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+				if err != nil {
+					continue
 				}
-				if _, err := w.Write([]byte("\n")); err != nil {
+				if err = writeEvent(w, enc, event); err != nil {
 					log.Error("error writing data:", "err", err)
-					return
+					continue
+				}
+				flusher.Flush()
+				heartbeat.Reset(heartbeatInterval)
+			case <-heartbeat.C:
+				if err != nil {
+					continue
+				}
+				if _, err = w.Write([]byte(": heartbeat\n\n")); err != nil {
+					continue
 				}
 				flusher.Flush()
 			}
 		}
-		if _, err := w.Write([]byte("event: exit\ndata: exit\n\n")); err != nil {
-			log.Error("error sending exit event", "err", err)
-		}
 	} else {
-		var allResults []P
-		for res := range worker {
-			if res == nil {
+		var allResults []any
+		for event := range events {
+			if event.Name != "" {
 				continue
 			}
 			select {
 			case <-r.Context().Done():
 				break
 			default:
-				allResults = append(allResults, res)
+				allResults = append(allResults, event.Data)
 			}
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -76,26 +132,58 @@ func Respond[P ~*T, T any](w http.ResponseWriter, r *http.Request, worker iter.S
 	}
 }
 
+// writeEvent writes a single event, with its id and name if it has them.
+func writeEvent(w io.Writer, enc *json.Encoder, event Event) error {
+	if event.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.ID); err != nil {
+			return err
+		}
+	}
+	if event.Name != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event.Name); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if err := enc.Encode(event.Data); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("\n"))
+	return err
+}
+
 type Result struct {
 	Path       string               `json:"path"`
 	URL        string               `json:"url,omitempty"`
 	Color      *float64             `json:"color,omitempty"`
 	Prediction *classify.Prediction `json:"prediction,omitempty"`
+	Deleted    bool                 `json:"deleted,omitempty"`
 }
 
 type distanceConfig[R io.ReadSeekCloser] struct {
-	enabled   bool
-	target    colorful.Color
-	metric    func(colorful.Color, colorful.Color) float64
-	threshold float64
-	method    func(string) (R, error)
+	enabled    bool
+	target     colorful.Color
+	metric     func(colorful.Color, colorful.Color) float64
+	metricName string
+	threshold  float64
+	method     func(string) (R, error)
 }
 
-func newDistanceConfig(r *http.Request, crypto *lib.Crypto) (distanceConfig[*lib.CryptoFile], error) {
-	colorHex := r.URL.Query().Get("color")
-	thresholdStr := r.URL.Query().Get("threshold")
-	metricStr := r.URL.Query().Get("metric")
-	shouldGetDistance := r.URL.Query().Get("distance") == "true"
+// key describes what the distance stage measures, to tell apart walks that would not measure the same.
+func (d *distanceConfig[_]) key() string {
+	if !d.enabled {
+		return ""
+	}
+	return fmt.Sprintf("distance=%s,%s,%g", d.target.Hex(), d.metricName, d.threshold)
+}
+
+func newDistanceConfig(query url.Values, crypto *lib.Crypto) (distanceConfig[*lib.CryptoFile], error) {
+	colorHex := query.Get("color")
+	thresholdStr := query.Get("threshold")
+	metricStr := query.Get("metric")
+	shouldGetDistance := query.Get("distance") == "true"
 
 	if !shouldGetDistance {
 		return distanceConfig[*lib.CryptoFile]{enabled: false}, nil
@@ -105,7 +193,8 @@ func newDistanceConfig(r *http.Request, crypto *lib.Crypto) (distanceConfig[*lib
 		return distanceConfig[*lib.CryptoFile]{enabled: false}, errors.New("folder and color parameters are required")
 	}
 
-	threshold := 0.1
+	defaults := settings.Load().Distance
+	threshold := defaults.Threshold
 	if thresholdStr != "" {
 		if t, err := strconv.ParseFloat(thresholdStr, 64); err == nil {
 			threshold = t
@@ -118,35 +207,22 @@ func newDistanceConfig(r *http.Request, crypto *lib.Crypto) (distanceConfig[*lib
 		return distanceConfig[*lib.CryptoFile]{enabled: false}, errors.New("invalid color format; use hex (e.g. #ff0000)")
 	}
 
-	metric := colorful.Color.DistanceLab
-	switch metricStr {
-	case "DistanceRgb":
-		metric = colorful.Color.DistanceRgb
-	case "DistanceLab":
-		metric = colorful.Color.DistanceLab
-	case "DistanceLuv":
-		metric = colorful.Color.DistanceLuv
-	case "DistanceCIE76":
-		metric = colorful.Color.DistanceCIE76
-	case "DistanceCIE94":
-		metric = colorful.Color.DistanceCIE94
-	case "DistanceCIEDE2000":
-		metric = colorful.Color.DistanceCIEDE2000
-	default:
-		metric = colorful.Color.DistanceLab
+	if _, ok := distance.Metrics[metricStr]; !ok {
+		metricStr = defaults.Metric
 	}
 
 	return distanceConfig[*lib.CryptoFile]{
-		enabled:   shouldGetDistance,
-		target:    target,
-		metric:    metric,
-		threshold: threshold,
-		method:    crypto.Open,
+		enabled:    shouldGetDistance,
+		target:     target,
+		metric:     distance.Metrics[metricStr],
+		metricName: metricStr,
+		threshold:  threshold,
+		method:     crypto.Open,
 	}, nil
 }
 
 func (d *distanceConfig[_]) worker(ctx context.Context) utils.WorkerPool[string, *float64] {
-	return utils.NewWorkerPool(runtime.NumCPU(), func(path string) *float64 {
+	return utils.NewWorkerPool(settings.Load().Concurrency.Distance, func(path string) *float64 {
 		if !d.enabled {
 			return nil
 		}
@@ -184,7 +260,7 @@ type classifyConfig[R io.ReadSeekCloser] struct {
 }
 
 func (d *classifyConfig[_]) worker(ctx context.Context) utils.WorkerPool[string, *classify.Prediction] {
-	return utils.NewWorkerPool(runtime.NumCPU(), func(path string) *classify.Prediction {
+	return utils.NewWorkerPool(settings.Load().Concurrency.Classify, func(path string) *classify.Prediction {
 		if !d.enabled {
 			return nil
 		}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+
+	"classifier/pkg/health"
+)
+
+// ReadyChecks are run by ReadyHandler. Until it is set, the server is ready as soon as it is alive.
+var ReadyChecks []health.Check
+
+// HealthHandler reports that the process is alive.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// ReadyHandler runs ReadyChecks, responding with 503 Service Unavailable unless all of them pass.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := health.Run(r.Context(), ReadyChecks...)
+	if !report.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,736 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/utils"
+	"classifier/pkg/walker"
+)
+
+// JobKind is what a job runs.
+type JobKind string
+
+const (
+	// JobWalk walks a local folder, taking the same parameters as /walk.
+	JobWalk JobKind = "walk"
+	// JobScan watches Inkbunny for new submissions, taking the same parameters as /watch.
+	JobScan JobKind = "scan"
+)
+
+// JobStatus is the state of a job.
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// jobSaveInterval is how often a running job writes its progress to disk.
+const jobSaveInterval = 5 * time.Second
+
+// errJobLimit is returned by Start when the client already has as many jobs running as it may.
+var errJobLimit = errors.New("too many jobs")
+
+// Job is a walk or scan that runs in the background, independently of the request that started it.
+// Its state is saved to job.json and every result is appended to results.jsonl in the job's folder,
+// so that both survive a restart. Walks also keep their own checkpoint.json there, which they resume from.
+type Job struct {
+	ID       string           `json:"id"`
+	Kind     JobKind          `json:"kind"`
+	Client   string           `json:"client,omitempty"` // Client started the job, and has it count towards its limits.
+	Params   url.Values       `json:"params"`
+	Status   JobStatus        `json:"status"`
+	Error    string           `json:"error,omitempty"`
+	Results  int              `json:"results"`
+	Progress *walker.Snapshot `json:"progress,omitempty"`
+	Created  time.Time        `json:"created"`
+	Until    time.Time        `json:"until,omitzero"` // Until is when a scan completes, from its duration_seconds parameter.
+	Finished time.Time        `json:"finished,omitzero"`
+
+	mu       sync.Mutex
+	dir      string
+	offsets  []int64 // offsets holds where each result starts in results.jsonl, and where the next one will.
+	progress *walker.Progress
+	cancel   context.CancelFunc
+	changed  chan struct{}
+	stopped  chan struct{}   // stopped is closed once a started job saved its last result.
+	written  map[string]bool // written holds the paths a restarted walk already saved, so that they are not saved twice.
+}
+
+// Jobs keeps every job and runs them in the background.
+type Jobs struct {
+	dir  string
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+// DefaultJobs is used by the job handlers. Until it is set, no job can be started.
+var DefaultJobs *Jobs
+
+// LoadJobs reads every job saved in dir. Jobs that were still running when the server stopped are started again,
+// with walks resuming from their own checkpoint.
+func LoadJobs(dir string) (*Jobs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	jobs := &Jobs{dir: dir, jobs: make(map[string]*Job)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		job, err := loadJob(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			log.Warn("Could not load job", "id", entry.Name(), "err", err)
+			continue
+		}
+		jobs.jobs[job.ID] = job
+		if job.Status == JobRunning {
+			log.Info("Restarting interrupted job", "id", job.ID, "kind", job.Kind, "results", job.Results)
+			if err := job.start(); err != nil {
+				job.finish(err)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+func loadJob(dir string) (*Job, error) {
+	f, err := os.Open(filepath.Join(dir, "job.json"))
+	if err != nil {
+		return nil, err
+	}
+	job, err := utils.DecodeAndClose[*Job](f)
+	if err != nil {
+		return nil, err
+	}
+	job.dir = dir
+	job.changed = make(chan struct{})
+	if job.offsets, err = indexResults(filepath.Join(dir, "results.jsonl")); err != nil {
+		return nil, err
+	}
+	job.Results = len(job.offsets) - 1
+	return job, nil
+}
+
+// indexResults returns where each line of the results file starts, followed by its size.
+func indexResults(name string) ([]int64, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []int64{0}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	offsets := []int64{0}
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			offset += int64(len(line))
+			offsets = append(offsets, offset)
+		}
+		if err == io.EOF {
+			// A partial line was cut off by a crash, drop it so that the next result starts cleanly.
+			return offsets, f.Truncate(offset)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resultPaths returns the path of every result in the results file, other than deleted files.
+func resultPaths(name string) (map[string]bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	paths := make(map[string]bool)
+	decoder := json.NewDecoder(f)
+	for {
+		var result Result
+		err := decoder.Decode(&result)
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !result.Deleted {
+			paths[result.Path] = true
+		}
+	}
+}
+
+// Start creates a job of the given kind for client and runs it in the background, unless client already has
+// limit jobs running, in which case it returns errJobLimit. A limit of zero allows any number of jobs.
+func (j *Jobs) Start(kind JobKind, client string, params url.Values, limit int) (*Job, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	job := &Job{
+		ID:      hex.EncodeToString(id),
+		Kind:    kind,
+		Client:  client,
+		Params:  params,
+		Status:  JobRunning,
+		Created: time.Now(),
+		dir:     filepath.Join(j.dir, hex.EncodeToString(id)),
+		offsets: []int64{0},
+		changed: make(chan struct{}),
+	}
+	if kind == JobScan {
+		duration, err := parseSeconds(params.Get("duration_seconds"))
+		if err != nil || duration < 0 {
+			return nil, badRequest(fmt.Errorf("invalid duration_seconds %q", params.Get("duration_seconds")))
+		}
+		if duration > 0 {
+			job.Until = job.Created.Add(duration)
+		}
+	}
+
+	// The job is counted as running from the moment it is checked against the limit, so that concurrent
+	// requests from the same client cannot start more than limit between them.
+	j.mu.Lock()
+	if limit > 0 && j.running(client) >= limit {
+		j.mu.Unlock()
+		return nil, fmt.Errorf("%w, at most %d can run at once", errJobLimit, limit)
+	}
+	j.jobs[job.ID] = job
+	j.mu.Unlock()
+
+	err := os.MkdirAll(job.dir, 0755)
+	if err == nil {
+		if err = job.start(); err != nil {
+			os.RemoveAll(job.dir)
+		}
+	}
+	if err != nil {
+		j.mu.Lock()
+		delete(j.jobs, job.ID)
+		j.mu.Unlock()
+		return nil, err
+	}
+	return job, nil
+}
+
+// Get returns the job with id.
+func (j *Jobs) Get(id string) (*Job, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	job, ok := j.jobs[id]
+	return job, ok
+}
+
+// Running returns how many jobs client has running.
+func (j *Jobs) Running(client string) int {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.running(client)
+}
+
+// running is Running for callers that hold j.mu.
+func (j *Jobs) running(client string) int {
+	var n int
+	for _, job := range j.jobs {
+		job.mu.Lock()
+		if job.Client == client && job.Status == JobRunning {
+			n++
+		}
+		job.mu.Unlock()
+	}
+	return n
+}
+
+// List returns every job, newest first.
+func (j *Jobs) List() []*Job {
+	j.mu.RLock()
+	jobs := make([]*Job, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		jobs = append(jobs, job)
+	}
+	j.mu.RUnlock()
+	slices.SortFunc(jobs, func(a, b *Job) int { return b.Created.Compare(a.Created) })
+	return jobs
+}
+
+// Stop cancels every running job when the server shuts down, and waits until they saved their results
+// or ctx is done. Their status stays running, so that LoadJobs starts them again.
+func (j *Jobs) Stop(ctx context.Context) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.RLock()
+	var stopped []chan struct{}
+	for _, job := range j.jobs {
+		job.mu.Lock()
+		if job.cancel != nil {
+			job.cancel()
+			stopped = append(stopped, job.stopped)
+		}
+		job.mu.Unlock()
+	}
+	j.mu.RUnlock()
+	for _, done := range stopped {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// start parses the job's parameters and runs it in a new goroutine.
+func (job *Job) start() error {
+	// Nobody waits on jobs, so they only get their share of the classifier while clients are waiting on it.
+	ctx := classify.WithPriority(context.Background(), classify.Background)
+	var cancel context.CancelFunc
+	if job.Until.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		// Scans run until Until, and then complete like a walk does once it visited every file.
+		ctx, cancel = context.WithDeadline(ctx, job.Until)
+	}
+	results := make(chan *Result)
+	progress := new(walker.Progress)
+	switch job.Kind {
+	case JobWalk:
+		walk, err := newWalk(job.Params)
+		if errors.Is(err, errNothingToDo) {
+			err = badRequest(errors.New("either distance or classify must be enabled, along with max"))
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		// Jobs always keep a checkpoint of their own, whether or not they were asked to resume,
+		// so that a restarted job continues where it stopped rather than where another walk did.
+		walk.checkpoint, err = walker.LoadCheckpoint(filepath.Join(job.dir, "checkpoint.json"), walk.folder, walk.shard)
+		if err == nil && job.Results > 0 {
+			job.written, err = resultPaths(filepath.Join(job.dir, "results.jsonl"))
+		}
+		if err != nil {
+			walk.release()
+			cancel()
+			return err
+		}
+		go walk.run(ctx, results, progress)
+	case JobScan:
+		watch, err := newWatch(job.Params)
+		if errors.Is(err, errNothingToDo) {
+			err = badRequest(errors.New("either distance or classify must be enabled"))
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		go watch.run(ctx, results)
+	default:
+		cancel()
+		return badRequest(fmt.Errorf("unknown job kind %q", job.Kind))
+	}
+
+	job.mu.Lock()
+	job.cancel = cancel
+	job.progress = progress
+	job.stopped = make(chan struct{})
+	job.mu.Unlock()
+	if err := job.save(); err != nil {
+		// The walk or scan already started, so it is waited for like Stop does.
+		cancel()
+		for range results {
+		}
+		job.mu.Lock()
+		job.cancel = nil
+		close(job.stopped)
+		job.mu.Unlock()
+		return err
+	}
+	go job.collect(ctx, results)
+	log.Info("Started job", "id", job.ID, "kind", job.Kind)
+	return nil
+}
+
+// collect appends every result to the results file, saving the job's progress along the way.
+func (job *Job) collect(ctx context.Context, results <-chan *Result) {
+	defer close(job.stopped)
+	f, err := os.OpenFile(filepath.Join(job.dir, "results.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		for range results {
+		}
+		job.finish(err)
+		return
+	}
+	defer f.Close()
+
+	ticker := time.NewTicker(jobSaveInterval)
+	defer ticker.Stop()
+	var writeErr error
+	for {
+		select {
+		case <-ticker.C:
+			if err := job.save(); err != nil {
+				log.Warn("Could not save job", "id", job.ID, "err", err)
+			}
+		case result, ok := <-results:
+			if !ok {
+				if errors.Is(ctx.Err(), context.Canceled) && writeErr == nil {
+					// Cancelled by Cancel or the server shutting down, rather than by the job finishing.
+					job.mu.Lock()
+					status := job.Status
+					job.mu.Unlock()
+					if status == JobRunning {
+						job.save()
+						return
+					}
+				}
+				job.finish(writeErr)
+				return
+			}
+			if writeErr != nil || job.written[result.Path] && !result.Deleted {
+				continue
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				writeErr = err
+				continue
+			}
+			if _, err := f.Write(append(data, '\n')); err != nil {
+				writeErr = err
+				continue
+			}
+			job.mu.Lock()
+			job.offsets = append(job.offsets, job.offsets[len(job.offsets)-1]+int64(len(data))+1)
+			job.Results++
+			job.notify()
+			job.mu.Unlock()
+		}
+	}
+}
+
+// finish records how the job ended and saves it.
+func (job *Job) finish(err error) {
+	job.mu.Lock()
+	switch {
+	case job.Status == JobCancelled:
+	case err != nil:
+		job.Status = JobFailed
+		job.Error = err.Error()
+	default:
+		job.Status = JobCompleted
+	}
+	job.Finished = time.Now()
+	job.cancel = nil
+	if job.progress != nil && job.Kind == JobWalk {
+		// Keep the final progress, rather than letting its elapsed time grow forever.
+		snapshot := job.progress.Snapshot()
+		job.Progress = &snapshot
+	}
+	job.progress = nil
+	job.notify()
+	job.mu.Unlock()
+	if err := job.save(); err != nil {
+		log.Warn("Could not save job", "id", job.ID, "err", err)
+	}
+	log.Info("Finished job", "id", job.ID, "status", job.Status, "results", job.Results)
+}
+
+// Cancel stops the job if it is still running.
+func (job *Job) Cancel() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.Status != JobRunning || job.cancel == nil {
+		return false
+	}
+	job.Status = JobCancelled
+	job.cancel()
+	return true
+}
+
+// notify wakes up everyone waiting for new results. The caller must hold job.mu.
+func (job *Job) notify() {
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+// Snapshot returns a copy of the job with its current progress, safe to encode.
+func (job *Job) Snapshot() *Job {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	clone := &Job{
+		ID:       job.ID,
+		Kind:     job.Kind,
+		Client:   job.Client,
+		Params:   job.Params,
+		Status:   job.Status,
+		Error:    job.Error,
+		Results:  job.Results,
+		Progress: job.Progress,
+		Created:  job.Created,
+		Until:    job.Until,
+		Finished: job.Finished,
+	}
+	if job.progress != nil && job.Kind == JobWalk {
+		snapshot := job.progress.Snapshot()
+		clone.Progress = &snapshot
+	}
+	return clone
+}
+
+func (job *Job) save() error {
+	snapshot := job.Snapshot()
+	job.mu.Lock()
+	job.Progress = snapshot.Progress
+	job.mu.Unlock()
+
+	name := filepath.Join(job.dir, "job.json")
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := utils.Encode(f, snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Read returns up to limit results starting at offset, along with a channel that is closed once more results
+// are available or the job finished, and whether the job is still running.
+func (job *Job) Read(offset, limit int) ([]json.RawMessage, <-chan struct{}, bool, error) {
+	job.mu.Lock()
+	offsets := job.offsets
+	changed := job.changed
+	running := job.Status == JobRunning && job.cancel != nil
+	job.mu.Unlock()
+
+	total := len(offsets) - 1
+	if offset >= total || limit <= 0 {
+		return nil, changed, running, nil
+	}
+	end := min(offset+limit, total)
+
+	f, err := os.Open(filepath.Join(job.dir, "results.jsonl"))
+	if err != nil {
+		return nil, changed, running, err
+	}
+	defer f.Close()
+	data := make([]byte, offsets[end]-offsets[offset])
+	if _, err := f.ReadAt(data, offsets[offset]); err != nil {
+		return nil, changed, running, err
+	}
+	results := make([]json.RawMessage, 0, end-offset)
+	for i := offset; i < end; i++ {
+		start, stop := offsets[i]-offsets[offset], offsets[i+1]-offsets[offset]-1
+		results = append(results, json.RawMessage(data[start:stop]))
+	}
+	return results, changed, running, nil
+}
+
+// JobsHandler starts a job from a JSON body such as {"kind": "walk", "params": {"folder": "images", "max": "100"}},
+// where params are the query parameters of /walk for walks, or of /watch for scans.
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	if DefaultJobs == nil {
+		http.Error(w, "jobs are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	request, err := utils.Decode[struct {
+		Kind   JobKind           `json:"kind"`
+		Params map[string]string `json:"params"`
+	}](r.Body)
+	if err != nil {
+		http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := make(url.Values, len(request.Params))
+	for key, value := range request.Params {
+		params.Set(key, value)
+	}
+	job, err := DefaultJobs.Start(request.Kind, clientID(r), params, settings.Load().Limits.Jobs)
+	if errors.Is(err, errJobLimit) {
+		rateLimited.Inc(r.Pattern, "jobs")
+		tooManyRequests(w, jobsRetry, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSONStatus(w, http.StatusAccepted, job.Snapshot())
+}
+
+// ListJobsHandler returns every job of the client, newest first.
+func ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshots := []*Job{}
+	if DefaultJobs == nil {
+		writeJSON(w, snapshots)
+		return
+	}
+	client := clientID(r)
+	for _, job := range DefaultJobs.List() {
+		if job.owned(client) {
+			snapshots = append(snapshots, job.Snapshot())
+		}
+	}
+	writeJSON(w, snapshots)
+}
+
+// JobHandler returns the status and progress of a job.
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := getJob(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, job.Snapshot())
+}
+
+// CancelJobHandler cancels a running job. Its results so far are kept.
+func CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := getJob(w, r)
+	if !ok {
+		return
+	}
+	if !job.Cancel() {
+		http.Error(w, fmt.Sprintf("job %s is not running", job.ID), http.StatusConflict)
+		return
+	}
+	log.Info("Cancelled job", "id", job.ID)
+	writeJSON(w, job.Snapshot())
+}
+
+// JobResultsHandler returns a page of up to limit results starting at offset, along with the offset of the next page.
+// With stream=true, results from offset onwards are streamed as they arrive until the job finishes,
+// and reconnecting with Last-Event-ID continues after the last result received.
+// With format, every result saved so far is downloaded as a report, as with /walk.
+func JobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := getJob(w, r)
+	if !ok {
+		return
+	}
+	offset, limit := 0, 100
+	s := r.URL.Query().Get("offset")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		s = id // every event's id is the offset of the result after it
+	}
+	if s != "" {
+		var err error
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	format, err := parseReportFormat(r.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if format != "" {
+		writeReport(w, format, "job-"+job.ID, jobResults(job))
+		return
+	}
+
+	if r.URL.Query().Get("stream") != "true" {
+		results, _, _, err := job.Read(offset, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if results == nil {
+			results = []json.RawMessage{}
+		}
+		writeJSON(w, struct {
+			Results []json.RawMessage `json:"results"`
+			Next    int               `json:"next"`
+		}{results, offset + len(results)})
+		return
+	}
+
+	RespondEvents(w, r, func(yield func(Event) bool) {
+		for {
+			results, changed, running, err := job.Read(offset, limit)
+			if err != nil {
+				log.Error("Error reading job results", "id", job.ID, "err", err)
+				return
+			}
+			for i, result := range results {
+				if !yield(Event{ID: strconv.Itoa(offset + i + 1), Data: result}) {
+					return
+				}
+			}
+			offset += len(results)
+			if len(results) > 0 {
+				continue
+			}
+			if !running {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-changed:
+			}
+		}
+	})
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	if DefaultJobs == nil {
+		http.Error(w, "jobs are not enabled", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	// Jobs of other clients are not found, so that their IDs cannot be told apart from unknown ones.
+	job, ok := DefaultJobs.Get(r.PathValue("id"))
+	if !ok || !job.owned(clientID(r)) {
+		http.Error(w, fmt.Sprintf("job %s not found", r.PathValue("id")), http.StatusNotFound)
+		return nil, false
+	}
+	return job, true
+}
+
+// owned reports whether client may see and cancel the job: only the client that started it may,
+// unless it was started without one, as jobs saved before they had a client were.
+func (job *Job) owned(client string) bool {
+	return job.Client == "" || job.Client == client
+}
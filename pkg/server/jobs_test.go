@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"classifier/pkg/sandbox"
+)
+
+// testImages writes n white images to a new folder allowed by AllowedRoots, and returns the folder.
+func testImages(t *testing.T, n int) string {
+	t.Helper()
+	dir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for i := range n {
+		f, err := os.Create(filepath.Join(dir, strconv.Itoa(i)+".png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	roots, err := sandbox.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := AllowedRoots
+	AllowedRoots = roots
+	t.Cleanup(func() {
+		AllowedRoots = previous
+		roots.Close()
+	})
+	return dir
+}
+
+// walkParams are the parameters of a walk over folder that finds every white image.
+func walkParams(folder string, max int) url.Values {
+	return url.Values{
+		"folder":    {folder},
+		"max":       {strconv.Itoa(max)},
+		"distance":  {"true"},
+		"color":     {"#ffffff"},
+		"threshold": {"100"},
+	}
+}
+
+// waitJob waits until job is no longer running.
+func waitJob(t *testing.T, job *Job) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		_, changed, running, err := job.Read(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !running {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("job %s is still running", job.ID)
+		}
+	}
+}
+
+// jobPaths returns the path of every result of job.
+func jobPaths(t *testing.T, job *Job) []string {
+	t.Helper()
+	results, _, _, err := job.Read(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, len(results))
+	for i, data := range results {
+		var result Result
+		if err := json.Unmarshal(data, &result); err != nil {
+			t.Fatal(err)
+		}
+		paths[i] = result.Path
+	}
+	return paths
+}
+
+func TestJobs_Restart(t *testing.T) {
+	folder := testImages(t, 5)
+	dir := t.TempDir()
+	jobs, err := LoadJobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := jobs.Start(JobWalk, "", walkParams(folder, 2), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, job)
+	if got := job.Snapshot(); got.Status != JobCompleted || got.Results != 2 {
+		t.Fatalf("got %s with %d results, want completed with 2", got.Status, got.Results)
+	}
+	if _, err := os.Stat(filepath.Join(job.dir, "checkpoint.json")); err != nil {
+		t.Fatalf("the job did not keep its own checkpoint: %v", err)
+	}
+
+	// Pretend the server stopped while the job was running, after it saved another result but before it
+	// saved the checkpoint, and while it was writing a result.
+	state := map[string]any{}
+	data, err := os.ReadFile(filepath.Join(job.dir, "job.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	state["status"] = JobRunning
+	state["params"] = walkParams(folder, 100)
+	delete(state, "finished")
+	if data, err = json.Marshal(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(job.dir, "job.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(job.dir, "results.jsonl"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"path":"` + filepath.Join(folder, "2.png") + `","color":0}` + "\n" + `{"path":"`)
+	f.Close()
+
+	jobs, err = LoadJobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, ok := jobs.Get(job.ID)
+	if !ok {
+		t.Fatalf("job %s was not loaded", job.ID)
+	}
+	waitJob(t, restarted)
+	if got := restarted.Snapshot(); got.Status != JobCompleted {
+		t.Fatalf("got %s (%s), want completed", got.Status, got.Error)
+	}
+	paths := jobPaths(t, restarted)
+	if len(paths) != 5 {
+		t.Fatalf("got %v, want every image once", paths)
+	}
+	for i, path := range paths {
+		if want := filepath.Join(folder, strconv.Itoa(i)+".png"); path != want {
+			t.Errorf("result %d is %s, want %s", i, path, want)
+		}
+	}
+}
+
+func TestJobs_Start(t *testing.T) {
+	jobs, err := LoadJobs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, duration := range []string{"-1", "soon"} {
+		params := url.Values{"distance": {"true"}, "color": {"#ffffff"}, "duration_seconds": {duration}}
+		if _, err := jobs.Start(JobScan, "", params, 0); err == nil {
+			t.Errorf("duration_seconds=%s: expected an error", duration)
+		}
+	}
+	if _, err := jobs.Start(JobWalk, "", url.Values{"folder": {t.TempDir()}, "max": {"1"}}, 0); err == nil {
+		t.Error("expected an error for a walk with nothing to do")
+	}
+	if n := len(jobs.List()); n != 0 {
+		t.Errorf("got %d jobs, want none to be kept", n)
+	}
+}
+
+func TestJobs_StartLimit(t *testing.T) {
+	release := blockingClassifier(t)
+	folder := testImages(t, 1)
+	jobs, err := LoadJobs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		close(release)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		jobs.Stop(ctx)
+	}()
+
+	params := url.Values{"folder": {folder}, "max": {"1"}, "classify": {"true"}}
+	var started, limited atomic.Int64
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jobs.Start(JobWalk, "client", params, 2)
+			switch {
+			case err == nil:
+				started.Add(1)
+			case errors.Is(err, errJobLimit):
+				limited.Add(1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if started.Load() != 2 || limited.Load() != 8 {
+		t.Errorf("started %d and limited %d jobs at once, want 2 and 8", started.Load(), limited.Load())
+	}
+	if _, err := jobs.Start(JobWalk, "other", params, 2); err != nil {
+		t.Errorf("got %v for another client, want its own limit", err)
+	}
+}
+
+func TestJobsHandler(t *testing.T) {
+	folder := testImages(t, 1)
+	jobs, err := LoadJobs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(jobs *Jobs) { DefaultJobs = jobs }(DefaultJobs)
+	DefaultJobs = jobs
+
+	body := `{"kind": "walk", "params": {"folder": "` + folder + `", "max": "1", "distance": "true", "color": "#ffffff"}}`
+	w := httptest.NewRecorder()
+	JobsHandler(w, httptest.NewRequest("POST", "/jobs", strings.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var job Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Location"); got != "/jobs/"+job.ID {
+		t.Errorf("got Location %q, want /jobs/%s", got, job.ID)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+	started, ok := jobs.Get(job.ID)
+	if !ok {
+		t.Fatalf("job %s was not kept", job.ID)
+	}
+	waitJob(t, started)
+}
+
+func TestJobs_Owner(t *testing.T) {
+	release := blockingClassifier(t)
+	folder := testImages(t, 1)
+	jobs, err := LoadJobs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(jobs *Jobs) { DefaultJobs = jobs }(DefaultJobs)
+	DefaultJobs = jobs
+	defer func() {
+		close(release)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		jobs.Stop(ctx)
+	}()
+	job, err := jobs.Start(JobWalk, "ip:192.0.2.1", url.Values{"folder": {folder}, "max": {"1"}, "classify": {"true"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, path, addr string) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = addr + ":1234"
+		r.SetPathValue("id", job.ID)
+		return r
+	}
+	// Other clients neither see the job, nor get, read or cancel it.
+	w := httptest.NewRecorder()
+	ListJobsHandler(w, request("GET", "/jobs", "192.0.2.2"))
+	if strings.Contains(w.Body.String(), job.ID) || strings.Contains(w.Body.String(), "192.0.2.1") {
+		t.Errorf("another client was listed the job: %s", w.Body)
+	}
+	for _, handler := range []http.HandlerFunc{JobHandler, JobResultsHandler, CancelJobHandler} {
+		w := httptest.NewRecorder()
+		handler(w, request("GET", "/jobs/"+job.ID, "192.0.2.2"))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("got %d for the job of another client, want 404", w.Code)
+		}
+	}
+	if got := job.Snapshot(); got.Status != JobRunning {
+		t.Fatalf("got %s, want the job to keep running", got.Status)
+	}
+
+	w = httptest.NewRecorder()
+	ListJobsHandler(w, request("GET", "/jobs", "192.0.2.1"))
+	if !strings.Contains(w.Body.String(), job.ID) {
+		t.Errorf("the client was not listed its own job: %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	CancelJobHandler(w, request("DELETE", "/jobs/"+job.ID, "192.0.2.1"))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d cancelling its own job, want 200: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/label"
+	"classifier/pkg/utils"
+)
+
+// Labels keeps the classes reviewers gave to images. Until it is set, labeling is disabled.
+var Labels *label.Store
+
+// labelLease is how long an image handed out by NextLabelHandler is kept from other reviewers.
+const labelLease = 10 * time.Minute
+
+// defaultValidation is the fraction of labeled images exported for validation when none is given.
+const defaultValidation = 0.2
+
+// reviewerOf returns who is labeling: the name of the client's API key if it has one, then the name it gave,
+// then its address.
+func reviewerOf(r *http.Request, given string) string {
+	id := clientID(r)
+	if name, ok := strings.CutPrefix(id, "key:"); ok {
+		return name
+	}
+	if given != "" {
+		return given
+	}
+	return id
+}
+
+// NextLabelHandler returns the unlabeled image of the pool the classifier is least confident about,
+// and leases it to the reviewer so that others are handed a different one. The pool is every cached prediction
+// matching the same filters as PredictionsHandler, and is empty once they are all labeled or leased.
+// Remote paths are returned without their key, which AddLabelHandler puts back.
+func NextLabelHandler(w http.ResponseWriter, r *http.Request) {
+	if Labels == nil {
+		http.Error(w, "labeling is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	query, err := newQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reviewer := reviewerOf(r, r.URL.Query().Get("reviewer"))
+
+	items, err := classify.DefaultCache.Matching(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type candidate struct {
+		classify.Item
+		confidence float64
+	}
+	candidates := make([]candidate, 0, len(items))
+	for _, item := range items {
+		if _, ok := Labels.Get(item.Path); !ok {
+			_, confidence := item.Prediction.Max()
+			candidates = append(candidates, candidate{item, confidence})
+		}
+	}
+	// Ties are broken by path, so that reviewers are handed images in the same order every time.
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(a.confidence, b.confidence), strings.Compare(a.Path, b.Path))
+	})
+	for _, c := range candidates {
+		if Labels.Lease(c.Path, reviewer, labelLease) {
+			c.Path = withoutKey(c.Path)
+			writeJSON(w, c.Item)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddLabelHandler records the class a reviewer gave to an image, along with what the classifier predicted for it,
+// so that labels and predictions can be compared even after the image is classified again.
+func AddLabelHandler(w http.ResponseWriter, r *http.Request) {
+	if Labels == nil {
+		http.Error(w, "labeling is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	request, err := utils.Decode[struct {
+		Path     string `json:"path"`
+		Class    string `json:"class"`
+		Reviewer string `json:"reviewer"`
+	}](r.Body)
+	if err != nil {
+		http.Error(w, "invalid label: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	l := label.Label{
+		Path:     withKey(request.Path),
+		Class:    request.Class,
+		Reviewer: reviewerOf(r, request.Reviewer),
+		Time:     time.Now(),
+	}
+	if entry, ok := classify.DefaultCache.Get(l.Path); ok {
+		l.Prediction, l.Model = entry.Prediction, entry.Model
+	}
+	if err := l.Validate(); err != nil {
+		http.Error(w, "invalid label: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := Labels.Add(l); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Info("Labeled image", "path", l.Path, "class", l.Class, "reviewer", l.Reviewer)
+	writeJSONStatus(w, http.StatusCreated, l)
+}
+
+// labelComparison is a label along with the current prediction for its path.
+type labelComparison struct {
+	label.Label
+	Current *classify.Entry `json:"current,omitempty"`
+	Agrees  bool            `json:"agrees"`
+}
+
+// LabelsHandler lists the latest label of every path, optionally only those starting with prefix
+// or given by reviewer, alongside the current prediction and whether its most likely class agrees with the label.
+// The key of remote paths, which decrypts them, is left out of the paths listed.
+func LabelsHandler(w http.ResponseWriter, r *http.Request) {
+	if Labels == nil {
+		writeJSON(w, []labelComparison{})
+		return
+	}
+	prefix, reviewer := r.URL.Query().Get("prefix"), r.URL.Query().Get("reviewer")
+	comparisons := []labelComparison{}
+	for _, l := range Labels.Latest() {
+		if !strings.HasPrefix(l.Path, prefix) || reviewer != "" && l.Reviewer != reviewer {
+			continue
+		}
+		comparison := labelComparison{Label: l}
+		comparison.Path = withoutKey(l.Path)
+		if entry, ok := classify.DefaultCache.Get(l.Path); ok {
+			comparison.Current = &entry
+			class, _ := entry.Prediction.Max()
+			comparison.Agrees = class == l.Class
+		}
+		comparisons = append(comparisons, comparison)
+	}
+	writeJSON(w, comparisons)
+}
+
+// ExportLabelsHandler copies every labeled image into folder, which must be inside the allowed roots,
+// as a YOLO classification dataset with folder/{train,val}/<class>/<image>. val is the fraction of images
+// kept for validation. Images that can no longer be read are skipped and reported.
+func ExportLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	if Labels == nil {
+		http.Error(w, "labeling is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	request, err := utils.Decode[struct {
+		Folder string   `json:"folder"`
+		Val    *float64 `json:"val"`
+	}](r.Body)
+	if err != nil {
+		http.Error(w, "invalid export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Folder == "" {
+		http.Error(w, "folder is required", http.StatusBadRequest)
+		return
+	}
+	fraction := defaultValidation
+	if request.Val != nil {
+		fraction = *request.Val
+	}
+	if fraction < 0 || fraction > 1 {
+		http.Error(w, "val must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := AllowedRoots.Resolve(request.Folder); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	create := func(name string) (io.WriteCloser, error) { return AllowedRoots.Create(name) }
+	counts, err := label.Export(Labels.Latest(), Labels.Classes(), request.Folder, fraction, openImage, create, AllowedRoots.Remove)
+	skipped := []string{}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			skipped = append(skipped, err.Error())
+		}
+	}
+	exported := 0
+	for _, n := range counts {
+		exported += n
+	}
+	log.Info(fmt.Sprintf("Exported %d labeled image%s", exported, utils.Plural(exported)), "folder", request.Folder, "skipped", len(skipped))
+	writeJSON(w, map[string]any{"folder": request.Folder, "classes": counts, "skipped": skipped})
+}
+
+// withoutKey removes the key query parameter from the remote path p, so that it can be listed without the key.
+// Other paths are returned as is.
+func withoutKey(p string) string {
+	u, err := url.Parse(p)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return p
+	}
+	query := u.Query()
+	if !query.Has("key") {
+		return p
+	}
+	query.Del("key")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// withKey returns the cached path that p is without its key, so that images handed out by NextLabelHandler
+// are labeled along with the key they are exported with. Other paths are returned as is.
+func withKey(p string) string {
+	if u, err := url.Parse(p); err != nil || u.Scheme == "" || u.Host == "" || u.RawQuery != "" {
+		return p
+	}
+	if _, ok := classify.DefaultCache.Get(p); ok {
+		return p
+	}
+	items, err := classify.DefaultCache.Matching(classify.Query{Prefix: p + "?"})
+	if err != nil {
+		return p
+	}
+	for _, item := range items {
+		if withoutKey(item.Path) == p {
+			return item.Path
+		}
+	}
+	return p
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/label"
+)
+
+// testLabels points Labels at a new store for the duration of the test.
+func testLabels(t *testing.T) {
+	t.Helper()
+	store, err := label.Open(filepath.Join(t.TempDir(), "labels.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := Labels
+	Labels = store
+	t.Cleanup(func() {
+		Labels = previous
+		store.Close()
+	})
+}
+
+func addLabel(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	AddLabelHandler(w, httptest.NewRequest("POST", "/labels", strings.NewReader(body)))
+	return w
+}
+
+func TestNextLabelHandler(t *testing.T) {
+	testPredictions(t)
+	testLabels(t)
+	next := func(reviewer string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		NextLabelHandler(w, httptest.NewRequest("GET", "/labels/next?prefix=predictions/&reviewer="+reviewer, nil))
+		if w.Code == http.StatusNoContent {
+			return ""
+		}
+		var item struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+		return item.Path
+	}
+
+	// The least confident image goes first, and images leased to another reviewer are skipped.
+	for _, step := range []struct{ reviewer, want string }{
+		{"alice", "predictions/b.png"},
+		{"bob", "predictions/d.png"},
+		{"alice", "predictions/b.png"},
+	} {
+		if got := next(step.reviewer); got != step.want {
+			t.Errorf("%s got %q, want %q", step.reviewer, got, step.want)
+		}
+	}
+	if w := addLabel(t, `{"path": "predictions/b.png", "class": "safe", "reviewer": "alice"}`); w.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	// Labeled images are left out, and the pool is empty once every image is labeled or leased.
+	for _, step := range []struct{ reviewer, want string }{
+		{"alice", "predictions/a.png"},
+		{"carol", "predictions/c.png"},
+		{"dave", ""},
+	} {
+		if got := next(step.reviewer); got != step.want {
+			t.Errorf("%s got %q, want %q", step.reviewer, got, step.want)
+		}
+	}
+}
+
+func TestNextLabelHandler_Remote(t *testing.T) {
+	testLabels(t)
+	remote := "https://us.ib.metapix.net/files/full/1/1_artist_a.png?key=secret"
+	cachePredictions(t, map[string]*classify.Entry{
+		remote: {Prediction: classify.Prediction{"cub": 0.5, "safe": 0.5}, Model: "v1"},
+	})
+
+	w := httptest.NewRecorder()
+	NextLabelHandler(w, httptest.NewRequest("GET", "/labels/next?prefix=https://us.ib.metapix.net/&reviewer=alice", nil))
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("the key of a remote path was handed out: %s", w.Body)
+	}
+	var item struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if want := "https://us.ib.metapix.net/files/full/1/1_artist_a.png"; item.Path != want {
+		t.Fatalf("got %s, want %s", item.Path, want)
+	}
+
+	// Labeling the path that was handed out labels the keyed one, along with its prediction.
+	if w := addLabel(t, `{"path": "`+item.Path+`", "class": "safe", "reviewer": "alice"}`); w.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	l, ok := Labels.Get(remote)
+	if !ok || l.Model != "v1" {
+		t.Errorf("got %+v, want the keyed path labeled along with its prediction", l)
+	}
+}
+
+func TestAddLabelHandler(t *testing.T) {
+	testPredictions(t)
+	testLabels(t)
+	w := addLabel(t, `{"path": "predictions/a.png", "class": "cub", "reviewer": "alice"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+	var l label.Label
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Reviewer != "alice" || l.Model != "v1" || !l.Agrees() {
+		t.Errorf("got %+v, want the label along with the prediction of v1", l)
+	}
+
+	for _, body := range []string{`{"path": "predictions/a.png", "class": "not a class"}`, `{"class": "cub"}`, `{`} {
+		if w := addLabel(t, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestLabelsHandler(t *testing.T) {
+	testPredictions(t)
+	testLabels(t)
+	remote := "https://us.ib.metapix.net/files/full/1/1_artist_a.png?key=secret"
+	for _, l := range []label.Label{
+		{Path: "predictions/a.png", Class: "safe", Reviewer: "alice"},
+		{Path: "predictions/c.png", Class: "safe", Reviewer: "bob"},
+		{Path: remote, Class: "cub", Reviewer: "alice"},
+	} {
+		if err := Labels.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	LabelsHandler(w, httptest.NewRequest("GET", "/labels?reviewer=alice", nil))
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("the key of a remote path was listed: %s", w.Body)
+	}
+	var comparisons []labelComparison
+	if err := json.Unmarshal(w.Body.Bytes(), &comparisons); err != nil {
+		t.Fatal(err)
+	}
+	if len(comparisons) != 2 {
+		t.Fatalf("got %+v, want the 2 labels of alice", comparisons)
+	}
+	// Labels are sorted by path, which puts the remote one first.
+	if got, want := comparisons[0].Path, "https://us.ib.metapix.net/files/full/1/1_artist_a.png"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if a := comparisons[1]; a.Path != "predictions/a.png" || a.Current == nil || a.Agrees {
+		t.Errorf("got %+v, want a.png along with a prediction that disagrees", a)
+	}
+	if _, ok := Labels.Get(remote); !ok {
+		t.Error("the stored label lost the key it needs to be exported")
+	}
+}
+
+func TestExportLabelsHandler(t *testing.T) {
+	folder := testImages(t, 1)
+	testLabels(t)
+	image := filepath.Join(folder, "0.png")
+	export := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		body := `{"folder": "` + filepath.Join(folder, "dataset") + `", "val": 0}`
+		ExportLabelsHandler(w, httptest.NewRequest("POST", "/labels/export", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	for _, class := range []string{"cat", "dog"} {
+		if err := Labels.Add(label.Label{Path: image, Class: class, Reviewer: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		export()
+	}
+	name := label.FileName(image)
+	if _, err := os.Stat(filepath.Join(folder, "dataset", "train", "dog", name)); err != nil {
+		t.Errorf("the relabeled image was not exported: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "dataset", "train", "cat", name)); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the copy of the previous export to be removed", err)
+	}
+
+	w := httptest.NewRecorder()
+	ExportLabelsHandler(w, httptest.NewRequest("POST", "/labels/export", strings.NewReader(`{"folder": "/elsewhere"}`)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d for a folder outside the roots, want 403", w.Code)
+	}
+}
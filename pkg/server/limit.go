@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/config"
+)
+
+const (
+	// APIKeyHeader is the header clients send their API key in.
+	APIKeyHeader = "X-API-Key"
+	// busyRetry is when clients over their concurrency limit are asked to try again.
+	busyRetry = 5 * time.Second
+	// jobsRetry is when clients over their job limit are asked to try again.
+	jobsRetry = 30 * time.Second
+	// clientIdle is how long a client's limits are remembered once it has nothing open.
+	clientIdle = 10 * time.Minute
+)
+
+// clientLimit is the token bucket and open requests of one client.
+type clientLimit struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// limits holds the state of every client that was recently seen.
+var limits = struct {
+	sync.Mutex
+	clients map[string]*clientLimit
+	swept   time.Time
+}{clients: make(map[string]*clientLimit)}
+
+// clientID identifies the client making r: the name of its API key if it sent a known one, or else its IP address.
+func clientID(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		for known, name := range settings.Load().Limits.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(known)) == 1 {
+				return "key:" + name
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Limit rejects requests with 429 Too Many Requests once their client started more of them than the token bucket
+// allows, or already has as many open as it may. Use it for handlers that walk, watch or classify.
+func Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := admit(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
+
+// admit takes a token and a slot for the request r like Limit does, for handlers that are only limited
+// when they do something expensive. Once it responded with 429, it returns false.
+func admit(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	id := clientID(r)
+	cfg := settings.Load().Limits
+	retry, reason := take(id, cfg, time.Now())
+	if retry > 0 {
+		rateLimited.Inc(r.Pattern, reason)
+		log.Warn("Client is over its limit", "client", id, "limit", reason, "retry", retry)
+		message := "rate limit exceeded"
+		if reason == "concurrent" {
+			message = fmt.Sprintf("at most %d requests can be open at once", cfg.Concurrent)
+		}
+		tooManyRequests(w, retry, message)
+		return nil, false
+	}
+	return func() { done(id) }, true
+}
+
+// take takes a token and a slot for a request from client id, or returns how long it should wait
+// and which limit it hit, either "rate" or "concurrent".
+func take(id string, cfg config.Limits, now time.Time) (time.Duration, string) {
+	limits.Lock()
+	defer limits.Unlock()
+	sweep(now)
+	c, ok := limits.clients[id]
+	if !ok {
+		c = &clientLimit{tokens: float64(cfg.Burst), last: now}
+		limits.clients[id] = c
+	}
+	c.tokens = min(float64(cfg.Burst), c.tokens+now.Sub(c.last).Seconds()*cfg.RequestsPerSecond)
+	c.last = now
+	if c.tokens < 1 {
+		return time.Duration((1 - c.tokens) / cfg.RequestsPerSecond * float64(time.Second)), "rate"
+	}
+	if c.active >= cfg.Concurrent {
+		return busyRetry, "concurrent"
+	}
+	c.tokens--
+	c.active++
+	return 0, ""
+}
+
+// done frees the slot taken by a request from client id.
+func done(id string) {
+	limits.Lock()
+	defer limits.Unlock()
+	if c, ok := limits.clients[id]; ok {
+		c.active--
+	}
+}
+
+// sweep forgets clients with nothing open that have not been seen for clientIdle, since their bucket is full again.
+// The caller must hold the limits lock.
+func sweep(now time.Time) {
+	if now.Sub(limits.swept) < clientIdle {
+		return
+	}
+	limits.swept = now
+	for id, c := range limits.clients {
+		if c.active == 0 && now.Sub(c.last) > clientIdle {
+			delete(limits.clients, id)
+		}
+	}
+}
+
+// tooManyRequests responds with 429 and a Retry-After header in whole seconds.
+func tooManyRequests(w http.ResponseWriter, retry time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"classifier/pkg/config"
+)
+
+// forgetClients clears the limits of clients once the test is done, so that it can run again.
+func forgetClients(t *testing.T, ids ...string) {
+	t.Cleanup(func() {
+		limits.Lock()
+		defer limits.Unlock()
+		for _, id := range ids {
+			delete(limits.clients, id)
+		}
+	})
+}
+
+func TestTake(t *testing.T) {
+	cfg := config.Limits{RequestsPerSecond: 2, Burst: 2, Concurrent: 3}
+	now := time.Now()
+	id := "ip:test-take"
+	forgetClients(t, id)
+	for range 2 {
+		if retry, reason := take(id, cfg, now); retry != 0 {
+			t.Fatalf("got limited by %s within the burst", reason)
+		}
+	}
+	retry, reason := take(id, cfg, now)
+	if reason != "rate" || retry != 500*time.Millisecond {
+		t.Errorf("got %s, %v, want to be rate limited for 500ms", reason, retry)
+	}
+	if retry, _ := take(id, cfg, now.Add(500*time.Millisecond)); retry != 0 {
+		t.Error("token was not refilled")
+	}
+	if retry, reason := take(id, cfg, now.Add(time.Hour)); reason != "concurrent" || retry != busyRetry {
+		t.Errorf("got %s, %v, want to be limited by open requests", reason, retry)
+	}
+	done(id)
+	if retry, _ := take(id, cfg, now.Add(time.Hour)); retry != 0 {
+		t.Error("slot was not freed")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	defer func(cfg *config.Config) { settings.Store(cfg) }(settings.Load())
+	cfg := *config.Default()
+	cfg.Limits = config.Limits{RequestsPerSecond: 0.1, Burst: 1, Concurrent: 1, Jobs: 1, APIKeys: map[string]string{"secret": "bot"}}
+	settings.Store(&cfg)
+	forgetClients(t, "ip:192.0.2.1", "ip:192.0.2.2", "key:bot")
+
+	handler := Limit(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(addr, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/walk", nil)
+		r.RemoteAddr = addr
+		if key != "" {
+			r.Header.Set(APIKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := request("192.0.2.1:1234", ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d for the first request", w.Code)
+	}
+	w := request("192.0.2.1:5678", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("got %d with Retry-After %q, want 429 with 10", w.Code, w.Header().Get("Retry-After"))
+	}
+	// An unknown key does not get its own limits, while a known one does.
+	if w := request("192.0.2.1:1234", "guess"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d with an unknown key, want 429", w.Code)
+	}
+	if w := request("192.0.2.1:1234", "secret"); w.Code != http.StatusOK {
+		t.Errorf("got %d with a known key, want 200", w.Code)
+	}
+	if w := request("192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("got %d from another address, want 200", w.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"classifier/pkg/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounter("http_requests_total", "HTTP requests served, by route and status code.", "endpoint", "code")
+	httpErrors   = metrics.NewCounter("http_request_errors_total", "HTTP requests that ended with a server error.", "endpoint")
+	httpDuration = metrics.NewHistogram("http_request_duration_seconds", "Time taken to serve HTTP requests, including the whole of event streams.", nil, "endpoint")
+
+	sseClients = metrics.NewGauge("sse_clients", "Clients currently reading an event stream.")
+
+	rateLimited = metrics.NewCounter("http_rate_limited_total", "Requests rejected because their client was over a limit, by route and reason.", "endpoint", "reason")
+)
+
+// Instrument records the count, latency and errors of every request served by mux, by the pattern of the route it matched.
+func Instrument(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(sw, r)
+
+		endpoint := r.Pattern // set by http.ServeMux once it matched a route
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+		httpRequests.Inc(endpoint, strconv.Itoa(sw.status))
+		httpDuration.Since(start, endpoint)
+		if sw.status >= http.StatusInternalServerError {
+			httpErrors.Inc(endpoint)
+		}
+	})
+}
+
+// statusWriter remembers the status code written to a http.ResponseWriter, and can still be flushed.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// openAPI is the part of the OpenAPI document the tests compare with the handlers.
+type openAPI struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Parameters []openAPIParameter `json:"parameters"`
+}
+
+type openAPIParameter struct {
+	Ref  string `json:"$ref"`
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+func loadOpenAPI(t *testing.T) openAPI {
+	t.Helper()
+	var doc openAPI
+	if err := json.Unmarshal(OpenAPI, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// parameters returns the parameters of the operation, with references resolved.
+func (doc openAPI) parameters(op openAPIOperation) []openAPIParameter {
+	params := make([]openAPIParameter, len(op.Parameters))
+	for i, param := range op.Parameters {
+		if name, ok := strings.CutPrefix(param.Ref, "#/components/parameters/"); ok {
+			param = doc.Components.Parameters[name]
+		}
+		params[i] = param
+	}
+	return params
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+	documented := make(map[string]bool)
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	routes := Routes()
+	for _, pattern := range slices.Sorted(maps.Keys(routes)) {
+		if !documented[pattern] {
+			t.Errorf("route %s is not documented", pattern)
+		}
+	}
+	for _, pattern := range slices.Sorted(maps.Keys(documented)) {
+		if _, ok := routes[pattern]; !ok {
+			t.Errorf("documented route %s is not served", pattern)
+		}
+	}
+}
+
+func TestOpenAPIParameters(t *testing.T) {
+	doc := loadOpenAPI(t)
+	documented := make(map[string]bool)
+	for _, ops := range doc.Paths {
+		for _, op := range ops {
+			for _, param := range doc.parameters(op) {
+				if param.Name == "" {
+					t.Errorf("unresolved parameter %s", param.Ref)
+				}
+				documented[param.In+" "+param.Name] = true
+			}
+		}
+	}
+
+	read := readParameters(t)
+	for _, param := range slices.Sorted(maps.Keys(read)) {
+		if !documented[param] {
+			t.Errorf("%s parameter is read at %s but not documented", param, read[param])
+		}
+	}
+	for _, param := range slices.Sorted(maps.Keys(documented)) {
+		if _, ok := read[param]; !ok {
+			t.Errorf("%s parameter is documented but never read", param)
+		}
+	}
+}
+
+// readParameters finds the parameters the handlers read, by where they are read: query parameters through
+// query.Get, values.Get or r.URL.Query().Get and by indexing query, headers through r.Header.Get,
+// and path values through r.PathValue.
+func readParameters(t *testing.T) map[string]string {
+	t.Helper()
+	names, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	read := make(map[string]string)
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			var in string
+			var arg ast.Expr
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok || len(n.Args) != 1 {
+					return true
+				}
+				switch receiver := exprString(sel.X); {
+				case sel.Sel.Name == "Get" && (receiver == "query" || receiver == "values" || receiver == "r.URL.Query()"):
+					in = "query"
+				case sel.Sel.Name == "Get" && receiver == "r.Header":
+					in = "header"
+				case sel.Sel.Name == "PathValue" && receiver == "r":
+					in = "path"
+				default:
+					return true
+				}
+				arg = n.Args[0]
+			case *ast.IndexExpr:
+				if exprString(n.X) != "query" {
+					return true
+				}
+				in, arg = "query", n.Index
+			default:
+				return true
+			}
+			if lit, ok := arg.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				value, _ := strconv.Unquote(lit.Value)
+				read[in+" "+value] = fset.Position(lit.Pos()).String()
+			}
+			return true
+		})
+	}
+	if len(read) == 0 {
+		t.Fatal("no parameters found")
+	}
+	return read
+}
+
+func exprString(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name
+	case *ast.SelectorExpr:
+		return exprString(expr.X) + "." + expr.Sel.Name
+	case *ast.CallExpr:
+		return exprString(expr.Fun) + "()"
+	}
+	return ""
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/lucasb-eyer/go-colorful"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/lib"
+	"classifier/pkg/utils"
+)
+
+// maxUploadSize limits the size of a single /predict request.
+const maxUploadSize = 64 << 20
+
+// uploadPrefix is the name uploads are cached under, followed by their hash.
+const uploadPrefix = "upload/"
+
+// uploadTTL is how long uploads stay cached, as nothing else refers to them once the request is done.
+const uploadTTL = 24 * time.Hour
+
+func init() {
+	classify.DefaultCache.ExpireAfter(uploadPrefix, uploadTTL)
+}
+
+// uploadFile serves an uploaded image from memory as an io.ReadSeekCloser.
+type uploadFile struct{ *bytes.Reader }
+
+func (uploadFile) Close() error { return nil }
+
+// PredictHandler classifies the images uploaded as multipart "file" fields, and returns one Result per file
+// in the order they were uploaded. It takes the same encrypt_key, classify, distance, color, threshold and
+// metric query parameters as WalkHandler, except that classify defaults to true.
+// Uploads are cached in classify.DefaultCache by their content for uploadTTL, so the same image is only
+// classified once meanwhile.
+func PredictHandler(w http.ResponseWriter, r *http.Request) {
+	shouldClassify := r.URL.Query().Get("classify") != "false"
+	encryptKey := r.URL.Query().Get("encrypt_key")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request is larger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		http.Error(w, "at least one file is required", http.StatusBadRequest)
+		return
+	}
+
+	// Uploads are keyed by their hash, which is also the name they are cached and classified under.
+	uploads := make(map[string][]byte, len(headers))
+	names := make([]string, len(headers))
+	for i, header := range headers {
+		if !utils.IsImage(header.Filename) {
+			http.Error(w, fmt.Sprintf("file %s is not an image", header.Filename), http.StatusBadRequest)
+			return
+		}
+		data, err := readUpload(header)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading %s: %v", header.Filename, err), http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(data)
+		names[i] = uploadPrefix + hex.EncodeToString(sum[:]) + strings.ToLower(filepath.Ext(header.Filename))
+		uploads[names[i]] = data
+	}
+	open := func(name string) (io.ReadSeekCloser, error) {
+		data, ok := uploads[name]
+		if !ok {
+			return nil, fmt.Errorf("upload %s not found", name)
+		}
+		return uploadFile{bytes.NewReader(data)}, nil
+	}
+
+	distanceConfig, err := newDistanceConfig(r.URL.Query(), nil) // uploads are unencrypted, so distance reads them as is
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var plain *lib.Crypto
+	distanceConfig.method = plain.OpenWith(open, plain.Decoder)
+	if distanceConfig.metric == nil {
+		distanceConfig.metric = colorful.Color.DistanceLab
+	}
+
+	crypto, err := lib.NewCrypto(encryptKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	classifyConfig := classifyConfig[*lib.CryptoFile]{
+		enabled: shouldClassify,
+		crypto:  crypto,
+		method:  crypto.OpenWith(open, crypto.Encrypt), // encrypt before handing the upload to classify.Predict
+	}
+
+	if !distanceConfig.enabled && !classifyConfig.enabled {
+		http.Error(w, "either classify or distance must be enabled", http.StatusBadRequest)
+		return
+	}
+
+	distanceWorker := distanceConfig.worker(r.Context())
+	classifyWorker := classifyConfig.worker(r.Context())
+	distanceWorker.Work()
+	classifyWorker.Work()
+
+	distancePromises := make([]<-chan *float64, len(names))
+	classifyPromises := make([]<-chan *classify.Prediction, len(names))
+	for i, name := range names {
+		distancePromises[i] = distanceWorker.Promise(name)
+		classifyPromises[i] = classifyWorker.Promise(name)
+	}
+
+	// Every promise is received before closing the workers, even when the request is cancelled,
+	// as the workers return early once the context is done.
+	results := make([]*Result, len(headers))
+	for i, header := range headers {
+		results[i] = &Result{
+			Path:       header.Filename,
+			Color:      <-distancePromises[i],
+			Prediction: <-classifyPromises[i],
+		}
+	}
+	distanceWorker.Close()
+	classifyWorker.Close()
+
+	if err := r.Context().Err(); err != nil {
+		log.Warn("Request cancelled while predicting uploads", "err", err)
+		return
+	}
+
+	log.Info("Finished predicting uploads", "files", len(results), "distance", distanceConfig.enabled, "classify", shouldClassify)
+	writeJSON(w, results)
+}
+
+// readUpload reads an uploaded file into memory.
+func readUpload(header *multipart.FileHeader) ([]byte, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
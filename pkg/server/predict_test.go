@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"classifier/pkg/classify"
+)
+
+// fakeClassifier points classify.DefaultCache at a classifier that predicts "safe" for every image,
+// and returns how many images it was sent.
+func fakeClassifier(t *testing.T) *atomic.Int64 {
+	t.Helper()
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"safe": 0.9, "cub": 0.1}`))
+	}))
+	t.Cleanup(srv.Close)
+	classify.SetPredictURL(srv.URL)
+	t.Cleanup(func() { classify.SetPredictURL("http://localhost:7860/predict") })
+	return &calls
+}
+
+// uploadRequest is a /predict request uploading files, named by their content.
+func uploadRequest(t *testing.T, query string, files map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := w.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	w.Close()
+	r := httptest.NewRequest("POST", "/predict?"+query, &body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+func TestPredictHandler(t *testing.T) {
+	calls := fakeClassifier(t)
+	content := "an upload only this test makes " + t.Name()
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		PredictHandler(w, uploadRequest(t, "", map[string]string{"a.png": content}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+		var results []Result
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Path != "a.png" || results[0].Prediction == nil || (*results[0].Prediction)["safe"] != 0.9 {
+			t.Fatalf("got %+v, want a.png classified as safe", results)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("the classifier was called %d times, want the second upload to be cached", n)
+	}
+
+	for query, files := range map[string]map[string]string{
+		"":                               {},
+		"classify=true":                  {"notes.txt": "text"},
+		"classify=false":                 {"a.png": content},
+		"classify=false&color=not-a-hex": {"a.png": content},
+	} {
+		w := httptest.NewRecorder()
+		PredictHandler(w, uploadRequest(t, query, files))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q with %v: got %d, want 400", query, files, w.Code)
+		}
+	}
+}
+
+func TestPredictHandler_Expire(t *testing.T) {
+	fakeClassifier(t)
+	w := httptest.NewRecorder()
+	PredictHandler(w, uploadRequest(t, "", map[string]string{"a.png": "an upload that expires"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	name := filepath.Join(t.TempDir(), "classifications.json")
+	classify.DefaultCache.ExpireAfter(uploadPrefix, 0)
+	defer classify.DefaultCache.ExpireAfter(uploadPrefix, uploadTTL)
+	if err := classify.DefaultCache.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), uploadPrefix) {
+		t.Errorf("expired uploads were saved: %s", data)
+	}
+}
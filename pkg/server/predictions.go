@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/utils"
+)
+
+// PredictionsHandler lists the cached predictions that match the class, min_confidence, max_confidence,
+// any_rank, prefix and model query parameters, sorted by path. Pages hold up to limit items,
+// and the next page is requested by passing the returned "next" value as cursor.
+func PredictionsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := newQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := classify.DefaultCache.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, page)
+}
+
+// PredictionHandler returns the cached prediction for the path query parameter.
+func PredictionHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "path parameter is required", http.StatusBadRequest)
+		return
+	}
+	entry, ok := classify.DefaultCache.Get(path)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no prediction cached for %s", path), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, classify.Item{Path: path, Entry: entry})
+}
+
+// DeletePredictionHandler removes the cached prediction for the path query parameter.
+func DeletePredictionHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "path parameter is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := classify.DefaultCache.Get(path); !ok {
+		http.Error(w, fmt.Sprintf("no prediction cached for %s", path), http.StatusNotFound)
+		return
+	}
+	classify.DefaultCache.Delete(path)
+	log.Info("Deleted prediction", "path", path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeletePredictionsHandler removes every cached prediction matching the same filters as PredictionsHandler.
+// To avoid clearing the whole cache by accident, at least one filter or all=true is required.
+// Every match is removed at once, so cursor and limit are rejected rather than ignored.
+func DeletePredictionsHandler(w http.ResponseWriter, r *http.Request) {
+	modifyPredictions(w, r, "deleted", classify.DefaultCache.DeleteMatching)
+}
+
+// InvalidatePredictionsHandler marks every cached prediction matching the same filters as PredictionsHandler
+// as stale. Stale predictions are kept until the file is classified again.
+func InvalidatePredictionsHandler(w http.ResponseWriter, r *http.Request) {
+	modifyPredictions(w, r, "invalidated", classify.DefaultCache.Invalidate)
+}
+
+func modifyPredictions(w http.ResponseWriter, r *http.Request, verb string, modify func(classify.Query) (int, error)) {
+	query, err := newQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Cursor != "" || query.Limit != 0 {
+		http.Error(w, "cursor and limit only page through listings, every matching prediction is "+verb, http.StatusBadRequest)
+		return
+	}
+	if !query.Filtered() && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "at least one filter or all=true is required", http.StatusBadRequest)
+		return
+	}
+	n, err := modify(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("%s %d prediction%s", verb, n, utils.Plural(n))
+	writeJSON(w, map[string]int{verb: n})
+}
+
+// newQuery reads a classify.Query from the query parameters.
+func newQuery(values url.Values) (classify.Query, error) {
+	query := classify.Query{
+		Class:   values.Get("class"),
+		AnyRank: values.Get("any_rank") == "true",
+		Prefix:  values.Get("prefix"),
+		Model:   values.Get("model"),
+		Cursor:  values.Get("cursor"),
+	}
+	var err error
+	if s := values.Get("min_confidence"); s != "" {
+		if query.MinConfidence, err = strconv.ParseFloat(s, 64); err != nil {
+			return query, fmt.Errorf("invalid min_confidence: %w", err)
+		}
+	}
+	if s := values.Get("max_confidence"); s != "" {
+		if query.MaxConfidence, err = strconv.ParseFloat(s, 64); err != nil {
+			return query, fmt.Errorf("invalid max_confidence: %w", err)
+		}
+	}
+	if s := values.Get("limit"); s != "" {
+		if query.Limit, err = strconv.Atoi(s); err != nil {
+			return query, fmt.Errorf("invalid limit: %w", err)
+		}
+	}
+	return query, query.Validate()
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := utils.Encode(w, v); err != nil {
+		log.Error("error writing data:", "err", err)
+	}
+}
+
+// writeJSONStatus is writeJSON with another status than 200. The headers are set before the status is written,
+// as they are ignored after.
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, v)
+}
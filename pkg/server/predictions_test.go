@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"classifier/pkg/classify"
+)
+
+// cachePredictions adds entries to classify.DefaultCache, removing them once the test is done.
+func cachePredictions(t *testing.T, entries map[string]*classify.Entry) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "classifications.json")
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := classify.DefaultCache.Merge(name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for path := range entries {
+			classify.DefaultCache.Delete(path)
+		}
+	})
+}
+
+func testPredictions(t *testing.T) {
+	cachePredictions(t, map[string]*classify.Entry{
+		"predictions/a.png": {Prediction: classify.Prediction{"cub": 0.9, "safe": 0.1}, Model: "v1"},
+		"predictions/b.png": {Prediction: classify.Prediction{"safe": 0.6, "cub": 0.4}, Model: "v1"},
+		"predictions/c.png": {Prediction: classify.Prediction{"safe": 0.95, "cub": 0.05}, Model: "v2"},
+		"predictions/d.png": {Prediction: classify.Prediction{"cub": 0.7, "safe": 0.3}, Model: "v2"},
+	})
+}
+
+func TestNewQuery(t *testing.T) {
+	values, _ := url.ParseQuery("class=cub&any_rank=true&min_confidence=0.2&max_confidence=0.8&prefix=a/&model=v1&cursor=YQ&limit=5")
+	query, err := newQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := classify.Query{Class: "cub", AnyRank: true, MinConfidence: 0.2, MaxConfidence: 0.8, Prefix: "a/", Model: "v1", Cursor: "YQ", Limit: 5}
+	if query != want {
+		t.Errorf("got %+v, want %+v", query, want)
+	}
+	if !query.Filtered() {
+		t.Error("a query with filters should be filtered")
+	}
+	if paging := (classify.Query{Cursor: "YQ", Limit: 5, AnyRank: true}); paging.Filtered() {
+		t.Error("cursor, limit and any_rank alone should not be filters")
+	}
+
+	for _, raw := range []string{
+		"min_confidence=high",
+		"min_confidence=2",
+		"max_confidence=-1",
+		"min_confidence=0.8&max_confidence=0.2",
+		"limit=ten",
+		"limit=100000",
+	} {
+		values, _ := url.ParseQuery(raw)
+		if _, err := newQuery(values); err == nil {
+			t.Errorf("%s: expected an error", raw)
+		}
+	}
+}
+
+func TestQuery_Match(t *testing.T) {
+	entry := &classify.Entry{Prediction: classify.Prediction{"safe": 0.6, "cub": 0.4}, Model: "v1"}
+	tests := []struct {
+		query classify.Query
+		match bool
+	}{
+		{classify.Query{}, true},
+		{classify.Query{Prefix: "a/"}, true},
+		{classify.Query{Prefix: "b/"}, false},
+		{classify.Query{Model: "v2"}, false},
+		{classify.Query{Class: "cub"}, false},
+		{classify.Query{Class: "cub", AnyRank: true}, true},
+		{classify.Query{Class: "cub", AnyRank: true, MinConfidence: 0.5}, false},
+		{classify.Query{Class: "young", AnyRank: true}, false},
+		{classify.Query{MinConfidence: 0.5, MaxConfidence: 0.7}, true},
+		{classify.Query{MaxConfidence: 0.5}, false},
+		// Paging never changes what matches.
+		{classify.Query{Cursor: "Yg", Limit: 1}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.query.Match("a/b.png", entry); got != tt.match {
+			t.Errorf("%+v: got %v, want %v", tt.query, got, tt.match)
+		}
+	}
+}
+
+func TestPredictionsHandler_Paging(t *testing.T) {
+	testPredictions(t)
+	var paths []string
+	cursor := ""
+	for range 3 {
+		w := httptest.NewRecorder()
+		PredictionsHandler(w, httptest.NewRequest("GET", "/predictions?prefix=predictions/&limit=3&cursor="+cursor, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+		var page classify.Page
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range page.Items {
+			if item.Prediction == nil {
+				t.Errorf("%s was listed without its prediction", item.Path)
+			}
+			paths = append(paths, item.Path)
+		}
+		if cursor = page.Next; cursor == "" {
+			break
+		}
+	}
+	want := []string{"predictions/a.png", "predictions/b.png", "predictions/c.png", "predictions/d.png"}
+	if len(paths) != len(want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("got %v, want %v", paths, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	PredictionsHandler(w, httptest.NewRequest("GET", "/predictions?cursor=!!!", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid cursor, want 400", w.Code)
+	}
+}
+
+func TestModifyPredictions(t *testing.T) {
+	testPredictions(t)
+	for _, target := range []string{
+		"/predictions",
+		"/predictions?limit=1",
+		"/predictions?cursor=YQ",
+		"/predictions?any_rank=true",
+		"/predictions?prefix=predictions/&limit=1",
+	} {
+		w := httptest.NewRecorder()
+		DeletePredictionsHandler(w, httptest.NewRequest("DELETE", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("DELETE %s: got %d, want 400", target, w.Code)
+		}
+		w = httptest.NewRecorder()
+		InvalidatePredictionsHandler(w, httptest.NewRequest("POST", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: got %d, want 400", target, w.Code)
+		}
+	}
+	if _, ok := classify.DefaultCache.Get("predictions/a.png"); !ok {
+		t.Fatal("a rejected request changed the cache")
+	}
+
+	w := httptest.NewRecorder()
+	InvalidatePredictionsHandler(w, httptest.NewRequest("POST", "/predictions/invalidate?prefix=predictions/&model=v2", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"invalidated\":2}\n" {
+		t.Fatalf("got %d %s, want 2 invalidated", w.Code, w.Body)
+	}
+	if entry, _ := classify.DefaultCache.Get("predictions/c.png"); !entry.Stale {
+		t.Error("predictions/c.png was not invalidated")
+	}
+
+	w = httptest.NewRecorder()
+	DeletePredictionsHandler(w, httptest.NewRequest("DELETE", "/predictions?prefix=predictions/&class=cub", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"deleted\":2}\n" {
+		t.Fatalf("got %d %s, want 2 deleted", w.Code, w.Body)
+	}
+	for path, kept := range map[string]bool{"predictions/a.png": false, "predictions/b.png": true, "predictions/c.png": true, "predictions/d.png": false} {
+		if _, ok := classify.DefaultCache.Get(path); ok != kept {
+			t.Errorf("%s: got cached %v, want %v", path, ok, kept)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/ellypaws/inkbunny/api"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/lib"
+	"classifier/pkg/profile"
+)
+
+// Profiles keeps the artist galleries that were scanned. Until it is set, profiles are disabled.
+var Profiles *profile.Cache
+
+// ProfileHandler returns the profile of an artist: how many of their submissions were flagged for the class
+// query parameters, at or above min_confidence, and when. The gallery is scanned with the sid the first time,
+// or only its most recent submissions with recent, and cached until it is scanned again with refresh.
+// Without a sid, only a cached gallery is used. A scan is not cancelled when the client disconnects, as asking
+// again would otherwise start it over; it finishes and is cached for the next request instead.
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if Profiles == nil {
+		http.Error(w, "profiles are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	artist := r.PathValue("artist")
+	if !artistRegexp.MatchString(artist) {
+		http.Error(w, fmt.Sprintf("invalid artist %q", artist), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	sid := query.Get("sid")
+	classes := profile.DefaultClasses
+	if c := query["class"]; len(c) > 0 {
+		classes = c
+	}
+	threshold := profile.DefaultThreshold
+	if s := query.Get("min_confidence"); s != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(s, 64); err != nil {
+			http.Error(w, "invalid min_confidence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	recent := 0
+	if s := query.Get("recent"); s != "" {
+		var err error
+		if recent, err = strconv.Atoi(s); err != nil || recent < 1 {
+			http.Error(w, "recent must be a positive number of submissions", http.StatusBadRequest)
+			return
+		}
+	}
+	refresh := query.Get("refresh") == "true"
+
+	if sid == "" {
+		gallery, err := Profiles.Get(artist)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			http.Error(w, artist+" was never scanned, the sid parameter is required to scan it", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case refresh || !gallery.Covers(recent):
+			http.Error(w, "the sid parameter is required to scan "+artist+" again", http.StatusBadRequest)
+		default:
+			writeJSON(w, gallery.Trim(recent).Summarize(classes, threshold))
+		}
+		return
+	}
+
+	crypto, err := lib.NewCrypto(query.Get("encrypt_key"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	classifyConfig := classifyConfig[*os.File]{
+		enabled: true,
+		crypto:  crypto,
+		method:  os.Open, // files are already encrypted by utils.DownloadEncrypt
+	}
+	ctx := context.WithoutCancel(r.Context())
+	var distanceConfig distanceConfig[*lib.CryptoFile]
+	distanceWorker := distanceConfig.worker(ctx)
+	classifyWorker := classifyConfig.worker(ctx)
+	distanceWorker.Work()
+	classifyWorker.Work()
+	defer distanceWorker.Close()
+	defer classifyWorker.Close()
+
+	scanner := profile.Scanner{
+		SID: sid,
+		Predict: func(ctx context.Context, submission api.Submission) ([]classify.Prediction, []int, int) {
+			results, pages, failed := collectSubmission(ctx, submission, crypto, query.Get("encrypt_key"), &distanceWorker, &classifyWorker)
+			predictions := make([]classify.Prediction, 0, len(results))
+			classified := make([]int, 0, len(results))
+			for i, result := range results {
+				if result.Prediction != nil {
+					predictions = append(predictions, *result.Prediction)
+					classified = append(classified, pages[i])
+				}
+			}
+			return predictions, classified, failed
+		},
+		Workers: settings.Load().Concurrency.Download,
+	}
+	gallery, err := Profiles.Gallery(ctx, scanner, artist, recent, refresh)
+	if err != nil {
+		log.Error("Error scanning artist", "artist", artist, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	p := gallery.Summarize(classes, threshold)
+	log.Info("Profiled artist", "artist", p.Artist, "submissions", p.Submissions, "flagged", len(p.Flagged), "classes", strings.Join(classes, ","))
+	writeJSON(w, p)
+}
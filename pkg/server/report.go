@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"iter"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/thumb"
+)
+
+// ReportFormat is a format results can be downloaded in instead of being streamed.
+type ReportFormat string
+
+const (
+	// ReportCSV has one row per result, with a column for every predicted class.
+	ReportCSV ReportFormat = "csv"
+	// ReportJSONL has one result per line, as they are sent over SSE.
+	ReportJSONL ReportFormat = "jsonl"
+	// ReportHTML is a self-contained page with thumbnails and sortable columns.
+	ReportHTML ReportFormat = "html"
+)
+
+// reportThumbnailSize is the largest side of thumbnails embedded in HTML reports.
+const reportThumbnailSize = 160
+
+// parseReportFormat reads the format query parameter, which is empty when results should be streamed.
+func parseReportFormat(query url.Values) (ReportFormat, error) {
+	switch format := ReportFormat(strings.ToLower(query.Get("format"))); format {
+	case "", ReportCSV, ReportJSONL, ReportHTML:
+		return format, nil
+	case "ndjson":
+		return ReportJSONL, nil
+	default:
+		return "", badRequest(fmt.Errorf("unknown format %q, expected csv, jsonl or html", format))
+	}
+}
+
+// writeReport writes every result as a file attachment called name. Results are always read to the end,
+// even once writing to the client failed.
+func writeReport(w http.ResponseWriter, format ReportFormat, name string, results iter.Seq[*Result]) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+string(format)))
+	results = skipNil(results)
+	var err error
+	switch format {
+	case ReportCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = writeCSV(w, slices.Collect(results))
+	case ReportJSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		err = writeJSONL(w, results)
+	case ReportHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = writeHTML(w, name, slices.Collect(results))
+	}
+	if err != nil {
+		log.Error("Error writing report", "name", name, "format", format, "err", err)
+	}
+}
+
+func skipNil(results iter.Seq[*Result]) iter.Seq[*Result] {
+	return func(yield func(*Result) bool) {
+		for result := range results {
+			if result != nil && !yield(result) {
+				return
+			}
+		}
+	}
+}
+
+func writeJSONL(w http.ResponseWriter, results iter.Seq[*Result]) error {
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	var err error
+	for result := range results {
+		if err != nil {
+			continue
+		}
+		err = enc.Encode(result)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return err
+}
+
+// reportClasses returns every class predicted for any of the results, sorted by name.
+func reportClasses(results []*Result) []string {
+	classes := make(map[string]struct{})
+	for _, result := range results {
+		if result.Prediction != nil {
+			for class := range *result.Prediction {
+				classes[class] = struct{}{}
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(classes))
+}
+
+func writeCSV(w http.ResponseWriter, results []*Result) error {
+	classes := reportClasses(results)
+	out := csv.NewWriter(w)
+	out.Write(append([]string{"path", "url", "color", "deleted", "class", "confidence"}, classes...))
+	for _, result := range results {
+		row := []string{result.Path, result.URL, "", strconv.FormatBool(result.Deleted), "", ""}
+		if result.Color != nil {
+			row[2] = formatScore(*result.Color)
+		}
+		var prediction map[string]float64
+		if result.Prediction != nil && len(*result.Prediction) > 0 {
+			prediction = *result.Prediction
+			class, confidence := result.Prediction.Max()
+			row[4], row[5] = class, formatScore(confidence)
+		}
+		for _, class := range classes {
+			if confidence, ok := prediction[class]; ok {
+				row = append(row, formatScore(confidence))
+			} else {
+				row = append(row, "")
+			}
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func formatScore(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+//go:embed report.html
+var reportPage string
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"score": func(f float64) string { return strconv.FormatFloat(f, 'f', 4, 64) },
+}).Parse(reportPage))
+
+// reportRow is a result as shown in an HTML report. Scores holds the confidence of each of the report's
+// classes, nil where the class was not predicted.
+type reportRow struct {
+	*Result
+	Name       string
+	Thumbnail  template.URL
+	Class      string
+	Confidence *float64
+	Scores     []*float64
+}
+
+func writeHTML(w http.ResponseWriter, name string, results []*Result) error {
+	classes := reportClasses(results)
+	rows := make([]reportRow, len(results))
+	for i, result := range results {
+		row := reportRow{Result: result, Name: path.Base(strings.ReplaceAll(result.Path, `\`, "/")), Scores: make([]*float64, len(classes))}
+		if result.Prediction != nil && len(*result.Prediction) > 0 {
+			class, confidence := result.Prediction.Max()
+			row.Class, row.Confidence = class, &confidence
+			for j, class := range classes {
+				if confidence, ok := (*result.Prediction)[class]; ok {
+					row.Scores[j] = &confidence
+				}
+			}
+		}
+		rows[i] = row
+	}
+
+	// Thumbnails are embedded so that the report can be opened without the server.
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				rows[i].Thumbnail = reportThumbnail(rows[i].Path)
+			}
+		}()
+	}
+	for i, row := range rows {
+		if !row.Deleted {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	buf := bufio.NewWriter(w)
+	err := reportTemplate.Execute(buf, struct {
+		Title     string
+		Generated time.Time
+		Classes   []string
+		Rows      []reportRow
+	}{name, time.Now(), classes, rows})
+	return errors.Join(err, buf.Flush())
+}
+
+// reportThumbnail returns a data URI of a JPEG thumbnail of the image at path, or an empty one if it cannot be read.
+func reportThumbnail(path string) template.URL {
+	file, err := openImage(path)
+	if err != nil {
+		log.Debug("Skipping thumbnail", "path", path, "err", err)
+		return ""
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	buf.WriteString("data:image/jpeg;base64,")
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	if err := thumb.JPEG(enc, file, reportThumbnailSize); err != nil {
+		log.Debug("Skipping thumbnail", "path", path, "err", err)
+		return ""
+	}
+	enc.Close()
+	return template.URL(buf.String())
+}
+
+// jobResults reads every result a job has saved so far.
+func jobResults(job *Job) iter.Seq[*Result] {
+	return func(yield func(*Result) bool) {
+		for offset := 0; ; {
+			results, _, _, err := job.Read(offset, 1000)
+			if err != nil {
+				log.Error("Error reading job results", "id", job.ID, "err", err)
+				return
+			}
+			if len(results) == 0 {
+				return
+			}
+			offset += len(results)
+			for _, raw := range results {
+				var result Result
+				if err := json.Unmarshal(raw, &result); err != nil {
+					log.Error("Error decoding job result", "id", job.ID, "err", err)
+					continue
+				}
+				if !yield(&result) {
+					return
+				}
+			}
+		}
+	}
+}
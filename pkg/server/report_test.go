@@ -0,0 +1,103 @@
+package server
+
+import (
+	"image"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/sandbox"
+)
+
+func reportResults() []*Result {
+	color := 0.25
+	return []*Result{
+		{Path: "a.png", Color: &color, Prediction: &classify.Prediction{"cat": 0.75, "dog": 0.25}},
+		{Path: "b,c.png", Prediction: &classify.Prediction{"bird": 1}},
+		nil,
+		{Path: "gone.png", Deleted: true},
+	}
+}
+
+func TestWriteReportCSV(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeReport(w, ReportCSV, "walk", slices.Values(reportResults()))
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="walk.csv"` {
+		t.Errorf("got Content-Disposition %q", got)
+	}
+	want := `path,url,color,deleted,class,confidence,bird,cat,dog
+a.png,,0.25,false,cat,0.75,,0.75,0.25
+"b,c.png",,,false,bird,1,1,,
+gone.png,,,true,,,,,
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteReportJSONL(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeReport(w, ReportJSONL, "walk", slices.Values(reportResults()))
+	want := `{"path":"a.png","color":0.25,"prediction":{"cat":0.75,"dog":0.25}}
+{"path":"b,c.png","prediction":{"bird":1}}
+{"path":"gone.png","deleted":true}
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteReportHTML(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	roots, err := sandbox.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roots.Close()
+	defer func(roots *sandbox.Roots) { AllowedRoots = roots }(AllowedRoots)
+	AllowedRoots = roots
+
+	results := reportResults()
+	results[0].Path = filepath.Join(dir, "a.png")
+	w := httptest.NewRecorder()
+	writeReport(w, ReportHTML, "walk", slices.Values(results))
+	body := w.Body.String()
+	for _, want := range []string{
+		`<img src="data:image/jpeg;base64,`,
+		`<th data-type="number">bird</th>`,
+		`<td class="number" data-value="0.25">0.2500</td>`,
+		`<tr class="deleted">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("report does not contain %q", want)
+		}
+	}
+	if n := strings.Count(body, "<img"); n != 1 {
+		t.Errorf("got %d thumbnails, want 1", n)
+	}
+}
+
+func TestParseReportFormat(t *testing.T) {
+	for format, want := range map[string]ReportFormat{"": "", "CSV": ReportCSV, "ndjson": ReportJSONL, "html": ReportHTML} {
+		got, err := parseReportFormat(map[string][]string{"format": {format}})
+		if err != nil || got != want {
+			t.Errorf("parseReportFormat(%q) = %q, %v, want %q", format, got, err, want)
+		}
+	}
+	if _, err := parseReportFormat(map[string][]string{"format": {"xml"}}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+
+	"classifier/pkg/metrics"
+)
+
+// OpenAPI describes every route of Routes, along with its parameters and responses, as an OpenAPI 3.1 document.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// Routes returns the handler of every route the server serves, by pattern.
+// Routes that walk, watch or classify are limited per client.
+func Routes() map[string]http.Handler {
+	return map[string]http.Handler{
+		"GET /":                         http.HandlerFunc(HomeHandler),
+		"GET /openapi.json":             http.HandlerFunc(OpenAPIHandler),
+		"GET /watch":                    Limit(Watcher),
+		"GET /watch/folder":             Limit(FolderWatcher),
+		"GET /walk":                     Limit(WalkHandler),
+		"GET /search":                   Limit(SearchHandler),
+		"POST /predict":                 Limit(PredictHandler),
+		"GET /predictions":              http.HandlerFunc(PredictionsHandler),
+		"DELETE /predictions":           http.HandlerFunc(DeletePredictionsHandler),
+		"POST /predictions/invalidate":  http.HandlerFunc(InvalidatePredictionsHandler),
+		"GET /predictions/entry":        http.HandlerFunc(PredictionHandler),
+		"DELETE /predictions/entry":     http.HandlerFunc(DeletePredictionHandler),
+		"GET /file/{path}":              http.HandlerFunc(FileProxy),
+		"GET /thumb/{path}":             http.HandlerFunc(ThumbnailHandler),
+		"POST /jobs":                    Limit(JobsHandler),
+		"GET /jobs":                     http.HandlerFunc(ListJobsHandler),
+		"GET /jobs/{id}":                http.HandlerFunc(JobHandler),
+		"GET /jobs/{id}/results":        http.HandlerFunc(JobResultsHandler),
+		"DELETE /jobs/{id}":             http.HandlerFunc(CancelJobHandler),
+		"GET /label/next":               http.HandlerFunc(NextLabelHandler),
+		"GET /labels":                   http.HandlerFunc(LabelsHandler),
+		"POST /labels":                  http.HandlerFunc(AddLabelHandler),
+		"POST /labels/export":           http.HandlerFunc(ExportLabelsHandler),
+		"GET /artists/{artist}/profile": Limit(ProfileHandler),
+		"GET /metrics":                  metrics.Handler(),
+		"GET /healthz":                  http.HandlerFunc(HealthHandler),
+		"GET /readyz":                   http.HandlerFunc(ReadyHandler),
+	}
+}
+
+// Register adds every route of Routes to mux.
+func Register(mux *http.ServeMux) {
+	for pattern, handler := range Routes() {
+		mux.Handle(pattern, handler)
+	}
+}
+
+// OpenAPIHandler serves the OpenAPI document describing the server.
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPI)
+}
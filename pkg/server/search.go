@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/ellypaws/inkbunny/api"
+
+	"classifier/pkg/lib"
+	"classifier/pkg/utils"
+)
+
+// searchPageSize is how many submissions are requested per page of results, the most Inkbunny allows.
+const searchPageSize = 100
+
+// searchOrders are the orderby values Inkbunny accepts.
+var searchOrders = []string{"create_datetime", "unread_datetime", "views", "total_print_sales", "total_digital_sales", "total_sales", "username", "fav_datetime", "fav_stars", "pool_order"}
+
+var poolRegexp = regexp.MustCompile(`^\d+$`)
+
+// SearchSummary is sent as a final "summary" event once every submission a search found was scanned.
+// Found is how many submissions Inkbunny found, of which Submissions were scanned, up to max.
+// Classes counts the results by their most likely class.
+type SearchSummary struct {
+	Found       int            `json:"found"`
+	Submissions int            `json:"submissions"`
+	Files       int            `json:"files"`
+	Matched     int            `json:"matched"`
+	Failed      int            `json:"failed"`
+	Classes     map[string]int `json:"classes,omitempty"`
+	Elapsed     float64        `json:"elapsed"` // in seconds
+}
+
+// SearchHandler scans every submission of an Inkbunny search once, streaming a Result for every file that matched
+// and ending with a "summary" event. Unlike Watcher, which only ever looks at the unread submissions of the sid,
+// the search is read from the text, keywords, username, pool_id, dayslimit, type and orderby query parameters.
+// Clients reconnecting with Last-Event-ID continue the scan they were reading.
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if ResumeEvents(w, r) {
+		return
+	}
+	search, err := newSearch(r.URL.Query())
+	if errors.Is(err, errNothingToDo) {
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response, err := api.Credentials{Sid: search.request.SID}.SearchSubmissions(search.request)
+	utils.CountInkbunnyCall("search", err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Info("Scanning search", "submissions", int(response.ResultsCountAll), "pages", int(response.PagesCount), "max", search.max)
+
+	StreamEvents(w, r, func(ctx context.Context) iter.Seq[Event] {
+		return search.run(ctx, response)
+	})
+}
+
+// searchRequest is an Inkbunny search read from query parameters by newSearch.
+type searchRequest struct {
+	request        api.SubmissionSearchRequest
+	max            int
+	encryptKey     string
+	distanceConfig distanceConfig[*lib.CryptoFile]
+	classifyConfig classifyConfig[*os.File]
+}
+
+// newSearch reads the sid, text, keywords, username, pool_id, dayslimit, type, orderby and max query parameters,
+// along with encrypt_key, classify and those of newDistanceConfig. At least one of text, username, pool_id
+// and dayslimit is required, so that a missing parameter does not scan the whole of Inkbunny.
+func newSearch(query url.Values) (*searchRequest, error) {
+	request := api.SubmissionSearchRequest{
+		SID:                query.Get("sid"),
+		GetRID:             api.Yes,
+		SubmissionsPerPage: searchPageSize,
+		Text:               query.Get("text"),
+		Username:           query.Get("username"),
+		PoolID:             query.Get("pool_id"),
+		OrderBy:            query.Get("orderby"),
+	}
+	if request.SID == "" {
+		return nil, badRequest(errors.New("sid parameter is required"))
+	}
+	if s := query.Get("keywords"); s != "" {
+		keywords, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, badRequest(fmt.Errorf("invalid keywords: %w", err))
+		}
+		request.Keywords = api.BooleanYN(keywords)
+	}
+	if request.Username != "" && !artistRegexp.MatchString(request.Username) {
+		return nil, badRequest(fmt.Errorf("invalid username %q", request.Username))
+	}
+	if request.PoolID != "" && !poolRegexp.MatchString(request.PoolID) {
+		return nil, badRequest(fmt.Errorf("invalid pool_id %q", request.PoolID))
+	}
+	if s := query.Get("dayslimit"); s != "" {
+		days, err := strconv.Atoi(s)
+		if err != nil || days < 1 {
+			return nil, badRequest(errors.New("dayslimit must be a positive number of days"))
+		}
+		request.DaysLimit = api.IntString(days)
+	}
+	if s := query.Get("type"); s != "" {
+		for t := range strings.SplitSeq(s, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(t))
+			if err != nil || n < int(api.SubmissionTypePicturePinup) || n > int(api.SubmissionTypePhotography) {
+				return nil, badRequest(fmt.Errorf("invalid type %q, expected submission types from %d to %d separated by commas", t, api.SubmissionTypePicturePinup, api.SubmissionTypePhotography))
+			}
+			request.Type = append(request.Type, api.SubmissionType(n))
+		}
+	}
+	if request.OrderBy != "" && !slices.Contains(searchOrders, request.OrderBy) {
+		return nil, badRequest(fmt.Errorf("orderby %q must be one of %s", request.OrderBy, strings.Join(searchOrders, ", ")))
+	}
+	if request.Text == "" && request.Username == "" && request.PoolID == "" && request.DaysLimit == 0 {
+		return nil, badRequest(errors.New("at least one of text, username, pool_id and dayslimit is required"))
+	}
+
+	maxSubmissions := 0
+	if s := query.Get("max"); s != "" {
+		var err error
+		if maxSubmissions, err = strconv.Atoi(s); err != nil || maxSubmissions < 1 {
+			return nil, badRequest(errors.New("max must be a positive number of submissions"))
+		}
+	}
+
+	crypto, err := lib.NewCrypto(query.Get("encrypt_key"))
+	if err != nil {
+		return nil, err
+	}
+	distanceConfig, err := newDistanceConfig(query, crypto) // downloads are encrypted, so distance decrypts them
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	classifyConfig := classifyConfig[*os.File]{
+		enabled: query.Get("classify") == "true",
+		crypto:  crypto,
+		method:  os.Open, // files are already encrypted by utils.DownloadEncrypt
+	}
+	if !distanceConfig.enabled && !classifyConfig.enabled {
+		return nil, errNothingToDo
+	}
+
+	return &searchRequest{
+		request:        request,
+		max:            maxSubmissions,
+		encryptKey:     query.Get("encrypt_key"),
+		distanceConfig: distanceConfig,
+		classifyConfig: classifyConfig,
+	}, nil
+}
+
+// scannedSubmission is what collectSubmission found in a submission.
+type scannedSubmission struct {
+	files   int
+	results []*Result
+	failed  int
+}
+
+// run downloads and scans every submission of response, the first page of the search, and the pages after it.
+// Events are sent for every result, followed by a "summary" event.
+func (sr *searchRequest) run(ctx context.Context, response api.SubmissionSearchResponse) iter.Seq[Event] {
+	return func(yield func(Event) bool) {
+		start := time.Now()
+		summary := SearchSummary{Found: int(response.ResultsCountAll), Classes: make(map[string]int)}
+
+		distanceWorker := sr.distanceConfig.worker(ctx)
+		classifyWorker := sr.classifyConfig.worker(ctx)
+		distanceWorker.Work()
+		classifyWorker.Work()
+		worker := utils.NewWorkerPool(settings.Load().Concurrency.Download, func(submission api.Submission) scannedSubmission {
+			scanned := scannedSubmission{}
+			for _, file := range submission.Files {
+				if utils.IsImage(file.FileURLFull) {
+					scanned.files++
+				}
+			}
+			scanned.results, _, scanned.failed = collectSubmission(ctx, submission, sr.classifyConfig.crypto, sr.encryptKey, &distanceWorker, &classifyWorker)
+			return scanned
+		})
+		worker.Work()
+		go func() {
+			defer worker.Close()
+			for submissions := range sr.details(ctx, response) {
+				worker.Add(submissions...)
+			}
+		}()
+
+		// Every submission is read, even once the client stopped, so that the workers can finish.
+		stopped := false
+		for scanned := range worker.Iter() {
+			summary.Submissions++
+			summary.Files += scanned.files
+			summary.Failed += scanned.failed
+			for _, result := range scanned.results {
+				summary.Matched++
+				if result.Prediction != nil && len(*result.Prediction) > 0 {
+					class, _ := result.Prediction.Max()
+					summary.Classes[class]++
+				}
+				if !stopped && !yield(Event{Data: result}) {
+					stopped = true
+				}
+			}
+		}
+		distanceWorker.Close()
+		classifyWorker.Close()
+
+		summary.Elapsed = time.Since(start).Seconds()
+		log.Info("Finished scanning search", "submissions", summary.Submissions, "matched", summary.Matched, "failed", summary.Failed)
+		if !stopped {
+			yield(Event{Name: "summary", Data: summary})
+		}
+	}
+}
+
+// details pages through every result of the search with AllSubmissions, yielding the details of
+// the submissions of each page, up to max submissions. Pages that cannot be read are skipped.
+func (sr *searchRequest) details(ctx context.Context, response api.SubmissionSearchResponse) iter.Seq[[]api.Submission] {
+	return func(yield func([]api.Submission) bool) {
+		sid := sr.request.SID
+		page, sent := 0, 0
+		for submissions, err := range response.AllSubmissions() {
+			page++
+			if page > 1 { // the first page was searched by SearchHandler
+				utils.CountInkbunnyCall("search", err)
+			}
+			if err != nil {
+				log.Error("Error searching submissions", "page", page, "err", err)
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			ids := make([]string, 0, len(submissions))
+			for _, submission := range submissions {
+				ids = append(ids, submission.SubmissionID)
+			}
+			if sr.max > 0 {
+				ids = ids[:min(len(ids), sr.max-sent)]
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			details, err := api.Credentials{Sid: sid}.SubmissionDetails(api.SubmissionDetailsRequest{SID: sid, SubmissionIDs: strings.Join(ids, ",")})
+			utils.CountInkbunnyCall("submissions", err)
+			if err != nil {
+				log.Error("Error getting submission details", "page", page, "err", err)
+				continue
+			}
+			sent += len(ids)
+			if !yield(details.Submissions) {
+				return
+			}
+			if sr.max > 0 && sent >= sr.max {
+				return
+			}
+		}
+	}
+}
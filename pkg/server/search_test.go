@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/ellypaws/inkbunny/api"
+)
+
+func TestNewSearch(t *testing.T) {
+	query, _ := url.ParseQuery("sid=abc&text=dragon&keywords=false&username=artist&pool_id=42&dayslimit=7&type=1,%202&orderby=views&max=50&classify=true")
+	search, err := newSearch(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := search.request
+	if request.SID != "abc" || request.Text != "dragon" || request.Keywords || request.Username != "artist" ||
+		request.PoolID != "42" || request.DaysLimit != 7 || request.OrderBy != "views" {
+		t.Errorf("got %+v", request)
+	}
+	if !slices.Equal(request.Type, api.SubmissionTypes{api.SubmissionTypePicturePinup, api.SubmissionTypeSketch}) {
+		t.Errorf("got types %v", request.Type)
+	}
+	if !request.GetRID || request.SubmissionsPerPage != searchPageSize {
+		t.Error("searches must return a rid to page through every result")
+	}
+	if search.max != 50 || !search.classifyConfig.enabled || search.distanceConfig.enabled {
+		t.Errorf("got max %d, classify %v, distance %v", search.max, search.classifyConfig.enabled, search.distanceConfig.enabled)
+	}
+
+	for _, raw := range []string{
+		"text=dragon&classify=true",
+		"sid=abc&classify=true",
+		"sid=abc&username=../etc&classify=true",
+		"sid=abc&pool_id=1;2&classify=true",
+		"sid=abc&dayslimit=0&classify=true",
+		"sid=abc&text=dragon&type=15&classify=true",
+		"sid=abc&text=dragon&orderby=random&classify=true",
+		"sid=abc&text=dragon&max=-1&classify=true",
+		"sid=abc&text=dragon&keywords=maybe&classify=true",
+	} {
+		query, _ := url.ParseQuery(raw)
+		var status statusError
+		if _, err := newSearch(query); !errors.As(err, &status) {
+			t.Errorf("%s: got %v, want a bad request", raw, err)
+		}
+	}
+
+	query, _ = url.ParseQuery("sid=abc&text=dragon")
+	if _, err := newSearch(query); !errors.Is(err, errNothingToDo) {
+		t.Errorf("got %v without classify or distance, want errNothingToDo", err)
+	}
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	_ "embed"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"path/filepath"
@@ -11,7 +14,9 @@ import (
 
 	"github.com/charmbracelet/log"
 
+	"classifier/pkg/archive"
 	"classifier/pkg/lib"
+	"classifier/pkg/sandbox"
 	"classifier/pkg/utils"
 )
 
@@ -31,43 +36,131 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// AllowedRoots are the folders that /walk, /watch/folder and /file may read local files from.
+// Until it is set, every local path is forbidden.
+var AllowedRoots *sandbox.Roots
+
+// InkbunnyRoot is the folder files downloaded from Inkbunny are stored in.
+// Remote paths given to /file are only ever resolved inside it.
+var InkbunnyRoot *sandbox.Roots
+
+// statusError is an error reported to clients with a specific HTTP status code.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e statusError) Error() string { return e.err.Error() }
+func (e statusError) Unwrap() error { return e.err }
+
+// badRequest marks err as caused by invalid parameters.
+func badRequest(err error) error {
+	return statusError{code: http.StatusBadRequest, err: err}
+}
+
+// writeError writes err with the status code that matches it, such as 403 for paths outside the allowed roots.
+func writeError(w http.ResponseWriter, err error) {
+	var status statusError
+	switch {
+	case errors.As(err, &status):
+		http.Error(w, err.Error(), status.code)
+	case errors.Is(err, sandbox.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, new(*lib.AuthError)), errors.Is(err, archive.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func FileProxy(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.PathValue("path"), "http") {
 		serveEncryptedFile(w, r)
 		return
 	}
-	http.ServeFile(w, r, filepath.Clean(r.PathValue("path")))
+	serveLocalFile(w, r)
 }
 
-func serveEncryptedFile(w http.ResponseWriter, r *http.Request) {
-	path, decryptKey := getImagePath(r.PathValue("path"))
-	if path == "" {
-		http.Error(w, "path not found", http.StatusNotFound)
+// serveLocalFile serves a file inside AllowedRoots, which may be a virtual path
+// inside an archive such as "comics/issue1.cbz!/page03.png".
+func serveLocalFile(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	file, err := AllowedRoots.Open(path)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
-
-	crypto, err := lib.NewCrypto(decryptKey)
+	defer file.Close()
+	var info fs.FileInfo
+	if f, ok := file.(fs.File); ok {
+		info, err = f.Stat()
+	} else {
+		info, err = AllowedRoots.Stat(path)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, fmt.Sprintf("%s is a folder", path), http.StatusBadRequest)
 		return
 	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
 
-	file, err := crypto.Open(path)
+func serveEncryptedFile(w http.ResponseWriter, r *http.Request) {
+	file, err := openImage(r.PathValue("path"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	defer file.Close()
 
+	// Every chunk is authenticated before it is written, so a file that was modified fails with a 422
+	// unless only chunks after the first were, in which case the response is cut short.
 	_, err = io.Copy(w, file)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 }
 
+// openImage opens the file at path the way /file does: Inkbunny URLs are decrypted from InkbunnyRoot
+// with their key query parameter, and anything else is read from AllowedRoots.
+func openImage(path string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(path, "http") {
+		return AllowedRoots.Open(path)
+	}
+	path, decryptKey, err := getImagePath(path)
+	if err != nil {
+		return nil, err
+	}
+	crypto, err := lib.NewCrypto(decryptKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.OpenWith(InkbunnyRoot.Open, crypto.Decoder)(path)
+}
+
+// statImage returns the fs.FileInfo of the file openImage opens for path, without opening it.
+func statImage(path string) (fs.FileInfo, error) {
+	if !strings.HasPrefix(path, "http") {
+		return AllowedRoots.Stat(path)
+	}
+	path, _, err := getImagePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return InkbunnyRoot.Stat(path)
+}
+
 var inkbunnyRegexp = regexp.MustCompile(`(?:https?://)?((?:\w+\.)?i(?:nk)?b(?:unny)?(?:\.metapix)?.net)/(?:((?:private_)?thumbnails|usericons|files)/(medium|large|huge|full|preview))/((\d+)/(\d+)_([^_]+)_(.*?)(?:_noncustom)?\.[^\s?]+)\S*`)
 
+// artistRegexp matches Inkbunny usernames, which are the only folder names files are downloaded into.
+var artistRegexp = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
 func getArtist(url string) string {
 	match := inkbunnyRegexp.FindStringSubmatch(url)
 	if match == nil || len(match) < 7 {
@@ -76,10 +169,19 @@ func getArtist(url string) string {
 	return inkbunnyRegexp.FindStringSubmatch(url)[7]
 }
 
-func getImagePath(path string) (string, string) {
+// getImagePath returns where the Inkbunny file at the URL path was downloaded to, relative to InkbunnyRoot,
+// along with its key query parameter. URLs that do not follow the Inkbunny storage layout are forbidden.
+func getImagePath(path string) (string, string, error) {
 	u, err := url.Parse(path)
 	if err != nil {
-		return "", ""
+		return "", "", fmt.Errorf("%w: %v", sandbox.ErrForbidden, err)
+	}
+	if match := inkbunnyRegexp.FindStringSubmatchIndex(u.String()); match == nil || match[0] != 0 {
+		return "", "", fmt.Errorf("%w: %s is not an Inkbunny file", sandbox.ErrForbidden, u.Path)
+	}
+	artist, name := getArtist(u.String()), filepath.Base(u.Path)
+	if !artistRegexp.MatchString(artist) || !utils.IsImage(name) || strings.ContainsAny(name, `/\`) || name == ".." {
+		return "", "", fmt.Errorf("%w: %s is not an Inkbunny file", sandbox.ErrForbidden, u.Path)
 	}
-	return filepath.Join("inkbunny", getArtist(u.String()), filepath.Base(u.Path)), u.Query().Get("key")
+	return filepath.Join(artist, name), u.Query().Get("key"), nil
 }
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+)
+
+// Shutdown stops srv from accepting requests, then cancels every stream and job so that they flush their results,
+// and waits for the open requests and the jobs until ctx is done. stop cancels srv.BaseContext: it is only called
+// once the open requests finished or ctx is done, so that requests get to finish rather than being cut short.
+// Connections still open once ctx is done are closed.
+func Shutdown(ctx context.Context, srv *http.Server, stop context.CancelFunc) error {
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+	context.AfterFunc(ctx, stop)
+	defer stop()
+
+	cancelStreams()
+	jobsErr := DefaultJobs.Stop(ctx)
+	if jobsErr != nil {
+		log.Warn("Jobs did not stop in time", "err", jobsErr)
+	}
+	err := <-done
+	if err != nil {
+		log.Warn("Requests did not finish in time, closing their connections", "err", err)
+		err = errors.Join(err, srv.Close())
+	}
+	return errors.Join(jobsErr, err)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"classifier/pkg/classify"
+)
+
+// serve starts srv on a local port, and returns its URL.
+func serve(t *testing.T, srv *http.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+func TestShutdown(t *testing.T) {
+	base, stop := context.WithCancel(context.Background())
+	defer stop()
+	started := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			select {
+			case <-time.After(100 * time.Millisecond):
+				io.WriteString(w, "finished")
+			case <-r.Context().Done():
+				io.WriteString(w, "cancelled")
+			}
+		}),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	url := serve(t, srv)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx, srv, stop); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-body; got != "finished" {
+		t.Errorf("got %q, want the open request to finish before its context is cancelled", got)
+	}
+	if base.Err() == nil {
+		t.Error("the base context was not cancelled once the server shut down")
+	}
+}
+
+func TestShutdown_Timeout(t *testing.T) {
+	base, stop := context.WithCancel(context.Background())
+	defer stop()
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-r.Context().Done()
+			close(cancelled)
+		}),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	url := serve(t, srv)
+	go http.Get(url)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx, srv, stop); err == nil {
+		t.Error("expected an error for a request that did not finish in time")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the open request was not cancelled once the drain was over")
+	}
+}
+
+// blockingClassifier points classify at a classifier that answers once release is closed.
+func blockingClassifier(t *testing.T) (release chan struct{}) {
+	t.Helper()
+	release = make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			w.Write([]byte(`{"safe": 0.9, "cub": 0.1}`))
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	classify.SetPredictURL(srv.URL)
+	t.Cleanup(func() { classify.SetPredictURL("http://localhost:7860/predict") })
+	return release
+}
+
+func TestJobs_Stop(t *testing.T) {
+	release := blockingClassifier(t)
+	folder := testImages(t, 3)
+	dir := t.TempDir()
+	jobs, err := LoadJobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := jobs.Start(JobWalk, "", url.Values{"folder": {folder}, "max": {"10"}, "classify": {"true"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := jobs.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// A stopped job is saved as running, with its own checkpoint, so that it is started again.
+	data, err := os.ReadFile(filepath.Join(job.dir, "job.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Job
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != JobRunning {
+		t.Errorf("got a stopped job saved as %s, want running", saved.Status)
+	}
+	if _, err := os.Stat(filepath.Join(job.dir, "checkpoint.json")); err != nil {
+		t.Errorf("the stopped job did not save its checkpoint: %v", err)
+	}
+
+	close(release)
+	jobs, err = LoadJobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, ok := jobs.Get(job.ID)
+	if !ok {
+		t.Fatalf("job %s was not loaded", job.ID)
+	}
+	waitJob(t, restarted)
+	if got := restarted.Snapshot(); got.Status != JobCompleted || got.Results != 3 {
+		t.Errorf("got %s with %d results, want completed with 3", got.Status, got.Results)
+	}
+}
+
+func TestJobs_StartSaveError(t *testing.T) {
+	folder := testImages(t, 1)
+	dir := t.TempDir()
+	state := `{"id": "blocked", "kind": "walk", "status": "running", "params": {"folder": ["` + folder + `"], "max": ["1"], "distance": ["true"], "color": ["#ffffff"]}}`
+	if err := os.MkdirAll(filepath.Join(dir, "blocked", "job.json.tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blocked", "job.json"), []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := LoadJobs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, ok := jobs.Get("blocked")
+	if !ok {
+		t.Fatal("the job was not loaded")
+	}
+	select {
+	case <-job.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a job that could not be saved never stopped")
+	}
+	if got := job.Snapshot(); got.Status != JobFailed || !strings.Contains(got.Error, "job.json.tmp") {
+		t.Errorf("got %s (%s), want failed", got.Status, got.Error)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := jobs.Stop(ctx); err != nil {
+		t.Errorf("got %v, want Stop to return at once", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	testPredictions(t)
+	name := filepath.Join(t.TempDir(), "classifications.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		classify.DefaultCache.Checkpoint(ctx, name, 10*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(name)
+		if strings.Contains(string(data), "predictions/a.png") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the classifications were not checkpointed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Checkpoint did not return once its context was cancelled")
+	}
+}
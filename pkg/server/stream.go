@@ -0,0 +1,334 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"iter"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+var (
+	// replayLimit is how many of the latest events a stream keeps for clients that reconnect.
+	// Progress events are not counted, as only the latest of them is kept.
+	replayLimit = 1024
+	// streamLinger is how long a stream keeps running once its last client left, and how long
+	// a finished stream can still be replayed.
+	streamLinger = time.Minute
+)
+
+// stream runs a producer of events independently of the request that started it, numbering every event
+// as "<stream>-<sequence>" so that a client reconnecting with Last-Event-ID receives the events it missed.
+type stream struct {
+	id     string
+	key    string
+	cancel context.CancelFunc
+	limit  int           // limit is replayLimit when the stream started.
+	ttl    time.Duration // ttl is streamLinger when the stream started.
+
+	mu      sync.Mutex
+	events  []sequenced // events holds up to replayLimit events along with the latest progress event, in sequence.
+	first   uint64      // first is the lowest sequence that can still be replayed.
+	next    uint64
+	done    bool
+	clients int
+	linger  *time.Timer
+	changed chan struct{}
+}
+
+// sequenced is an event kept by a stream, along with its sequence.
+type sequenced struct {
+	seq uint64
+	Event
+}
+
+// streams holds every stream that can still be resumed, and the shared streams that are still running by key.
+// It is always locked before a stream's own mutex.
+var streams = struct {
+	sync.Mutex
+	m      map[string]*stream
+	shared map[string]*stream
+}{m: make(map[string]*stream), shared: make(map[string]*stream)}
+
+// StreamEvents sends the events of start to the client like RespondEvents, but resumably.
+// start runs with its own context, which is only cancelled once no client has been connected for streamLinger.
+// A client reconnecting with a Last-Event-ID from the stream continues where it left off instead of starting again.
+func StreamEvents(w http.ResponseWriter, r *http.Request, start func(ctx context.Context) iter.Seq[Event]) {
+	if ResumeEvents(w, r) {
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		RespondEvents(w, r, start(r.Context()))
+		return
+	}
+	s := newStream("", start)
+	RespondEvents(w, r, s.subscribe(r.Context(), 0))
+}
+
+// ShareEvents is like StreamEvents, except that clients passing the same key share a single stream.
+// start only runs for the first of them, and clients joining later first receive the recent events
+// that are still in the replay buffer. The stream stops once its last client left for streamLinger.
+func ShareEvents(w http.ResponseWriter, r *http.Request, key string, start func(ctx context.Context) iter.Seq[Event]) {
+	if ResumeEvents(w, r) {
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		RespondEvents(w, r, start(r.Context()))
+		return
+	}
+	streams.Lock()
+	s, ok := streams.shared[key]
+	if !ok {
+		s = startStream(key, start)
+	}
+	// Subscribe before unlocking, so that the stream cannot be stopped for having no clients in between.
+	events := s.subscribe(r.Context(), 0)
+	streams.Unlock()
+	if ok {
+		log.Info("Joining shared stream", "stream", s.id)
+	}
+	RespondEvents(w, r, events)
+}
+
+// Stream sends any results from start to the client, like Respond, but resumably as with StreamEvents.
+func Stream[P ~*T, T any](w http.ResponseWriter, r *http.Request, start func(ctx context.Context) iter.Seq[P]) {
+	StreamEvents(w, r, func(ctx context.Context) iter.Seq[Event] { return results(start(ctx)) })
+}
+
+// ResumeEvents continues the stream a client was reading before reconnecting with Last-Event-ID,
+// reporting whether there was one to continue. Clients that cannot set the header can pass last_event_id instead.
+func ResumeEvents(w http.ResponseWriter, r *http.Request) bool {
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID == "" {
+		return false
+	}
+	id, seq, ok := parseEventID(lastID)
+	if !ok {
+		return false
+	}
+	streams.Lock()
+	s, ok := streams.m[id]
+	var events iter.Seq[Event]
+	if ok {
+		events = s.subscribe(r.Context(), seq+1)
+	}
+	streams.Unlock()
+	if !ok {
+		log.Warn("Stream to resume has expired, starting over", "last_event_id", lastID)
+		return false
+	}
+	log.Info("Resuming stream", "stream", id, "after", seq)
+	RespondEvents(w, r, events)
+	return true
+}
+
+func parseEventID(id string) (string, uint64, bool) {
+	stream, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return stream, n, true
+}
+
+// newStream starts a stream, shared by every client with the same key unless key is empty.
+func newStream(key string, start func(ctx context.Context) iter.Seq[Event]) *stream {
+	streams.Lock()
+	defer streams.Unlock()
+	return startStream(key, start)
+}
+
+// startStream is newStream for callers that already hold the streams lock.
+func startStream(key string, start func(ctx context.Context) iter.Seq[Event]) *stream {
+	id := make([]byte, 8)
+	rand.Read(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &stream{
+		id:      hex.EncodeToString(id),
+		key:     key,
+		cancel:  cancel,
+		limit:   replayLimit,
+		ttl:     streamLinger,
+		first:   1,
+		next:    1,
+		changed: make(chan struct{}),
+	}
+	streams.m[s.id] = s
+	if key != "" {
+		streams.shared[key] = s
+	}
+
+	go func() {
+		for event := range start(ctx) {
+			s.append(event)
+		}
+		s.unshare()
+		s.mu.Lock()
+		s.done = true
+		s.notify()
+		s.mu.Unlock()
+		cancel()
+		// Keep the finished stream around for clients that have yet to reconnect.
+		time.AfterFunc(s.ttl, s.remove)
+	}()
+	return s
+}
+
+// append adds event to the stream. A progress event replaces the previous one, which clients reconnecting
+// have no need for, so that a long walk's progress does not push its results out of the replay buffer.
+func (s *stream) append(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.ID = fmt.Sprintf("%s-%d", s.id, s.next)
+	isProgress := func(e sequenced) bool { return e.Name == "progress" }
+	events := s.events
+	if event.Name == "progress" {
+		// Subscribers may still be reading the old events, so they are copied rather than changed in place.
+		events = slices.DeleteFunc(slices.Clone(events), isProgress)
+	}
+	events = append(events, sequenced{seq: s.next, Event: event})
+	s.next++
+	kept := len(events)
+	if slices.ContainsFunc(events, isProgress) {
+		kept--
+	}
+	if kept > s.limit {
+		drop := 0
+		for dropped := 0; dropped < kept-s.limit; drop++ {
+			if !isProgress(events[drop]) {
+				dropped++
+			}
+		}
+		s.first = events[drop-1].seq + 1
+		events = append(events[:0:0], events[drop:]...)
+	}
+	s.events = events
+	s.notify()
+}
+
+// notify wakes up every subscriber. The caller must hold s.mu.
+func (s *stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// subscribe returns the events from sequence from onwards, or from the oldest event still kept when from is 0,
+// following the stream until it is done or ctx is. Events that were already dropped from the replay buffer
+// are skipped, as are progress events that were replaced by a later one. The stream counts the subscriber
+// as a client from now on, until the returned sequence is read to the end.
+func (s *stream) subscribe(ctx context.Context, from uint64) iter.Seq[Event] {
+	s.attach()
+	return func(yield func(Event) bool) {
+		defer s.detach()
+		for {
+			s.mu.Lock()
+			if from == 0 {
+				from = s.first
+			}
+			if from < s.first {
+				log.Warn("Events were dropped before the client reconnected", "stream", s.id, "missed", s.first-from)
+				from = s.first
+			}
+			i, _ := slices.BinarySearchFunc(s.events, from, func(e sequenced, seq uint64) int { return cmp.Compare(e.seq, seq) })
+			events := s.events[i:]
+			done, changed := s.done, s.changed
+			s.mu.Unlock()
+
+			for _, event := range events {
+				if !yield(event.Event) {
+					return
+				}
+				from = event.seq + 1
+			}
+			if len(events) > 0 {
+				continue
+			}
+			if done {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+		}
+	}
+}
+
+// attach stops the stream from being cancelled while a client is reading it.
+func (s *stream) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients++
+	if s.linger != nil {
+		s.linger.Stop()
+		s.linger = nil
+	}
+}
+
+// detach cancels the stream once no client has been reading it for streamLinger.
+func (s *stream) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients--
+	if s.clients > 0 || s.done {
+		return
+	}
+	s.linger = time.AfterFunc(s.ttl, func() {
+		streams.Lock()
+		s.mu.Lock()
+		idle := s.clients == 0 && !s.done
+		if idle && s.key != "" {
+			delete(streams.shared, s.key)
+		}
+		s.mu.Unlock()
+		streams.Unlock()
+		if idle {
+			log.Info("Cancelling stream without clients", "stream", s.id)
+			s.cancel()
+		}
+	})
+}
+
+// unshare stops new clients from joining the stream.
+func (s *stream) unshare() {
+	if s.key == "" {
+		return
+	}
+	streams.Lock()
+	if streams.shared[s.key] == s {
+		delete(streams.shared, s.key)
+	}
+	streams.Unlock()
+}
+
+func (s *stream) remove() {
+	streams.Lock()
+	delete(streams.m, s.id)
+	streams.Unlock()
+}
+
+// cancelStreams cancels every stream that is still running. Their clients receive the events
+// the streams send while stopping, followed by the exit event.
+func cancelStreams() {
+	streams.Lock()
+	defer streams.Unlock()
+	for _, s := range streams.m {
+		s.cancel()
+	}
+}
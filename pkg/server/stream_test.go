@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"iter"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamResume(t *testing.T) {
+	release := make(chan struct{})
+	s := newStream("", func(ctx context.Context) iter.Seq[Event] {
+		return func(yield func(Event) bool) {
+			if !yield(Event{Data: 1}) || !yield(Event{Data: 2}) {
+				return
+			}
+			<-release
+			yield(Event{Data: 3})
+		}
+	})
+
+	var first []Event
+	for event := range s.subscribe(t.Context(), 1) {
+		first = append(first, event)
+		if len(first) == 2 {
+			break
+		}
+	}
+	if first[0].ID != s.id+"-1" || first[1].ID != s.id+"-2" {
+		t.Fatalf("got ids %q and %q, want %s-1 and %s-2", first[0].ID, first[1].ID, s.id, s.id)
+	}
+	close(release)
+
+	waitFor(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.done
+	})
+
+	r := httptest.NewRequest("GET", "/watch", nil)
+	r.Header.Set("Last-Event-ID", first[0].ID)
+	w := httptest.NewRecorder()
+	if !ResumeEvents(w, r) {
+		t.Fatal("stream was not resumed")
+	}
+	want := "id: " + s.id + "-2\ndata: 2\n\nid: " + s.id + "-3\ndata: 3\n\nevent: exit\ndata: exit\n\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStreamReplayLimit(t *testing.T) {
+	defer func(limit int) { replayLimit = limit }(replayLimit)
+	replayLimit = 2
+
+	s := newStream("", func(ctx context.Context) iter.Seq[Event] {
+		return func(yield func(Event) bool) {
+			for i := range 5 {
+				if !yield(Event{Data: i}) {
+					return
+				}
+			}
+		}
+	})
+	var got []string
+	for event := range s.subscribe(t.Context(), 1) {
+		got = append(got, event.ID)
+	}
+	// The subscriber may have started before or after the events were dropped, but always ends with the latest.
+	if len(got) < 2 || got[len(got)-1] != s.id+"-5" {
+		t.Errorf("got %v, want to end with %s-5", got, s.id)
+	}
+}
+
+func TestStreamCoalescesProgress(t *testing.T) {
+	defer func(limit int) { replayLimit = limit }(replayLimit)
+	replayLimit = 2
+
+	s := newStream("", func(ctx context.Context) iter.Seq[Event] {
+		return func(yield func(Event) bool) {
+			yield(Event{Data: "a"})
+			for i := range 10 {
+				yield(Event{Name: "progress", Data: i})
+			}
+			yield(Event{Data: "b"})
+			yield(Event{Name: "progress", Data: 10})
+		}
+	})
+	waitFor(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.done
+	})
+
+	var got []string
+	for event := range s.subscribe(t.Context(), 1) {
+		got = append(got, event.ID+" "+event.Name)
+	}
+	// Every result is kept, however many progress events were sent in between.
+	want := []string{s.id + "-1 ", s.id + "-12 ", s.id + "-13 progress"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestResumeUnknownStream(t *testing.T) {
+	for _, id := range []string{"", "garbage", "0000-1"} {
+		r := httptest.NewRequest("GET", "/watch", nil)
+		r.Header.Set("Last-Event-ID", id)
+		if ResumeEvents(httptest.NewRecorder(), r) {
+			t.Errorf("ResumeEvents(%q) = true, want false", id)
+		}
+	}
+}
+
+func TestShareEvents(t *testing.T) {
+	var starts atomic.Int32
+	release := make(chan struct{})
+	start := func(ctx context.Context) iter.Seq[Event] {
+		starts.Add(1)
+		return func(yield func(Event) bool) {
+			if !yield(Event{Data: 1}) {
+				return
+			}
+			<-release
+			yield(Event{Data: 2})
+		}
+	}
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, 2)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ShareEvents(recorders[i], httptest.NewRequest("GET", "/watch", nil), "test", start)
+		}()
+		// Wait for the client to be subscribed, so that the second joins the running stream.
+		waitFor(t, func() bool {
+			streams.Lock()
+			defer streams.Unlock()
+			s, ok := streams.shared["test"]
+			if !ok {
+				return false
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.clients == i+1 && s.next > 1
+		})
+	}
+	close(release)
+	wg.Wait()
+
+	if n := starts.Load(); n != 1 {
+		t.Errorf("started %d times, want 1", n)
+	}
+	for i, w := range recorders {
+		body := w.Body.String()
+		if !strings.Contains(body, "data: 1\n") || !strings.Contains(body, "data: 2\n") {
+			t.Errorf("client %d got %q, want both events", i, body)
+		}
+	}
+}
+
+func TestShareEventsStopsWithoutClients(t *testing.T) {
+	defer func(linger time.Duration) { streamLinger = linger }(streamLinger)
+	streamLinger = time.Millisecond
+
+	stopped := make(chan struct{})
+	start := func(ctx context.Context) iter.Seq[Event] {
+		return func(yield func(Event) bool) {
+			<-ctx.Done()
+			close(stopped)
+		}
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		ShareEvents(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, "GET", "/watch", nil), "idle", start)
+		close(done)
+	}()
+	var s *stream
+	waitFor(t, func() bool {
+		streams.Lock()
+		defer streams.Unlock()
+		s = streams.shared["idle"]
+		return s != nil
+	})
+	cancel()
+	<-done
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stream kept running without clients")
+	}
+	waitFor(t, func() bool {
+		streams.Lock()
+		defer streams.Unlock()
+		return streams.m[s.id] == nil && streams.shared["idle"] == nil
+	})
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
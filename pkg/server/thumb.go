@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/thumb"
+)
+
+const (
+	// defaultThumbnailSize is the largest side of thumbnails when no size is given.
+	defaultThumbnailSize = 256
+	// maxThumbnailSize is the largest size that can be requested, beyond which /file should be used instead.
+	maxThumbnailSize = 1024
+	// maxThumbnailSource is the largest file thumbnails are made of.
+	maxThumbnailSource = 64 << 20
+)
+
+// Thumbnails caches the thumbnails served by ThumbnailHandler. Until it is set, they are made for every request.
+var Thumbnails *thumb.Cache
+
+// ThumbnailHandler serves a JPEG or WebP of the file at path, scaled down to fit within size×size pixels.
+// The file is read like /file does, decrypting Inkbunny files with their key. Files over maxThumbnailSource
+// bytes or thumb.MaxPixels pixels are refused. Thumbnails are cached by the requested path along with the size
+// and modification time of the file rather than by a hash of its content, so that a cached thumbnail is served
+// without opening the file at all, where hashing would read and decrypt the whole file for every tile of a grid.
+// Thumbnails that are not cached yet count towards the client's limits.
+func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	size := defaultThumbnailSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil || size < 1 || size > maxThumbnailSize {
+			http.Error(w, fmt.Sprintf("size must be between 1 and %d", maxThumbnailSize), http.StatusBadRequest)
+			return
+		}
+	}
+	format := thumb.FormatJPEG
+	switch s := thumb.Format(strings.ToLower(r.URL.Query().Get("format"))); s {
+	case "", thumb.FormatJPEG:
+	case thumb.FormatWebP:
+		format = s
+	default:
+		http.Error(w, "format must be jpeg or webp", http.StatusBadRequest)
+		return
+	}
+
+	path := r.PathValue("path")
+	info, err := statImage(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// The path includes the key of Inkbunny files, so that a thumbnail is only served to those who can decrypt it.
+	key := thumb.Key(sha256.Sum256(fmt.Appendf(nil, "%s\x00%d\x00%d\x00%s", path, info.Size(), info.ModTime().UnixNano(), format)), size)
+
+	data, ok := Thumbnails.Get(key)
+	if !ok {
+		// Only making a thumbnail is limited, so that a grid of cached thumbnails loads at once.
+		release, ok := admit(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		if info.Size() > maxThumbnailSource {
+			http.Error(w, fmt.Sprintf("%s is larger than %d bytes", path, maxThumbnailSource), http.StatusUnprocessableEntity)
+			return
+		}
+		file, err := openImage(path)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var buf bytes.Buffer
+		err = thumb.Encode(&buf, io.LimitReader(file, maxThumbnailSource), size, format)
+		file.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error making thumbnail of %s: %v", path, err), http.StatusUnprocessableEntity)
+			return
+		}
+		data = buf.Bytes()
+		if err := Thumbnails.Put(key, data); err != nil {
+			log.Error("Error caching thumbnail", "path", path, "err", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", strconv.Quote(key))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
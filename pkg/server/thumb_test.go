@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"classifier/pkg/config"
+	"classifier/pkg/lib"
+	"classifier/pkg/thumb"
+)
+
+func thumbnailRequest(path, query string) *http.Request {
+	r := httptest.NewRequest("GET", "/thumb/x?"+query, nil)
+	r.SetPathValue("path", path)
+	r.RemoteAddr = "192.0.2.42:1234" // a client of its own, as other tests use up the limits of the default one
+	return r
+}
+
+func TestThumbnailHandler(t *testing.T) {
+	forgetClients(t, "ip:192.0.2.42", "ip:192.0.2.43")
+	folder := testImages(t, 0)
+	name := filepath.Join(folder, "wide.png")
+	var src bytes.Buffer
+	if err := png.Encode(&src, image.NewRGBA(image.Rect(0, 0, 64, 32))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, src.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	crypto, err := lib.NewCrypto("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := thumb.NewCache(t.TempDir(), crypto, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(cache *thumb.Cache) { Thumbnails = cache }(Thumbnails)
+	Thumbnails = cache
+
+	for query, want := range map[string]string{"size=16": "jpeg", "size=16&format=webp": "webp"} {
+		w := httptest.NewRecorder()
+		ThumbnailHandler(w, thumbnailRequest(name, query))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", query, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); got != "image/"+want {
+			t.Errorf("%s: got Content-Type %s, want image/%s", query, got, want)
+		}
+		img, format, err := image.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if format != want || img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+			t.Errorf("%s: got a %dx%d %s, want a 16x8 %s", query, img.Bounds().Dx(), img.Bounds().Dy(), format, want)
+		}
+	}
+
+	// Thumbnails that still have to be made count towards the client's limits, unlike cached ones.
+	previous := settings.Load()
+	cfg := *config.Default()
+	cfg.Limits = config.Limits{RequestsPerSecond: 0.1, Burst: 1, Concurrent: 1, Jobs: 1}
+	settings.Store(&cfg)
+	limited := func(query string) *http.Request {
+		r := thumbnailRequest(name, query)
+		r.RemoteAddr = "192.0.2.43:1234"
+		return r
+	}
+	for _, query := range []string{"size=16", "size=16", "size=17", "size=18"} {
+		w := httptest.NewRecorder()
+		ThumbnailHandler(w, limited(query))
+		want := http.StatusOK
+		if query == "size=18" {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", query, w.Code, want)
+		}
+	}
+	settings.Store(previous)
+
+	// Cached thumbnails are served without reading the file, for as long as its size and modification time stay.
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, bytes.Repeat([]byte{0}, int(info.Size())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	ThumbnailHandler(w, thumbnailRequest(name, "size=16"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want the cached thumbnail: %s", w.Code, w.Body)
+	}
+	modified := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(name, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	ThumbnailHandler(w, thumbnailRequest(name, "size=16"))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got %d for a modified file that is no longer an image, want 422", w.Code)
+	}
+
+	for _, query := range []string{"size=0", "size=4096", "size=big", "format=gif"} {
+		w := httptest.NewRecorder()
+		ThumbnailHandler(w, thumbnailRequest(name, query))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	ThumbnailHandler(w, thumbnailRequest(filepath.Join(folder, "missing.png"), ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for a missing file, want 404", w.Code)
+	}
+}
@@ -2,33 +2,118 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/lucasb-eyer/go-colorful"
 
+	"classifier/pkg/classify"
 	"classifier/pkg/lib"
 	"classifier/pkg/utils"
+	"classifier/pkg/walker"
 )
 
+// errNothingToDo is returned when a request would not produce any result, such as when neither
+// distance nor classify is enabled. Handlers respond with an empty body, as they always have.
+var errNothingToDo = errors.New("nothing to do")
+
 // WalkHandler is the HTTP API endpoint that receives query parameters,
 // starts the walkDir process, and streams results back using Flush.
+// Clients reconnecting with Last-Event-ID continue the walk they were reading.
+// With the format query parameter, the results are downloaded as a csv, jsonl or html report instead.
 func WalkHandler(w http.ResponseWriter, r *http.Request) {
+	if ResumeEvents(w, r) {
+		return
+	}
+	format, err := parseReportFormat(r.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	interval, err := parseSeconds(r.URL.Query().Get("progress_seconds"))
+	if err != nil {
+		http.Error(w, "invalid progress_seconds: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	walk, err := newWalk(r.URL.Query())
+	if errors.Is(err, errNothingToDo) {
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if format != "" {
+		results := make(chan *Result)
+		go walk.run(r.Context(), results, new(walker.Progress))
+		writeReport(w, format, "walk-"+time.Now().Format("20060102-150405"), utils.Iter(results))
+		return
+	}
+
+	StreamEvents(w, r, func(ctx context.Context) iter.Seq[Event] {
+		progress := new(walker.Progress)
+		results := make(chan *Result)
+		go walk.run(ctx, results, progress)
+		return withProgress(ctx, results, progress, interval)
+	})
+}
+
+// walkRequest is a walk read from query parameters by newWalk, ready to be started with run.
+type walkRequest struct {
+	folder         string
+	fsys           fs.FS
+	release        func() // release lets the roots fsys belongs to be closed once run is done.
+	max            int
+	archives       bool
+	count          bool
+	filter         walker.Filter
+	shard          walker.Shard
+	manifest       *walker.Manifest
+	manifestPath   string
+	checkpoint     *walker.Checkpoint
+	distanceConfig distanceConfig[*lib.CryptoFile]
+	classifyConfig classifyConfig[*lib.CryptoFile]
+}
+
+// newWalk reads the folder, max, classify, encrypt_key, incremental, archives, resume, count, shard
+// and filter query parameters, along with those of newDistanceConfig.
+// The walk holds its folder's root open until it is run, or released when it never is.
+func newWalk(query url.Values) (_ *walkRequest, err error) {
 	// get query parameters: folder, color (as hex) and optional threshold
-	folder := r.URL.Query().Get("folder")
-	maxStr := r.URL.Query().Get("max")
-	shouldClassify := r.URL.Query().Get("classify") == "true"
-	encryptKey := r.URL.Query().Get("encrypt_key")
+	folder := query.Get("folder")
+	maxStr := query.Get("max")
+	shouldClassify := query.Get("classify") == "true"
+	encryptKey := query.Get("encrypt_key")
+	incremental := query.Get("incremental") == "true"
+	resume := query.Get("resume") == "true"
 
 	if folder == "" {
-		http.Error(w, "folder parameter is required", http.StatusBadRequest)
-		return
+		return nil, badRequest(errors.New("folder parameter is required"))
 	}
 
+	fsys, release, err := AllowedRoots.FS(folder)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
 	maxFiles := -1
 	if maxStr != "" {
 		if m, err := strconv.Atoi(maxStr); err == nil && m > 0 {
@@ -37,91 +122,242 @@ func WalkHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if maxFiles < 1 {
-		return
+		return nil, errNothingToDo
 	}
 
-	distanceConfig, err := newDistanceConfig(r, nil) // because we expect local files to be unencrypted, hand in a nil crypto
+	distanceConfig, err := newDistanceConfig(query, nil) // because we expect local files to be unencrypted, hand in a nil crypto
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, badRequest(err)
 	}
+	var plain *lib.Crypto
+	distanceConfig.method = plain.OpenWith(AllowedRoots.Open, plain.Decoder) // files may be inside archives
 
 	crypto, err := lib.NewCrypto(encryptKey)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	classifyConfig := classifyConfig[*lib.CryptoFile]{
 		enabled: shouldClassify,
 		crypto:  crypto,
-		method:  crypto.OpenWithMethod(crypto.Encrypt), // because we expect local files to be unencrypted, we encrypt before calling classify.Predict
+		method:  crypto.OpenWith(AllowedRoots.Open, crypto.Encrypt), // because we expect local files to be unencrypted, we encrypt before calling classify.Predict
 	}
 
 	if !distanceConfig.enabled && !classifyConfig.enabled {
-		return
+		return nil, errNothingToDo
 	}
 
-	results := make(chan *Result)
-	go walkDir(r.Context(), folder, maxFiles, results,
-		distanceConfig,
-		classifyConfig,
-	)
+	filter, err := newFilter(query)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	shard, err := walker.ParseShard(query.Get("shard"))
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	archives := query.Get("archives") == "true"
+	var manifest *walker.Manifest
+	var manifestPath string
+	if incremental {
+		// Files are only unchanged for walks that would do the same with them.
+		config := []string{distanceConfig.key()}
+		if classifyConfig.enabled {
+			config = append(config, "classify")
+		}
+		if archives {
+			config = append(config, "archives")
+		}
+		manifestPath = walker.ManifestPath(folder, shard, filter, strings.Join(config, ";"))
+		manifest, err = walker.LoadManifest(manifestPath, folder)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	Respond(w, r, utils.Iter(results))
-	log.Info("Finished processing results for", "folder", folder, "distance", distanceConfig.enabled, "classify", shouldClassify)
+	var checkpoint *walker.Checkpoint
+	if resume {
+		checkpoint, err = walker.LoadCheckpoint(walker.CheckpointPath(folder, shard, filter), folder, shard)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &walkRequest{
+		folder:         folder,
+		fsys:           fsys,
+		release:        release,
+		max:            maxFiles,
+		archives:       archives,
+		count:          query.Get("count") == "true",
+		filter:         filter,
+		shard:          shard,
+		manifest:       manifest,
+		manifestPath:   manifestPath,
+		checkpoint:     checkpoint,
+		distanceConfig: distanceConfig,
+		classifyConfig: classifyConfig,
+	}, nil
 }
 
-// walkDir traverses the folder rooted at "root" and, for each image file,
-// spawns a goroutine (limited by a semaphore of size runtime.NumCPU)
-func walkDir(ctx context.Context, root string, max int, results chan<- *Result, distanceConfig distanceConfig[*lib.CryptoFile], classifyConfig classifyConfig[*lib.CryptoFile]) {
-	defer close(results)
+// run walks the folder, sending results until the walk is done, and then saves the manifest.
+// The results channel is closed once every result was sent.
+func (wr *walkRequest) run(ctx context.Context, results chan<- *Result, progress *walker.Progress) {
+	defer wr.release()
+	walkDir(ctx, wr.fsys, wr.folder, wr.max, results,
+		wr.archives,
+		wr.filter,
+		wr.shard,
+		wr.manifest,
+		wr.checkpoint,
+		progress,
+		wr.count,
+		wr.distanceConfig,
+		wr.classifyConfig,
+	)
+	if wr.manifest != nil {
+		if err := wr.manifest.Save(wr.manifestPath); err != nil {
+			log.Error("Error saving manifest", "folder", wr.folder, "err", err)
+		}
+	}
+	log.Info("Finished processing results for", "folder", wr.folder, "shard", wr.shard, "distance", wr.distanceConfig.enabled, "classify", wr.classifyConfig.enabled)
+}
+
+// walkDir traverses fsys, the folder rooted at "root", and for each image file
+// collects the distance and classification results using walker.WalkFS.
+func walkDir(ctx context.Context, fsys fs.FS, root string, max int, results chan<- *Result, archives bool, filter walker.Filter, shard walker.Shard, manifest *walker.Manifest, checkpoint *walker.Checkpoint, progress *walker.Progress, count bool, distanceConfig distanceConfig[*lib.CryptoFile], classifyConfig classifyConfig[*lib.CryptoFile]) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
 
-	var (
-		count int
-		wg    sync.WaitGroup
-	)
-
 	if distanceConfig.metric == nil {
 		distanceConfig.metric = colorful.Color.DistanceLab
 	}
 
 	distanceWorker := distanceConfig.worker(ctx)
 	classifyWorker := classifyConfig.worker(ctx)
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		if utils.NotImage(path) {
-			return nil
-		}
-		if max > 0 && count >= max {
-			return filepath.SkipDir
-		}
-
-		count++
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			result, err := Collect(ctx, path, distanceWorker.Promise(path), classifyWorker.Promise(path))
-			if err != nil {
-				return
+	distanceWorker.Work()
+	classifyWorker.Work()
+	err := walker.WalkFS(ctx, fsys, root, results, walker.Config[*Result, struct{}]{
+		Enabled:    true,
+		Max:        max,
+		Skipper:    utils.NotImage,
+		Filter:     filter,
+		Archives:   archives,
+		Shard:      shard,
+		Manifest:   manifest,
+		Checkpoint: checkpoint,
+		Progress:   progress,
+		Count:      count,
+		Do: func(args walker.Args[struct{}]) (*Result, error) {
+			switch args.Status {
+			case walker.Modified:
+				classify.DefaultCache.Delete(args.Path)
+			case walker.Moved:
+				classify.DefaultCache.Rename(args.Previous, args.Path)
 			}
-			results <- result
-		}()
-
-		return nil
+			result, err := Collect(args.Context, args.Path, distanceWorker.Promise(args.Path), classifyWorker.Promise(args.Path))
+			if err == nil && result == nil {
+				err = walker.ErrNoResult
+			}
+			return result, err
+		},
+		OnDelete: func(path string) (*Result, error) {
+			classify.DefaultCache.Delete(path)
+			return &Result{Path: path, Deleted: true}, nil
+		},
 	})
 	if err != nil {
 		log.Errorf("error walking the path %s: %v", root, err)
 	}
-	distanceWorker.Work()
-	classifyWorker.Work()
-	wg.Wait()
 	distanceWorker.Close()
 	classifyWorker.Close()
 	distanceWorker.Wait()
 	classifyWorker.Wait()
 }
+
+// Summary is sent as a final "summary" event once a walk finished. Classes counts
+// the results by their most likely class.
+type Summary struct {
+	walker.Snapshot
+	Deleted int            `json:"deleted,omitempty"`
+	Classes map[string]int `json:"classes,omitempty"`
+}
+
+// withProgress turns results into events, interleaving a "progress" event every interval
+// and ending with a "summary" event once results is closed.
+func withProgress(ctx context.Context, results <-chan *Result, progress *walker.Progress, interval time.Duration) iter.Seq[Event] {
+	return func(yield func(Event) bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		summary := Summary{Classes: make(map[string]int)}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !yield(Event{Name: "progress", Data: progress.Snapshot()}) {
+					return
+				}
+			case result, ok := <-results:
+				if !ok {
+					summary.Snapshot = progress.Snapshot()
+					yield(Event{Name: "summary", Data: summary})
+					return
+				}
+				if result == nil {
+					continue
+				}
+				if result.Deleted {
+					summary.Deleted++
+				}
+				if result.Prediction != nil && len(*result.Prediction) > 0 {
+					class, _ := result.Prediction.Max()
+					summary.Classes[class]++
+				}
+				if !yield(Event{Data: result}) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// newFilter reads the include, exclude, min_size, max_size, modified_after and modified_before
+// query parameters. Patterns can be repeated, and times are either RFC 3339 or a plain date.
+func newFilter(query url.Values) (walker.Filter, error) {
+	filter := walker.Filter{
+		Include: query["include"],
+		Exclude: query["exclude"],
+	}
+
+	var err error
+	if s := query.Get("min_size"); s != "" {
+		if filter.MinSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid min_size: %w", err)
+		}
+	}
+	if s := query.Get("max_size"); s != "" {
+		if filter.MaxSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid max_size: %w", err)
+		}
+	}
+	if s := query.Get("modified_after"); s != "" {
+		if filter.ModifiedAfter, err = parseTime(s); err != nil {
+			return filter, fmt.Errorf("invalid modified_after: %w", err)
+		}
+	}
+	if s := query.Get("modified_before"); s != "" {
+		if filter.ModifiedBefore, err = parseTime(s); err != nil {
+			return filter, fmt.Errorf("invalid modified_before: %w", err)
+		}
+	}
+	return filter, filter.Validate()
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"classifier/pkg/walker"
+)
+
+// walkResults runs the walk of params until it is done, and returns its results.
+func walkResults(t *testing.T, params url.Values) []*Result {
+	t.Helper()
+	walk, err := newWalk(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, done := make(chan *Result), make(chan struct{})
+	go func() {
+		walk.run(context.Background(), results, new(walker.Progress))
+		close(done)
+	}()
+	var got []*Result
+	for result := range results {
+		got = append(got, result)
+	}
+	<-done // the manifest is saved once the results are sent
+	return got
+}
+
+func TestWalk_Incremental(t *testing.T) {
+	t.Chdir(t.TempDir()) // manifests are kept in the working directory
+	calls := fakeClassifier(t)
+	folder := testImages(t, 2)
+	params := walkParams(folder, 10)
+	params.Set("incremental", "true")
+
+	if got := walkResults(t, params); len(got) != 2 {
+		t.Fatalf("got %d results, want both images", len(got))
+	}
+	if got := walkResults(t, params); len(got) != 0 {
+		t.Errorf("got %d results, want the unchanged images to be skipped", len(got))
+	}
+
+	// Images that were only measured are still classified by a walk that classifies them.
+	params.Set("classify", "true")
+	got := walkResults(t, params)
+	if len(got) != 2 || calls.Load() != 2 {
+		t.Fatalf("got %d results and %d classifications, want both images classified", len(got), calls.Load())
+	}
+	for _, result := range got {
+		if result.Prediction == nil {
+			t.Errorf("%s was not classified", result.Path)
+		}
+	}
+
+	// As are images measured against another color.
+	params.Del("classify")
+	params.Set("color", "#000000")
+	if got := walkResults(t, params); len(got) != 2 {
+		t.Errorf("got %d results, want both images measured against the other color", len(got))
+	}
+}
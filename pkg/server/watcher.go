@@ -1,8 +1,14 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"iter"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -14,43 +20,143 @@ import (
 
 	"github.com/ellypaws/inkbunny/api"
 
+	"classifier/pkg/classify"
 	"classifier/pkg/lib"
 	"classifier/pkg/utils"
 )
 
+// Watcher streams a Result for every new Inkbunny submission that matched. Clients watching with the same
+// parameters share a single poller, and those joining later first receive its recent results. The poller keeps
+// running for a while after its last client disconnects, so that reconnecting with Last-Event-ID receives
+// the results it missed.
 func Watcher(w http.ResponseWriter, r *http.Request) {
-	sid := r.URL.Query().Get("sid")
-	encryptKey := r.URL.Query().Get("encrypt_key")
-	shouldClassify := r.URL.Query().Get("classify") == "true"
-	refreshRate := r.URL.Query().Get("refresh_rate_seconds")
-
-	crypto, err := lib.NewCrypto(encryptKey)
+	if ResumeEvents(w, r) {
+		return
+	}
+	watch, err := newWatch(r.URL.Query())
+	if errors.Is(err, errNothingToDo) {
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	distanceConfig, err := newDistanceConfig(r, crypto) // we need to open the decrypted file for the distance calculation to work
+	ShareEvents(w, r, watch.key, func(ctx context.Context) iter.Seq[Event] {
+		ch := make(chan *Result)
+		go watch.run(ctx, ch)
+		return results(utils.Iter(ch))
+	})
+}
+
+// watchRequest watches Inkbunny for new submissions, as read from query parameters by newWatch.
+type watchRequest struct {
+	key            string
+	sid            string
+	encryptKey     string
+	interval       time.Duration
+	distanceConfig distanceConfig[*lib.CryptoFile]
+	classifyConfig classifyConfig[*os.File]
+}
+
+// newWatch reads the sid, encrypt_key, classify and refresh_rate_seconds query parameters,
+// along with those of newDistanceConfig.
+func newWatch(query url.Values) (*watchRequest, error) {
+	crypto, err := lib.NewCrypto(query.Get("encrypt_key"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
+	}
+
+	distanceConfig, err := newDistanceConfig(query, crypto) // we need to open the decrypted file for the distance calculation to work
+	if err != nil {
+		return nil, badRequest(err)
 	}
 	classifyConfig := classifyConfig[*os.File]{
-		enabled: shouldClassify,
+		enabled: query.Get("classify") == "true",
 		crypto:  crypto,
 		method:  os.Open, // we expect the files to already be encrypted after calling utils.DownloadEncrypt
 	}
 
 	if !distanceConfig.enabled && !classifyConfig.enabled {
-		return
+		return nil, errNothingToDo
 	}
 
+	interval := defaultWatchInterval
+	if s := query.Get("refresh_rate_seconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			return nil, badRequest(fmt.Errorf("refresh_rate_seconds must be a positive number of seconds, got %q", s))
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	return &watchRequest{
+		key:            watchKey(query),
+		sid:            query.Get("sid"),
+		encryptKey:     query.Get("encrypt_key"),
+		interval:       interval,
+		distanceConfig: distanceConfig,
+		classifyConfig: classifyConfig,
+	}, nil
+}
+
+// watchKey identifies a watch by every parameter that changes its results, so that identical watches can share
+// a poller without the sid or encryption key showing up in logs.
+func watchKey(query url.Values) string {
+	h := sha256.New()
+	for _, param := range []string{"sid", "encrypt_key", "refresh_rate_seconds", "classify", "distance", "color", "threshold", "metric"} {
+		fmt.Fprintf(h, "%s=%q\n", param, query.Get(param))
+	}
+	return "watch:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// defaultWatchInterval is how often Inkbunny is searched when refresh_rate_seconds is not given,
+// and maxWatchBackoff is the longest a watch waits after searches that keep failing.
+const (
+	defaultWatchInterval = 30 * time.Second
+	maxWatchBackoff      = 10 * time.Minute
+)
+
+// poll calls fetch every interval until ctx is done, handing what it fetched to found, which it waits for.
+// Every failure in a row doubles the wait, up to maxWatchBackoff, so that Inkbunny is not polled in a loop
+// while it keeps failing.
+func poll[T any](ctx context.Context, interval time.Duration, fetch func() (T, error), found func(T)) {
+	backoff := interval
+	for ctx.Err() == nil {
+		wait := interval
+		v, err := fetch()
+		if err != nil {
+			wait = backoff
+			backoff = min(2*backoff, max(maxWatchBackoff, interval))
+			log.Error("Error polling Inkbunny", "err", err, "retry", wait)
+		} else {
+			backoff = interval
+			found(v)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// run watches for new submissions until ctx is done, sending a Result for every file that matched.
+// The results channel is closed when it returns.
+func (wr *watchRequest) run(ctx context.Context, results chan<- *Result) {
+	defer close(results)
+	var (
+		sid            = wr.sid
+		encryptKey     = wr.encryptKey
+		distanceConfig = wr.distanceConfig
+		classifyConfig = wr.classifyConfig
+	)
+
 	readSubs := make(map[string][]*Result)
-	distanceWorker := distanceConfig.worker(r.Context())
-	classifyWorker := classifyConfig.worker(r.Context())
+	distanceWorker := distanceConfig.worker(ctx)
+	classifyWorker := classifyConfig.worker(ctx)
 	var mu sync.RWMutex
 	var batch sync.WaitGroup
-	worker := utils.NewWorkerPool(30, func(submission api.Submission) []*Result {
+	worker := utils.NewWorkerPool(settings.Load().Concurrency.Download, func(submission api.Submission) []*Result {
 		defer batch.Done()
 		if !utils.IsImage(submission.FileURLFull) {
 			return nil
@@ -63,56 +169,13 @@ func Watcher(w http.ResponseWriter, r *http.Request) {
 		mu.RUnlock()
 
 		log.Infof("New submission found https://inkbunny.net/s/%s with %d file%s", submission.SubmissionID, len(submission.Files), utils.Plural(len(submission.Files)))
-
-		folder := filepath.Join("inkbunny", submission.Username)
-		err := os.MkdirAll(filepath.Join("inkbunny", submission.Username), 0755)
-		if err != nil {
-			log.Errorf("Error creating folder %s: %v", submission.SubmissionID, err)
-		}
-
-		results := make([]*Result, 0, len(submission.Files))
-		for i, file := range submission.Files {
-			if err = r.Context().Err(); err != nil {
-				break
-			}
-			if !utils.IsImage(file.FileURLFull) {
-				err = fmt.Errorf("file %s is not an image", file.FileURLFull)
-				continue
-			}
-
-			fileName := filepath.Join(folder, filepath.Base(file.FileURLFull))
-			f, err := utils.DownloadEncrypt(r.Context(), classifyConfig.crypto, file.FileURLFull, fileName)
-			if err != nil {
-				log.Errorf("Error downloading file %d %s: %v", i+1, file.FileURLFull, err)
-				continue
-			}
-			f.Close()
-			log.Debugf("Downloaded submission: %v", file.FileURLFull)
-
-			result, err := Collect(r.Context(), fileName, distanceWorker.Promise(fileName), classifyWorker.Promise(fileName))
-			if err != nil {
-				log.Errorf("Error processing submission %s: %v", file.SubmissionID, err)
-				continue
-			}
-			if result == nil {
-				continue
-			}
-			if result.Prediction == nil && result.Color == nil {
-				continue
-			}
-
-			if encryptKey != "" {
-				result.Path = fmt.Sprintf("%s?key=%s", file.FileURLFull, encryptKey)
-			}
-			result.URL = fmt.Sprintf("https://inkbunny.net/s/%s-p%d", file.SubmissionID, i+1)
-			results = append(results, result)
-		}
+		results, _, _ := collectSubmission(ctx, submission, classifyConfig.crypto, encryptKey, &distanceWorker, &classifyWorker)
 
 		mu.Lock()
 		readSubs[submission.SubmissionID] = results
 		mu.Unlock()
 		if len(results) == 0 {
-			log.Warn("No prediction found", "submission", submission.SubmissionID, "error", err)
+			log.Warn("No prediction found", "submission", submission.SubmissionID)
 			return nil
 		}
 		return results
@@ -120,53 +183,99 @@ func Watcher(w http.ResponseWriter, r *http.Request) {
 
 	// Submission watcher, adds new submissions to worker
 	go func() {
-		timeout := 30 * time.Second
-		if t, err := strconv.ParseInt(refreshRate, 10, 64); err != nil && t > 0 {
-			timeout = time.Duration(t) * time.Second
-		}
-		defer func() { worker.Close() }()
-		for r.Context().Err() == nil {
-			select {
-			case <-r.Context().Done():
-				return
-			default:
-			}
-			user := api.Credentials{Sid: sid}
-			request := api.SubmissionSearchRequest{
+		defer worker.Close()
+		user := api.Credentials{Sid: sid}
+		poll(ctx, wr.interval, func() ([]api.Submission, error) {
+			response, err := user.SearchSubmissions(api.SubmissionSearchRequest{
 				SID:    sid,
 				GetRID: true,
-			}
-			response, err := user.SearchSubmissions(request)
+			})
+			utils.CountInkbunnyCall("search", err)
 			if err != nil {
-				log.Errorf("Error searching submissions: %v", err)
+				return nil, fmt.Errorf("error searching submissions: %w", err)
 			}
 			var submissionIDs []string
 			for _, submission := range response.Submissions {
 				submissionIDs = append(submissionIDs, submission.SubmissionID)
 			}
-			details, err := api.Credentials{Sid: sid}.SubmissionDetails(api.SubmissionDetailsRequest{SID: sid, SubmissionIDs: strings.Join(submissionIDs, ",")})
+			details, err := user.SubmissionDetails(api.SubmissionDetailsRequest{SID: sid, SubmissionIDs: strings.Join(submissionIDs, ",")})
+			utils.CountInkbunnyCall("submissions", err)
 			if err != nil {
-				log.Errorf("Error getting submission details: %v", err)
-				continue
+				return nil, fmt.Errorf("error getting submission details: %w", err)
 			}
-			batch.Add(len(details.Submissions))
-			worker.Add(details.Submissions...)
+			return details.Submissions, nil
+		}, func(submissions []api.Submission) {
+			batch.Add(len(submissions))
+			worker.Add(submissions...)
 			batch.Wait()
-			select {
-			case <-r.Context().Done():
-				return
-			case <-time.After(timeout):
-				continue
-			}
-		}
+		})
 	}()
 
 	worker.Work()
 	classifyWorker.Work()
 	distanceWorker.Work()
 	log.Info("Starting watcher", "distance", distanceConfig.enabled, "classify", classifyConfig.enabled)
-	Respond(w, r, utils.Unpack(worker.Iter()))
+	for result := range utils.Unpack(worker.Iter()) {
+		if result == nil {
+			continue
+		}
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+	}
 	classifyWorker.Close()
 	distanceWorker.Close()
 	log.Info("Finished watching for new submissions")
 }
+
+// collectSubmission downloads every image of submission into the inkbunny folder, encrypted with crypto,
+// and collects their results. With encryptKey, result paths are the file URLs along with the key,
+// so that /file can decrypt them. It also returns which file of the submission each result is for, counting
+// from 1, and how many images could not be downloaded or processed.
+func collectSubmission(ctx context.Context, submission api.Submission, crypto *lib.Crypto, encryptKey string, distanceWorker *utils.WorkerPool[string, *float64], classifyWorker *utils.WorkerPool[string, *classify.Prediction]) ([]*Result, []int, int) {
+	folder := filepath.Join("inkbunny", submission.Username)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		log.Errorf("Error creating folder %s: %v", submission.SubmissionID, err)
+	}
+
+	var failed int
+	results := make([]*Result, 0, len(submission.Files))
+	pages := make([]int, 0, len(submission.Files))
+	for i, file := range submission.Files {
+		if ctx.Err() != nil {
+			break
+		}
+		if !utils.IsImage(file.FileURLFull) {
+			continue
+		}
+
+		fileName := filepath.Join(folder, filepath.Base(file.FileURLFull))
+		f, err := utils.DownloadEncrypt(ctx, crypto, file.FileURLFull, fileName)
+		if err != nil {
+			log.Errorf("Error downloading file %d %s: %v", i+1, file.FileURLFull, err)
+			failed++
+			continue
+		}
+		f.Close()
+		log.Debugf("Downloaded submission: %v", file.FileURLFull)
+
+		result, err := Collect(ctx, fileName, distanceWorker.Promise(fileName), classifyWorker.Promise(fileName))
+		if err != nil {
+			log.Errorf("Error processing submission %s: %v", file.SubmissionID, err)
+			failed++
+			continue
+		}
+		if result == nil {
+			continue
+		}
+
+		if encryptKey != "" {
+			result.Path = fmt.Sprintf("%s?key=%s", file.FileURLFull, encryptKey)
+		}
+		result.URL = fmt.Sprintf("https://inkbunny.net/s/%s-p%d", file.SubmissionID, i+1)
+		results = append(results, result)
+		pages = append(pages, i+1)
+	}
+	return results, pages, failed
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNewWatch_RefreshRate(t *testing.T) {
+	for raw, want := range map[string]time.Duration{
+		"":   defaultWatchInterval,
+		"5":  5 * time.Second,
+		"90": 90 * time.Second,
+	} {
+		query := url.Values{"sid": {"abc"}, "classify": {"true"}}
+		if raw != "" {
+			query.Set("refresh_rate_seconds", raw)
+		}
+		watch, err := newWatch(query)
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		if watch.interval != want {
+			t.Errorf("%q: got %v, want %v", raw, watch.interval, want)
+		}
+	}
+	for _, raw := range []string{"0", "-5", "soon"} {
+		query := url.Values{"sid": {"abc"}, "classify": {"true"}, "refresh_rate_seconds": {raw}}
+		var status statusError
+		if _, err := newWatch(query); !errors.As(err, &status) {
+			t.Errorf("%q: got %v, want a bad request", raw, err)
+		}
+	}
+}
+
+func TestPoll_Backoff(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Four failures in a row, a success, then another failure.
+	var calls []time.Time
+	var found int
+	poll(ctx, interval, func() (int, error) {
+		calls = append(calls, time.Now())
+		switch len(calls) {
+		case 5:
+			return 1, nil
+		case 7:
+			cancel()
+		}
+		return 0, errors.New("unavailable")
+	}, func(int) { found++ })
+
+	if len(calls) != 7 || found != 1 {
+		t.Fatalf("got %d polls and %d found, want 7 and 1", len(calls), found)
+	}
+	for i, want := range []time.Duration{interval, 2 * interval, 4 * interval, 8 * interval, interval, interval} {
+		if gap := calls[i+1].Sub(calls[i]); gap < want {
+			t.Errorf("poll %d came %v after the previous one, want at least %v", i+2, gap, want)
+		}
+	}
+	// A success resets the backoff.
+	if gap := calls[6].Sub(calls[5]); gap >= 8*interval {
+		t.Errorf("got %v after a success and a failure, want the backoff to start over", gap)
+	}
+}
@@ -54,6 +54,7 @@ type Config struct {
 	Classify      string
 	EncryptionKey string
 	Classes       string
+	WatchFolder   string
 	Context       context.Context
 }
 
@@ -93,6 +94,7 @@ func New(config Config) (*Bot, error) {
 		config.Output,
 		config.Context,
 		classes,
+		config.WatchFolder,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("error creating Telegram bot: %w", err)
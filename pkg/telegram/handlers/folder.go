@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/telebot.v4"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/telegram/parser"
+	"classifier/pkg/telegram/wrapper"
+	"classifier/pkg/utils"
+	"classifier/pkg/walker"
+)
+
+var filteredFileMessage = parser.Patternf("⚠️ Detected filtered (%.2f%%) in ||%s||", 1.0, "<UNKNOWN>")
+
+// FolderWatcher polls folder for new or modified images, classifies them once their writes
+// have settled and notifies subscribers of the ones above the threshold.
+func (b *Bot) FolderWatcher(folder string) error {
+	if !b.classify {
+		return errors.New("classification not enabled")
+	}
+
+	changes := make(chan walker.Change)
+	go func() {
+		err := walker.Watch(b.context, os.DirFS(folder), folder, changes, walker.WatchConfig{Skipper: utils.NotImage})
+		if err != nil && b.context.Err() == nil {
+			b.logger.Error("Folder watcher stopped", "folder", folder, "error", err)
+		}
+	}()
+
+	b.logger.Info("Starting folder watcher", "folder", folder)
+	for change := range changes {
+		if change.Status == walker.Modified {
+			classify.DefaultCache.Delete(change.Path)
+		}
+		prediction, err := b.predictFile(change.Path)
+		if err != nil {
+			b.logger.Error("Error classifying", "path", change.Path, "error", err)
+			continue
+		}
+
+		confidence := prediction.Clone().Whitelist(b.classes...).Sum()
+		if confidence < b.threshold {
+			class, max := prediction.Max()
+			b.logger.Debug("File not notifiable", "path", change.Path, b.classes, floatString(confidence), "class", class, "confidence", floatString(max))
+			continue
+		}
+
+		b.mu.Lock()
+		err = b.NotifyFile(change.Path, confidence)
+		b.mu.Unlock()
+		if err != nil {
+			b.logger.Errorf("Error notifying users: %v", err)
+		}
+	}
+	return nil
+}
+
+// predictFile classifies a local, unencrypted file, encrypting it first if the bot has a key.
+func (b *Bot) predictFile(path string) (classify.Prediction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	encrypt, err := b.crypto.Encrypt(file)
+	if err != nil {
+		return nil, err
+	}
+	return classify.DefaultCache.Predict(b.context, path, b.crypto.Key(), encrypt)
+}
+
+// NotifyFile sends a notification about a local file to every subscriber.
+// Unlike Notify, it has no report buttons since there is no submission to refer to.
+func (b *Bot) NotifyFile(path string, confidence float64) error {
+	b.logger.Infof("⚠️ Detected filtered (%.2f%%) in %s", confidence*100, path)
+
+	if len(b.Subscribers) == 0 {
+		b.logger.Warn("Cannot send message - no subscribers")
+		return nil
+	}
+	message := filteredFileMessage(confidence*100, path)
+	for id, recipient := range b.Subscribers {
+		if b.context.Err() != nil {
+			b.logger.Warn("Bot is shutting down, stopping message sending")
+			break
+		}
+		if recipient == nil {
+			b.logger.Warnf("%d has no recipient", id)
+			continue
+		}
+		_, err := wrapper.Send(b.Bot, recipient, message, defaultSendOption(nil))
+		if err != nil {
+			notificationsFailed.Inc("file")
+			b.logger.Error("Failed to send message", "error", err, "user_id", id)
+			if errors.Is(err, telebot.ErrBlockedByUser) {
+				b.Blacklist[id] = recipient
+				delete(b.Subscribers, id)
+				continue
+			}
+			return fmt.Errorf("error notifying %d: %w", id, err)
+		}
+		notificationsSent.Inc("file")
+		b.logger.Info("Notified successfully", "user_id", id, "username", recipient.Username, "path", path)
+	}
+	return nil
+}
@@ -21,11 +21,19 @@ var (
 func (b *Bot) Handlers() error {
 	b.Bot.Handle("/start", b.handleSubscribe)
 	b.Bot.Handle("/stop", b.handleUnsubscribe)
+	b.Bot.Handle("/profile", b.handleProfile)
 	b.Bot.Handle(telebot.OnPhoto, b.handleUpload)
 	b.Bot.Handle(&falseButton, b.handleReport(falsePositive))
 	b.Bot.Handle(&undoButton, b.handleReport(undoFalsePositive))
 	b.Bot.Handle(&dangerButton, b.handleReport(danger))
 	b.Bot.Handle(&undoDangerButton, b.handleReport(undoDanger))
+	if b.watchFolder != "" {
+		go func() {
+			if err := b.FolderWatcher(b.watchFolder); err != nil {
+				b.logger.Error("Could not watch folder", "folder", b.watchFolder, "error", err)
+			}
+		}()
+	}
 	return b.Watcher()
 }
 
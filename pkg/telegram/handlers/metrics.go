@@ -0,0 +1,9 @@
+package handlers
+
+import "classifier/pkg/metrics"
+
+var (
+	notificationsSent   = metrics.NewCounter("telegram_notifications_sent_total", "Notifications sent to subscribers.", "kind")
+	notificationsFailed = metrics.NewCounter("telegram_notifications_failed_total", "Notifications that could not be sent to a subscriber.", "kind")
+	reportsTotal        = metrics.NewCounter("telegram_reports_total", "Reports made with the buttons under a notification.", "action")
+)
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ellypaws/inkbunny/api"
+	"gopkg.in/telebot.v4"
+
+	"classifier/pkg/classify"
+	"classifier/pkg/profile"
+	"classifier/pkg/telegram/parser"
+	"classifier/pkg/utils"
+)
+
+// profilesPath is where scanned galleries are cached, the same folder the server uses by default.
+const profilesPath = "profiles"
+
+// profileWorkers is how many submissions are downloaded and classified at once while scanning a gallery.
+const profileWorkers = 10
+
+// profileFlagged is how many flagged submissions are linked in a profile, to stay within the length of a message.
+const profileFlagged = 10
+
+const profileUsage = "Usage: /profile <artist> [most recent submissions] [refresh]"
+
+// handleProfile replies to /profile with how much of the gallery of an artist is flagged for the classes of the bot.
+// The gallery is cached once scanned, and only scanned again with refresh or when more submissions are asked for.
+// Only subscribers can ask for profiles, as scanning a gallery downloads every submission in it.
+func (b *Bot) handleProfile(c telebot.Context) error {
+	chat := c.Chat()
+	if chat == nil {
+		return errors.New("chat cannot be nil")
+	}
+	b.mu.RLock()
+	_, ok := b.Subscribers[chat.ID]
+	b.mu.RUnlock()
+	if !ok {
+		return c.Reply("Only subscribers can ask for profiles, you can use /start to subscribe")
+	}
+	if !b.classify {
+		return c.Reply("Classification is not enabled")
+	}
+
+	args := c.Args()
+	if len(args) == 0 {
+		return c.Reply(profileUsage)
+	}
+	artist := args[0]
+	if err := profile.ValidateArtist(artist); err != nil {
+		return c.Reply(err.Error())
+	}
+	var (
+		recent  int
+		refresh bool
+	)
+	for _, arg := range args[1:] {
+		if arg == "refresh" {
+			refresh = true
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return c.Reply(profileUsage)
+		}
+		recent = n
+	}
+
+	message, err := b.Bot.Reply(c.Message(), fmt.Sprintf("Profiling %s…", artist))
+	if err != nil {
+		return err
+	}
+	b.logger.Info("Profiling artist", "artist", artist, "recent", recent, "refresh", refresh, "by", chat.Username)
+
+	gallery, err := b.profiles.Gallery(b.context, b.profileScanner(), artist, recent, refresh)
+	if err != nil {
+		b.logger.Error("Error profiling artist", "artist", artist, "error", err)
+		_, err = b.Bot.Edit(message, fmt.Sprintf("Could not profile %s: %v", artist, err))
+		return err
+	}
+	_, err = b.Bot.Edit(message, profileText(gallery.Summarize(b.classes, b.threshold)), defaultSendOption(nil))
+	return err
+}
+
+// profileScanner scans galleries by downloading and classifying each image the same way as the watcher.
+func (b *Bot) profileScanner() profile.Scanner {
+	return profile.Scanner{
+		SID:     b.sid,
+		Workers: profileWorkers,
+		Predict: func(ctx context.Context, submission api.Submission) ([]classify.Prediction, []int, int) {
+			var (
+				predictions = make([]classify.Prediction, 0, len(submission.Files))
+				pages       = make([]int, 0, len(submission.Files))
+				failed      int
+			)
+			for i, file := range submission.Files {
+				if ctx.Err() != nil {
+					break
+				}
+				if !utils.IsImage(file.FileURLFull) {
+					continue
+				}
+				prediction := b.predict(predictionRequest{
+					Username:     submission.Username,
+					FileURLFull:  file.FileURLFull,
+					SubmissionID: file.SubmissionID,
+				})
+				if prediction == nil {
+					failed++
+					continue
+				}
+				predictions = append(predictions, prediction.Prediction)
+				pages = append(pages, i+1)
+			}
+			return predictions, pages, failed
+		},
+	}
+}
+
+// profileText formats p as a MarkdownV2 message.
+func profileText(p *profile.Profile) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**Profile of %s**\n", p.Artist)
+	if p.Recent > 0 {
+		fmt.Fprintf(&sb, "Scanned the %d most recent of %d submissions", p.Submissions, p.Total)
+	} else {
+		fmt.Fprintf(&sb, "Scanned %d submission%s", p.Submissions, utils.Plural(p.Submissions))
+	}
+	fmt.Fprintf(&sb, " on %s\n", p.Scanned.Format(time.DateOnly))
+	if p.Failed > 0 {
+		fmt.Fprintf(&sb, "%d image%s could not be classified\n", p.Failed, utils.Plural(p.Failed))
+	}
+
+	fmt.Fprintf(&sb, "\n⚠️ **%d** of %d flagged (%s) for %s at %s or more\n",
+		len(p.Flagged), p.Classified, floatString(p.Rate()), strings.Join(p.FlaggedClasses, ", "), floatString(p.Threshold))
+	if len(p.Flagged) > 0 {
+		fmt.Fprintf(&sb, "First flagged %s, last flagged %s\n", p.FirstFlagged.Format(time.DateOnly), p.LastFlagged.Format(time.DateOnly))
+	}
+
+	if len(p.Classes) > 0 {
+		classes := slices.SortedFunc(maps.Keys(p.Classes), func(a, b string) int {
+			return cmp.Or(cmp.Compare(p.Classes[b], p.Classes[a]), strings.Compare(a, b))
+		})
+		sb.WriteString("\n**Classes**\n")
+		for _, class := range classes {
+			fmt.Fprintf(&sb, "%s: %d\n", class, p.Classes[class])
+		}
+	}
+
+	sb.WriteString("\n**Confidence**\n```\n")
+	for i, n := range p.Confidence {
+		fmt.Fprintf(&sb, "%3d-%3d%% %4d\n", i*100/profile.Buckets, (i+1)*100/profile.Buckets, n)
+	}
+	sb.WriteString("```\n")
+
+	if len(p.Flagged) > 0 {
+		sb.WriteString("\n**Flagged**\n")
+		for _, flag := range p.Flagged[:min(len(p.Flagged), profileFlagged)] {
+			fmt.Fprintf(&sb, "[#%s](%s-p%d) %s %s, %s\n", flag.ID, flag.URL, flag.Page, flag.Class, floatString(flag.Confidence), flag.Created.Format(time.DateOnly))
+		}
+		if more := len(p.Flagged) - profileFlagged; more > 0 {
+			fmt.Fprintf(&sb, "and %d more\n", more)
+		}
+	}
+	return parser.Parse(sb.String())
+}
@@ -15,6 +15,7 @@ import (
 	"gopkg.in/telebot.v4"
 
 	"classifier/pkg/lib"
+	"classifier/pkg/profile"
 	"classifier/pkg/utils"
 )
 
@@ -29,6 +30,8 @@ type Bot struct {
 	classify    bool
 	crypto      *lib.Crypto
 	classes     []string
+	watchFolder string
+	profiles    *profile.Cache
 
 	references map[string]*MessageRef
 
@@ -50,7 +53,7 @@ type MessageWithButton struct {
 
 type Subscribers = map[int64]*telebot.Chat
 
-func New(token string, sid string, refreshRate time.Duration, threshold float64, classify bool, encryptionKey string, output io.Writer, context context.Context, classes []string) (*Bot, error) {
+func New(token string, sid string, refreshRate time.Duration, threshold float64, classify bool, encryptionKey string, output io.Writer, context context.Context, classes []string, watchFolder string) (*Bot, error) {
 	settings := telebot.Settings{
 		Token:  token,
 		Poller: &telebot.LongPoller{Timeout: 10 * time.Second},
@@ -75,6 +78,11 @@ func New(token string, sid string, refreshRate time.Duration, threshold float64,
 		return nil, fmt.Errorf("error creating crypto: %w", err)
 	}
 
+	profiles, err := profile.OpenCache(profilesPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening profiles: %w", err)
+	}
+
 	return &Bot{
 		Bot:         bot,
 		Subscribers: make(Subscribers),
@@ -85,6 +93,8 @@ func New(token string, sid string, refreshRate time.Duration, threshold float64,
 		classify:    classify,
 		crypto:      crypto,
 		classes:     classes,
+		watchFolder: watchFolder,
+		profiles:    profiles,
 
 		references: make(map[string]*MessageRef),
 
@@ -14,6 +14,7 @@ import (
 	"github.com/ellypaws/inkbunny/api"
 
 	"classifier/pkg/classify"
+	"classifier/pkg/health"
 	"classifier/pkg/telegram/parser"
 	"classifier/pkg/telegram/wrapper"
 	"classifier/pkg/utils"
@@ -66,11 +67,21 @@ type Prediction struct {
 	Prediction classify.Prediction `json:"prediction,omitempty"`
 }
 
+// readyInterval is how often Watcher checks whether it is ready to start.
+const readyInterval = 5 * time.Second
+
 func (b *Bot) Watcher() error {
 	if !b.classify {
 		return errors.New("classification not enabled")
 	}
 
+	// Polling before the classifier loaded its model would only fail every submission found in the meantime.
+	b.logger.Info("Waiting for the classifier and Inkbunny to be ready")
+	if err := health.Wait(b.context, readyInterval, health.Classifier(), health.InkbunnySID(b.sid)); err != nil {
+		return fmt.Errorf("waiting for readiness: %w", err)
+	}
+	b.logger.Info("Ready, watching for new submissions")
+
 	predictionWorker := utils.NewWorkerPool(5, b.predict)
 	predictionWorker.Work()
 	defer predictionWorker.Close()
@@ -148,6 +159,7 @@ func (b *Bot) Watcher() error {
 				GetRID: true,
 			}
 			response, err := user.SearchSubmissions(request)
+			utils.CountInkbunnyCall("search", err)
 			if err != nil {
 				b.logger.Errorf("Error searching submissions: %v", err)
 			}
@@ -156,6 +168,7 @@ func (b *Bot) Watcher() error {
 				submissionIDs = append(submissionIDs, submission.SubmissionID)
 			}
 			details, err := api.Credentials{Sid: b.sid}.SubmissionDetails(api.SubmissionDetailsRequest{SID: b.sid, SubmissionIDs: strings.Join(submissionIDs, ",")})
+			utils.CountInkbunnyCall("submissions", err)
 			if err != nil {
 				b.logger.Errorf("Error getting submission details: %v", err)
 				continue
@@ -314,6 +327,7 @@ func (b *Bot) Notify(submission *api.Submission, prediction *Prediction) ([]Mess
 		}
 		reference, err := wrapper.Send(b.Bot, recipient, message, defaultSendOption(button))
 		if err != nil {
+			notificationsFailed.Inc("submission")
 			b.logger.Error("Failed to send message", "error", err, "user_id", id)
 			if errors.Is(err, telebot.ErrBlockedByUser) {
 				b.Blacklist[id] = recipient
@@ -324,6 +338,7 @@ func (b *Bot) Notify(submission *api.Submission, prediction *Prediction) ([]Mess
 			}
 		}
 
+		notificationsSent.Inc("submission")
 		b.logger.Info("Notified successfully", "user_id", id, "username", recipient.Username)
 		references = append(references, MessageWithButton{Message: reference, Button: button})
 	}
@@ -426,6 +441,7 @@ func (b *Bot) handleReport(action state) func(c telebot.Context) error {
 		}
 
 		b.logger.Info("Reported this", "submission", submissionID, "action", action, "user", user.ID, "username", user.Username)
+		reportsTotal.Inc(action.String())
 		switch action {
 		case falsePositive, danger:
 			if refs.Reports == nil {
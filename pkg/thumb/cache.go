@@ -0,0 +1,209 @@
+package thumb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/lib"
+)
+
+// Cache keeps encrypted thumbnails in a folder, removing the least recently used
+// once together they take up more than the maximum size.
+type Cache struct {
+	dir    string
+	crypto *lib.Crypto
+	max    int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*entry
+}
+
+type entry struct {
+	size int64
+	used time.Time
+}
+
+// Key identifies the thumbnail of the given size for the file identified by sum, such as the hash of its contents.
+func Key(sum [sha256.Size]byte, size int) string {
+	return hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(size)
+}
+
+// NewCache opens the cache in dir, creating it if needed, and encrypts every thumbnail with crypto.
+// Thumbnails saved with another key are never read, and are removed like any other unused one.
+func NewCache(dir string, crypto *lib.Crypto, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{dir: dir, crypto: crypto, max: maxBytes, entries: make(map[string]*entry)}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, file.Name())) // left over from a Put that was interrupted
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[file.Name()] = &entry{size: info.Size(), used: info.ModTime()}
+		c.size += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	log.Debug("Loaded thumbnail cache", "dir", dir, "thumbnails", len(c.entries), "bytes", c.size)
+	return c, nil
+}
+
+// name is the file name of key. It depends on the encryption key, so that the content hashes
+// cannot be told from the file names and thumbnails encrypted with another key are never decrypted.
+func (c *Cache) name(key string) string {
+	sum := sha256.Sum256([]byte(c.crypto.Key() + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the thumbnail saved for key, if there is one. A nil Cache has none.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	name := c.name(key)
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		e.used = time.Now()
+	}
+	c.mu.Unlock()
+	if !ok {
+		cacheMisses.Inc()
+		return nil, false
+	}
+
+	data, err := c.read(name)
+	if err != nil {
+		log.Warn("Error reading cached thumbnail", "key", key, "err", err)
+		c.remove(name)
+		cacheMisses.Inc()
+		return nil, false
+	}
+	// Keep the modification time as the last use, so that it survives restarts.
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, name), now, now)
+	cacheHits.Inc()
+	return data, true
+}
+
+func (c *Cache) read(name string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := c.crypto.Decoder(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// Put saves the thumbnail for key, then removes the least recently used thumbnails until the cache fits again.
+// A nil Cache discards it.
+func (c *Cache) Put(key string, data []byte) error {
+	if c == nil {
+		return nil
+	}
+	name := c.name(key)
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	w, err := c.crypto.Encoder(tmp)
+	if err == nil {
+		_, err = io.Copy(w, bytes.NewReader(data))
+		err = errors.Join(err, w.Close())
+	}
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error caching thumbnail: %w", err)
+	}
+	info, err := os.Stat(filepath.Join(c.dir, name))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[name]; ok {
+		c.size -= old.size
+	}
+	c.entries[name] = &entry{size: info.Size(), used: time.Now()}
+	c.size += info.Size()
+	c.evict()
+	return nil
+}
+
+// Size returns how many bytes the cached thumbnails take up.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// evict removes the least recently used thumbnails while the cache is too large. The caller must hold c.mu.
+func (c *Cache) evict() {
+	if c.size <= c.max {
+		return
+	}
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int { return c.entries[a].used.Compare(c.entries[b].used) })
+	for _, name := range names {
+		if c.size <= c.max {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("Error removing cached thumbnail", "name", name, "err", err)
+			continue
+		}
+		c.size -= c.entries[name].size
+		delete(c.entries, name)
+		cacheEvictions.Inc()
+	}
+}
+
+func (c *Cache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		os.Remove(filepath.Join(c.dir, name))
+		c.size -= e.size
+		delete(c.entries, name)
+	}
+}
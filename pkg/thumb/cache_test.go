@@ -0,0 +1,84 @@
+package thumb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"testing"
+	"time"
+
+	"classifier/pkg/lib"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	crypto, err := lib.NewCrypto("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(dir, crypto, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("thumbnail"), 4)
+	key := Key(sha256.Sum256([]byte("image")), 64)
+	if _, ok := c.Get(key); ok {
+		t.Fatal("got a thumbnail from an empty cache")
+	}
+	if err := c.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := c.Get(key)
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v, want %q", got, ok, data)
+	}
+
+	stored, err := os.ReadFile(dir + "/" + c.name(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("thumbnail")) {
+		t.Error("thumbnail was stored unencrypted")
+	}
+
+	other, err := lib.NewCrypto("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewCache(dir, other, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get(key); ok {
+		t.Error("got a thumbnail encrypted with another key")
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	c, err := NewCache(t.TempDir(), nil, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 10)
+	for _, key := range []string{"a", "b"} {
+		if err := c.Put(key, data); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Get("a") // a is now used more recently than b
+	time.Sleep(time.Millisecond)
+	if err := c.Put("c", data); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("Get(%q) = %v, want %v", key, ok, want)
+		}
+	}
+	if size := c.Size(); size != 20 {
+		t.Errorf("got size %d, want 20", size)
+	}
+}
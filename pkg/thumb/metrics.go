@@ -0,0 +1,9 @@
+package thumb
+
+import "classifier/pkg/metrics"
+
+var (
+	cacheHits      = metrics.NewCounter("thumbnail_cache_hits_total", "Thumbnails served from the cache.")
+	cacheMisses    = metrics.NewCounter("thumbnail_cache_misses_total", "Thumbnails that had to be generated.")
+	cacheEvictions = metrics.NewCounter("thumbnail_cache_evictions_total", "Thumbnails removed to keep the cache within its size.")
+)
@@ -0,0 +1,92 @@
+// Package thumb makes small previews of images.
+package thumb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Quality is the JPEG quality thumbnails are encoded with.
+const Quality = 80
+
+// MaxPixels is the most pixels an image may have to be decoded, since a small file can declare
+// dimensions that take gigabytes to decode.
+const MaxPixels = 50_000_000
+
+// ErrTooLarge is returned by Encode for images with more than MaxPixels pixels.
+var ErrTooLarge = fmt.Errorf("image has more than %d pixels", MaxPixels)
+
+// Format is an encoding thumbnails can be made in.
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatWebP Format = "webp" // WebP thumbnails are lossless, so they keep transparency but are larger.
+)
+
+// ContentType is the MIME type of thumbnails in the format.
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Resize scales img down to fit within size×size, keeping its aspect ratio.
+// Images that already fit are returned as they are.
+func Resize(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w > h {
+		w, h = size, max(1, h*size/w)
+	} else {
+		w, h = max(1, w*size/h), size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// JPEG decodes the image in r and writes it to w as a JPEG that fits within size×size.
+func JPEG(w io.Writer, r io.Reader, size int) error {
+	return Encode(w, r, size, FormatJPEG)
+}
+
+// Encode decodes the image in r and writes it to w in format, fitting within size×size.
+// Images with more than MaxPixels pixels are rejected with ErrTooLarge before they are decoded.
+func Encode(w io.Writer, r io.Reader, size int, format Format) error {
+	if size < 1 {
+		return errors.New("thumbnail size must be positive")
+	}
+	// The header read for the dimensions is kept to decode the image from the start.
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return fmt.Errorf("%w: %dx%d", ErrTooLarge, config.Width, config.Height)
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return err
+	}
+	switch format {
+	case FormatJPEG:
+		return jpeg.Encode(w, Resize(img, size), &jpeg.Options{Quality: Quality})
+	case FormatWebP:
+		return nativewebp.Encode(w, Resize(img, size), nil)
+	default:
+		return fmt.Errorf("unknown thumbnail format %q", format)
+	}
+}
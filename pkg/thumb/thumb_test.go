@@ -0,0 +1,89 @@
+package thumb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		w, h, size   int
+		wantW, wantH int
+	}{
+		{400, 200, 100, 100, 50},
+		{200, 400, 100, 50, 100},
+		{50, 20, 100, 50, 20},
+		{1000, 1, 100, 100, 1},
+	}
+	for _, tt := range tests {
+		got := Resize(image.NewRGBA(image.Rect(0, 0, tt.w, tt.h)), tt.size).Bounds()
+		if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+			t.Errorf("Resize(%dx%d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.size, got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestJPEG(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, image.NewRGBA(image.Rect(0, 0, 300, 150))); err != nil {
+		t.Fatal(err)
+	}
+	var dst bytes.Buffer
+	if err := JPEG(&dst, &src, 64); err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := image.Decode(&dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || img.Bounds().Dx() != 64 || img.Bounds().Dy() != 32 {
+		t.Errorf("got a %dx%d %s, want a 64x32 jpeg", img.Bounds().Dx(), img.Bounds().Dy(), format)
+	}
+}
+
+func TestEncode_WebP(t *testing.T) {
+	var src bytes.Buffer
+	if err := png.Encode(&src, image.NewRGBA(image.Rect(0, 0, 150, 300))); err != nil {
+		t.Fatal(err)
+	}
+	var dst bytes.Buffer
+	if err := Encode(&dst, &src, 64, FormatWebP); err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := image.Decode(&dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "webp" || img.Bounds().Dx() != 32 || img.Bounds().Dy() != 64 {
+		t.Errorf("got a %dx%d %s, want a 32x64 webp", img.Bounds().Dx(), img.Bounds().Dy(), format)
+	}
+	if err := Encode(&dst, &src, 64, "gif"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+// hugePNG is the start of a PNG that declares itself w×h, without any pixel data.
+func hugePNG(w, h uint32) []byte {
+	chunk := binary.BigEndian.AppendUint32([]byte("IHDR"), w)
+	chunk = binary.BigEndian.AppendUint32(chunk, h)
+	chunk = append(chunk, 8, 6, 0, 0, 0) // 8-bit RGBA
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(chunk)-4))
+	data = append(data, chunk...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(chunk))
+}
+
+func TestEncode_TooLarge(t *testing.T) {
+	var dst bytes.Buffer
+	if err := Encode(&dst, bytes.NewReader(hugePNG(50000, 50000)), 64, FormatJPEG); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if dst.Len() != 0 {
+		t.Errorf("got %d bytes written, want none", dst.Len())
+	}
+}
@@ -15,8 +15,8 @@ import (
 	"classifier/pkg/lib"
 )
 
-// DownloadEncrypt downloads a file from the given URL and saves it to the specified folder.
-// After saving the file, it immediately opens it using [lib.Crypto.Open].
+// DownloadEncrypt downloads a file from the given URL and saves it to the specified folder, encrypted in the
+// format of [lib.Crypto.Encoder]. After saving the file, it immediately opens it using [lib.Crypto.Open].
 // If the file already exists, it calls [lib.Crypto.Open].
 func DownloadEncrypt(ctx context.Context, crypto *lib.Crypto, link, fileName string) (*lib.CryptoFile, error) {
 	u, err := url.Parse(link)
@@ -33,8 +33,10 @@ func DownloadEncrypt(ctx context.Context, crypto *lib.Crypto, link, fileName str
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 
+	downloadsTotal.Inc()
 	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
 	if err != nil {
+		downloadFailures.Inc()
 		return nil, fmt.Errorf("error downloading file: %w", err)
 	}
 	defer resp.Body.Close()
@@ -53,9 +55,15 @@ func DownloadEncrypt(ctx context.Context, crypto *lib.Crypto, link, fileName str
 		return nil, fmt.Errorf("error creating encoder: %w", err)
 	}
 
-	_, err = io.Copy(encoder, resp.Body)
+	n, err := io.Copy(encoder, resp.Body)
+	downloadBytes.Add(float64(n))
+	if err == nil {
+		err = encoder.Close() // seals the last chunk, without which the file reads as truncated
+	}
 	if err != nil {
 		out.Close()
+		os.Remove(out.Name())
+		downloadFailures.Inc()
 		return nil, fmt.Errorf("error writing to file: %w", err)
 	}
 
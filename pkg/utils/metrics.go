@@ -0,0 +1,23 @@
+package utils
+
+import "classifier/pkg/metrics"
+
+var (
+	downloadsTotal   = metrics.NewCounter("downloads_total", "Files downloaded.")
+	downloadBytes    = metrics.NewCounter("download_bytes_total", "Bytes downloaded.")
+	downloadFailures = metrics.NewCounter("download_failures_total", "Downloads that failed.")
+
+	queueDepth    = metrics.NewGauge("worker_pool_queue_depth", "Jobs waiting for a worker across every worker pool.")
+	activeWorkers = metrics.NewGauge("worker_pool_active_workers", "Workers busy with a job across every worker pool.")
+
+	inkbunnyCalls = metrics.NewCounter("inkbunny_api_calls_total", "Calls made to the Inkbunny API.", "method", "result")
+)
+
+// CountInkbunnyCall records a call to the Inkbunny API method that returned err.
+func CountInkbunnyCall(method string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	inkbunnyCalls.Inc(method, result)
+}
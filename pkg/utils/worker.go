@@ -66,8 +66,11 @@ func (p *WorkerPool[J, R]) do() {
 	for range p.workers {
 		go func() {
 			for req := range p.jobs {
+				queueDepth.Dec()
 				workSet.Add(1)
+				activeWorkers.Inc()
 				r := p.work(req.job)
+				activeWorkers.Dec()
 				go func() {
 					select {
 					case p.responses <- r:
@@ -92,7 +95,7 @@ func (p *WorkerPool[J, R]) do() {
 // Add adds jobs to the worker pool. It blocks if the pool is full.
 func (p *WorkerPool[J, R]) Add(j ...J) {
 	for _, job := range j {
-		p.jobs <- jobRequest[J, R]{job: job}
+		p.enqueue(jobRequest[J, R]{job: job})
 	}
 }
 
@@ -100,21 +103,21 @@ func (p *WorkerPool[J, R]) Add(j ...J) {
 // The promise channel is buffered with one element.
 func (p *WorkerPool[J, R]) Promise(j J) <-chan R {
 	promiseCh := make(chan R)
-	go func() { p.jobs <- jobRequest[J, R]{job: j, promise: promiseCh} }()
+	go p.enqueue(jobRequest[J, R]{job: j, promise: promiseCh})
 	return promiseCh
 }
 
 // AddIter adds jobs to the worker pool from an iterator. It blocks if the pool is full.
 func (p *WorkerPool[J, R]) AddIter(j iter.Seq[J]) {
 	for job := range j {
-		p.jobs <- jobRequest[J, R]{job: job}
+		p.enqueue(jobRequest[J, R]{job: job})
 	}
 }
 
 // AddAndClose adds jobs to the worker pool and calls Close it after all jobs are added. It blocks if the pool is full.
 func (p *WorkerPool[J, R]) AddAndClose(j ...J) {
 	for _, job := range j {
-		p.jobs <- jobRequest[J, R]{job: job}
+		p.enqueue(jobRequest[J, R]{job: job})
 	}
 	p.Close()
 }
@@ -122,11 +125,17 @@ func (p *WorkerPool[J, R]) AddAndClose(j ...J) {
 // AddAndCloseIter adds jobs to the worker pool from an iterator and closes it after all jobs are added.
 func (p *WorkerPool[J, R]) AddAndCloseIter(j iter.Seq[J]) {
 	for job := range j {
-		p.jobs <- jobRequest[J, R]{job: job}
+		p.enqueue(jobRequest[J, R]{job: job})
 	}
 	p.Close()
 }
 
+// enqueue sends req to the workers, counting it as queued until one of them picks it up.
+func (p *WorkerPool[J, R]) enqueue(req jobRequest[J, R]) {
+	queueDepth.Inc()
+	p.jobs <- req
+}
+
 // Close closes the worker pool. It should be called after all jobs are added.
 // All Add methods panic when Close is called.
 func (p *WorkerPool[_, _]) Close() {
@@ -0,0 +1,137 @@
+package walker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"classifier/pkg/utils"
+)
+
+// checkpointInterval is how often Advance writes a checkpoint loaded from a file back to disk.
+const checkpointInterval = 5 * time.Second
+
+// Checkpoint records how far a walk over Root got, so that an interrupted walk resumes
+// after the last path it completed instead of starting from zero. Because WalkFS visits
+// files in a fixed order, Last is a watermark: every file up to and including it was processed.
+type Checkpoint struct {
+	Root  string `json:"root"`
+	Shard Shard  `json:"shard,omitzero"`
+	Last  string `json:"last"`
+
+	mu    sync.Mutex
+	name  string
+	saved time.Time
+}
+
+// statePath returns where the state for root is kept inside folder, with one file per shard and variant.
+func statePath(folder, root string, shard Shard, variant string) string {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	sum := sha256.Sum256([]byte(root))
+	name := hex.EncodeToString(sum[:8])
+	if shard.Count > 1 {
+		name += "." + strconv.Itoa(shard.Index) + "-of-" + strconv.Itoa(shard.Count)
+	}
+	if variant != "" {
+		name += "." + variant
+	}
+	return filepath.Join(folder, name+".json")
+}
+
+// CheckpointPath returns the default location of the checkpoint for root, shard and filter.
+// Walks with other filters keep their own checkpoint, as the files they visited before it are not the same.
+func CheckpointPath(root string, shard Shard, filter Filter) string {
+	return statePath("checkpoints", root, shard, filter.key())
+}
+
+// LoadCheckpoint reads the checkpoint stored at name. A missing file returns an empty Checkpoint.
+// The returned checkpoint remembers name, and is saved there periodically while a walk advances it.
+func LoadCheckpoint(name, root string, shard Shard) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{Root: root, Shard: shard}
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		checkpoint.name = name
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err = utils.DecodeAndClose[*Checkpoint](f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint %s: %w", name, err)
+	}
+	if checkpoint.Root != root || checkpoint.Shard != shard {
+		return nil, fmt.Errorf("checkpoint %s belongs to %q shard %q, not %q shard %q", name, checkpoint.Root, checkpoint.Shard, root, shard)
+	}
+	checkpoint.name = name
+	return checkpoint, nil
+}
+
+// Resume returns the path the next walk should continue after, or an empty string to start over.
+func (c *Checkpoint) Resume() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Last
+}
+
+// Advance marks every file up to and including path as processed.
+func (c *Checkpoint) Advance(path string) {
+	c.mu.Lock()
+	c.Last = path
+	save := c.name != "" && time.Since(c.saved) >= checkpointInterval
+	c.mu.Unlock()
+	if save {
+		if err := c.Save(); err != nil {
+			log.Warn("Error saving checkpoint", "name", c.name, "err", err)
+		}
+	}
+}
+
+// Reset clears the checkpoint once a walk completed, so that the next walk starts over.
+func (c *Checkpoint) Reset() {
+	c.mu.Lock()
+	c.Last = ""
+	c.mu.Unlock()
+}
+
+// Save writes the checkpoint back to the file it was loaded from, if any.
+func (c *Checkpoint) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.name == "" {
+		return nil
+	}
+	c.saved = time.Now()
+	return saveState(c.name, c)
+}
+
+// saveState writes v to name, creating its parent folder if needed. It is written to a temporary file first,
+// so that a crash while saving leaves the previous state intact.
+func saveState(name string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = errors.Join(utils.Encode(f, v), f.Close())
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package walker
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/charmbracelet/log"
+)
+
+// IgnoreFile is the name of the gitignore-style file honored in every walked directory.
+const IgnoreFile = ".classifierignore"
+
+// Filter narrows down the files a walk visits. The zero value lets every file through.
+type Filter struct {
+	// Include, when not empty, only lets through files matching at least one doublestar pattern.
+	// Patterns are matched against the slash separated path relative to the walked root.
+	Include []string
+	// Exclude drops files matching any doublestar pattern, relative to the walked root.
+	Exclude []string
+
+	MinSize int64 // MinSize drops files smaller than this many bytes.
+	MaxSize int64 // MaxSize, when positive, drops files larger than this many bytes.
+
+	ModifiedAfter  time.Time // ModifiedAfter drops files last modified before this time.
+	ModifiedBefore time.Time // ModifiedBefore drops files last modified after this time.
+}
+
+// Validate reports the first malformed pattern or inverted window.
+func (f Filter) Validate() error {
+	for _, pattern := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return errors.New("minimum size is larger than maximum size")
+	}
+	if !f.ModifiedAfter.IsZero() && !f.ModifiedBefore.IsZero() && f.ModifiedAfter.After(f.ModifiedBefore) {
+		return errors.New("modified after is later than modified before")
+	}
+	return nil
+}
+
+// key identifies the filter in the name of a checkpoint, or is empty for the zero value.
+func (f Filter) key() string {
+	if len(f.Include) == 0 && len(f.Exclude) == 0 && f.MinSize == 0 && f.MaxSize == 0 && f.ModifiedAfter.IsZero() && f.ModifiedBefore.IsZero() {
+		return ""
+	}
+	h := sha256.New()
+	for _, patterns := range [][]string{f.Include, f.Exclude} {
+		for _, pattern := range patterns {
+			fmt.Fprintf(h, "%q,", pattern)
+		}
+		h.Write([]byte{0})
+	}
+	fmt.Fprintf(h, "%d,%d,%d,%d", f.MinSize, f.MaxSize, f.ModifiedAfter.UnixNano(), f.ModifiedBefore.UnixNano())
+	return hex.EncodeToString(h.Sum(nil)[:4])
+}
+
+// Match reports whether the file at rel, relative to the walked root, passes the filter.
+func (f Filter) Match(rel string, info fs.FileInfo) bool {
+	rel = filepath.ToSlash(rel)
+	if len(f.Include) > 0 && !matchAny(f.Include, rel) {
+		return false
+	}
+	if matchAny(f.Exclude, rel) {
+		return false
+	}
+	if info == nil {
+		return true
+	}
+	if info.Size() < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	if !f.ModifiedAfter.IsZero() && info.ModTime().Before(f.ModifiedAfter) {
+		return false
+	}
+	if !f.ModifiedBefore.IsZero() && info.ModTime().After(f.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := doublestar.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreRule is a single line of an ignore file.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	ok, _ := doublestar.Match(r.pattern, rel)
+	return ok
+}
+
+// parseIgnore parses gitignore-style lines. Patterns without a slash match at any depth,
+// while patterns containing one are anchored to the folder of the ignore file.
+func parseIgnore(scanner *bufio.Scanner) []ignoreRule {
+	var rules []ignoreRule
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ignorer holds the rules of every ignore file found so far, keyed by the folder they were found in.
+type ignorer struct {
+	fsys  fs.FS
+	mu    sync.RWMutex
+	rules map[string][]ignoreRule
+}
+
+// load reads the ignore file in dir, if there is one. It must be called before the contents of dir are visited.
+func (i *ignorer) load(dir string) {
+	f, err := i.fsys.Open(path.Join(dir, IgnoreFile))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warnf("could not read %s in %s: %v", IgnoreFile, dir, err)
+		}
+		return
+	}
+	defer f.Close()
+	rules := parseIgnore(bufio.NewScanner(f))
+	if len(rules) == 0 {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.rules == nil {
+		i.rules = make(map[string][]ignoreRule)
+	}
+	i.rules[path.Clean(dir)] = rules
+}
+
+// ignored reports whether name, a slash separated path inside the walked file system,
+// is ignored by the ignore files of its parent folders.
+// Deeper ignore files take precedence, and later lines win over earlier ones.
+func (i *ignorer) ignored(name string, isDir bool) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if len(i.rules) == 0 {
+		return false
+	}
+	name = path.Clean(name)
+	var dirs []string
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == "." || dir == "/" {
+			break
+		}
+	}
+
+	var ignored bool
+	for j := len(dirs) - 1; j >= 0; j-- {
+		rules, ok := i.rules[dirs[j]]
+		if !ok {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, dirs[j]), "/")
+		if dirs[j] == "." {
+			rel = name
+		}
+		for _, rule := range rules {
+			if rule.match(rel, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
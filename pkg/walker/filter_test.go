@@ -0,0 +1,81 @@
+package walker
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestIgnorer(t *testing.T) {
+	var ignore ignorer
+	ignore.rules = map[string][]ignoreRule{
+		"root":          parseIgnore(bufio.NewScanner(strings.NewReader("# comment\n*.gif\nraw/\n/top.png\n"))),
+		"root/keep":     parseIgnore(bufio.NewScanner(strings.NewReader("!*.gif\n"))),
+		"root/a/nested": parseIgnore(bufio.NewScanner(strings.NewReader("**/drafts/**\n"))),
+	}
+
+	tests := []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"root/image.png", false, false},
+		{"root/image.gif", false, true},
+		{"root/deep/image.gif", false, true},
+		{"root/keep/image.gif", false, false},
+		{"root/raw", true, true},
+		{"root/raw", false, false},
+		{"root/top.png", false, true},
+		{"root/a/top.png", false, false},
+		{"root/a/nested/drafts/x.png", false, true},
+		{"root/a/drafts/x.png", false, false},
+	}
+	for _, tt := range tests {
+		if got := ignore.ignored(tt.name, tt.isDir); got != tt.ignored {
+			t.Errorf("ignored(%q, %v) = %v, want %v", tt.name, tt.isDir, got, tt.ignored)
+		}
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	filter := Filter{
+		Include: []string{"**/*.png", "**/*.jpg"},
+		Exclude: []string{"thumbs/**"},
+	}
+	tests := []struct {
+		rel   string
+		match bool
+	}{
+		{"a.png", true},
+		{"nested/b.jpg", true},
+		{"c.gif", false},
+		{"thumbs/a.png", false},
+	}
+	for _, tt := range tests {
+		if got := filter.Match(tt.rel, nil); got != tt.match {
+			t.Errorf("Match(%q) = %v, want %v", tt.rel, got, tt.match)
+		}
+	}
+}
+
+func TestCheckpointPath_Filter(t *testing.T) {
+	shard := Shard{Index: 1, Count: 2}
+	base := CheckpointPath("root", shard, Filter{})
+	paths := map[string]bool{base: true}
+	for _, filter := range []Filter{
+		{Include: []string{"a/**"}},
+		{Exclude: []string{"a/**"}},
+		{Include: []string{"a/**", "b/**"}},
+		{Include: []string{"a/**,b/**"}},
+		{MinSize: 10},
+	} {
+		path := CheckpointPath("root", shard, filter)
+		if paths[path] {
+			t.Errorf("filter %+v shares the checkpoint %s with another filter", filter, path)
+		}
+		paths[path] = true
+		if again := CheckpointPath("root", shard, filter); again != path {
+			t.Errorf("got %s and %s for the same filter", path, again)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package walker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"classifier/pkg/utils"
+)
+
+// Status describes how a file compares to what a Manifest last recorded for it.
+type Status int
+
+const (
+	New       Status = iota // New means the file was never recorded.
+	Unchanged               // Unchanged means size, mtime or hash matched the recorded entry.
+	Modified                // Modified means the file was recorded under the same path with different content.
+	Moved                   // Moved means the content was recorded under another path that no longer exists.
+)
+
+func (s Status) String() string {
+	switch s {
+	case New:
+		return "new"
+	case Unchanged:
+		return "unchanged"
+	case Modified:
+		return "modified"
+	case Moved:
+		return "moved"
+	default:
+		return ""
+	}
+}
+
+// Entry is what a Manifest stores for each file.
+type Entry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// Manifest persists the size, modification time and content hash of every file
+// visited under Root, so that a later walk can skip files that did not change.
+// Entries are keyed by their slash separated path relative to Root,
+// and are only committed once a file has been processed successfully.
+type Manifest struct {
+	Root    string            `json:"root"`
+	Entries map[string]*Entry `json:"entries"`
+
+	mu     sync.Mutex
+	seen   map[string]struct{}
+	hashes map[string]string
+}
+
+// NewManifest returns an empty Manifest for root.
+func NewManifest(root string) *Manifest {
+	return &Manifest{
+		Root:    root,
+		Entries: make(map[string]*Entry),
+	}
+}
+
+// ManifestPath returns the default location of the manifest for root, shard and filter, and for config,
+// which describes what the walk does with every file, such as the stages it runs and their settings.
+// Each shard keeps its own manifest, as shards never share a path. So do walks with another filter or config:
+// a file is only unchanged for walks that would do the same with it, so that a walk that only measured
+// distances does not keep a later one from classifying.
+func ManifestPath(root string, shard Shard, filter Filter, config string) string {
+	variant := filter.key()
+	if config != "" {
+		sum := sha256.Sum256([]byte(config))
+		variant = strings.TrimPrefix(variant+"."+hex.EncodeToString(sum[:4]), ".")
+	}
+	return statePath("manifests", root, shard, variant)
+}
+
+// LoadManifest reads the manifest stored at name. A missing file returns an empty Manifest for root.
+func LoadManifest(name, root string) (*Manifest, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewManifest(root), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := utils.DecodeAndClose[*Manifest](f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifest %s: %w", name, err)
+	}
+	if manifest.Root != root {
+		return nil, fmt.Errorf("manifest %s belongs to %q, not %q", name, manifest.Root, root)
+	}
+	if manifest.Entries == nil {
+		manifest.Entries = make(map[string]*Entry)
+	}
+	return manifest, nil
+}
+
+// Save writes the manifest to name, creating its parent folder if needed.
+// A crash while saving leaves the previous manifest intact.
+func (m *Manifest) Save(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return saveState(name, m)
+}
+
+// See marks path as present for the current walk so that it is not reported by Deleted.
+func (m *Manifest) See(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen == nil {
+		m.seen = make(map[string]struct{})
+	}
+	m.seen[path] = struct{}{}
+}
+
+// Check compares the file at path inside fsys against its recorded entry. Unchanged files are
+// recognized by size and mtime without reading them; otherwise the content is hashed.
+// The returned entry should be handed to Commit once the file has been processed.
+// For Moved files, previous holds the path the content was recorded under.
+func (m *Manifest) Check(fsys fs.FS, path string, info fs.FileInfo) (status Status, previous string, entry *Entry, err error) {
+	m.mu.Lock()
+	recorded, ok := m.Entries[path]
+	m.mu.Unlock()
+	if ok && recorded.Hash != "" && recorded.Size == info.Size() && recorded.ModTime.Equal(info.ModTime()) {
+		return Unchanged, "", recorded, nil
+	}
+
+	hash, err := hashFile(fsys, path)
+	if err != nil {
+		return New, "", nil, err
+	}
+	entry = &Entry{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+
+	if ok {
+		if recorded.Hash == hash {
+			m.Commit(path, entry)
+			return Unchanged, "", entry, nil
+		}
+		return Modified, "", entry, nil
+	}
+
+	m.mu.Lock()
+	previous, found := m.index()[hash]
+	m.mu.Unlock()
+	if found && previous != path {
+		if _, err := fs.Stat(fsys, previous); errors.Is(err, fs.ErrNotExist) {
+			return Moved, previous, entry, nil
+		}
+	}
+	return New, "", entry, nil
+}
+
+// Commit records entry for path. When the content moved, the previous path is forgotten.
+func (m *Manifest) Commit(path string, entry *Entry) {
+	if entry == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous, ok := m.index()[entry.Hash]; ok && previous != path {
+		if _, exists := m.seen[previous]; !exists {
+			delete(m.Entries, previous)
+		}
+	}
+	if old, ok := m.Entries[path]; ok && old.Hash != entry.Hash {
+		delete(m.hashes, old.Hash)
+	}
+	m.Entries[path] = entry
+	m.hashes[entry.Hash] = path
+}
+
+// Deleted removes and returns every recorded path that was not seen during the current walk.
+// It should only be called after a walk that visited the whole root.
+func (m *Manifest) Deleted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted []string
+	for path, entry := range m.Entries {
+		if _, ok := m.seen[path]; ok {
+			continue
+		}
+		deleted = append(deleted, path)
+		delete(m.Entries, path)
+		if m.hashes != nil && m.hashes[entry.Hash] == path {
+			delete(m.hashes, entry.Hash)
+		}
+	}
+	m.seen = nil
+	return deleted
+}
+
+// index lazily builds the hash to path lookup. The caller must hold m.mu.
+func (m *Manifest) index() map[string]string {
+	if m.hashes == nil {
+		m.hashes = make(map[string]string, len(m.Entries))
+		for path, entry := range m.Entries {
+			m.hashes[entry.Hash] = path
+		}
+	}
+	return m.hashes
+}
+
+func hashFile(fsys fs.FS, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,121 @@
+package walker
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestManifest_Check(t *testing.T) {
+	root := t.TempDir()
+	fsys := os.DirFS(root)
+	write := func(name, content string) fs.FileInfo {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	manifest := NewManifest(root)
+	info := write("a.png", "first")
+	status, _, entry, err := manifest.Check(fsys, "a.png", info)
+	if err != nil || status != New {
+		t.Fatalf("expected new, got %s %v", status, err)
+	}
+	manifest.Commit("a.png", entry)
+
+	if status, _, _, _ = manifest.Check(fsys, "a.png", info); status != Unchanged {
+		t.Fatalf("expected unchanged, got %s", status)
+	}
+
+	write("a.png", "second")
+	if err := os.Chtimes(filepath.Join(root, "a.png"), time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(filepath.Join(root, "a.png"))
+	status, _, entry, _ = manifest.Check(fsys, "a.png", info)
+	if status != Modified {
+		t.Fatalf("expected modified, got %s", status)
+	}
+	manifest.Commit("a.png", entry)
+
+	if err := os.Rename(filepath.Join(root, "a.png"), filepath.Join(root, "b.png")); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(filepath.Join(root, "b.png"))
+	status, previous, entry, _ := manifest.Check(fsys, "b.png", info)
+	if status != Moved || previous != "a.png" {
+		t.Fatalf("expected moved from a.png, got %s %q", status, previous)
+	}
+	manifest.See("b.png")
+	manifest.Commit("b.png", entry)
+
+	info = write("c.png", "third")
+	_, _, entry, _ = manifest.Check(fsys, "c.png", info)
+	manifest.Commit("c.png", entry)
+	if err := os.Remove(filepath.Join(root, "c.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted := manifest.Deleted(); !slices.Equal(deleted, []string{"c.png"}) {
+		t.Fatalf("expected c.png to be deleted, got %v", deleted)
+	}
+	if _, ok := manifest.Entries["a.png"]; ok {
+		t.Fatal("expected a.png to be forgotten after moving")
+	}
+}
+
+func TestManifestPath(t *testing.T) {
+	shard := Shard{Index: 1, Count: 2}
+	paths := make(map[string]bool)
+	for _, variant := range []struct {
+		filter Filter
+		config string
+	}{
+		{Filter{}, ""},
+		{Filter{}, "distance"},
+		{Filter{}, "distance;classify"},
+		{Filter{MinSize: 10}, "distance"},
+		{Filter{MinSize: 10}, ""},
+	} {
+		path := ManifestPath("root", shard, variant.filter, variant.config)
+		if paths[path] {
+			t.Errorf("%+v shares the manifest %s with another walk", variant, path)
+		}
+		paths[path] = true
+		if again := ManifestPath("root", shard, variant.filter, variant.config); again != path {
+			t.Errorf("got %s and %s for the same walk", path, again)
+		}
+	}
+}
+
+func TestManifest_Save(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "manifests", "root.json")
+	manifest := NewManifest("root")
+	manifest.Commit("a.png", &Entry{Size: 1, Hash: "a"})
+	for range 2 {
+		if err := manifest.Save(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := LoadManifest(name, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := loaded.Entries["a.png"]; entry == nil || entry.Hash != "a" {
+		t.Errorf("got %+v, want the saved entry", loaded.Entries)
+	}
+	// The manifest is written next to its file and renamed over it, leaving nothing else behind.
+	if files, _ := os.ReadDir(filepath.Dir(name)); len(files) != 1 {
+		t.Errorf("got %d files, want only the manifest", len(files))
+	}
+}
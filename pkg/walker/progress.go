@@ -0,0 +1,59 @@
+package walker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Progress counts the files of a running walk. It is safe to read with Snapshot
+// from another goroutine while WalkFS updates it.
+type Progress struct {
+	total      atomic.Int64
+	discovered atomic.Int64
+	processed  atomic.Int64
+	skipped    atomic.Int64
+	failed     atomic.Int64
+	started    atomic.Int64
+}
+
+// Snapshot is the state of a Progress at one point in time.
+// Processed includes files that had no result, such as images below the threshold,
+// while Failed only counts files that could not be processed.
+// Elapsed and ETA are in seconds, and Throughput is in files per second.
+type Snapshot struct {
+	// Total is the number of files found by the pre-scan, or 0 when Config.Count is false.
+	Total      int64   `json:"total,omitempty"`
+	Discovered int64   `json:"discovered"`
+	Processed  int64   `json:"processed"`
+	Skipped    int64   `json:"skipped"`
+	Failed     int64   `json:"failed"`
+	Elapsed    float64 `json:"elapsed"`
+	Throughput float64 `json:"throughput"`
+	ETA        float64 `json:"eta,omitempty"`
+}
+
+func (p *Progress) start() {
+	p.started.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+// Snapshot returns the current counts along with the throughput and, when the total is known, the ETA.
+func (p *Progress) Snapshot() Snapshot {
+	s := Snapshot{
+		Total:      p.total.Load(),
+		Discovered: p.discovered.Load(),
+		Processed:  p.processed.Load(),
+		Skipped:    p.skipped.Load(),
+		Failed:     p.failed.Load(),
+	}
+	if started := p.started.Load(); started != 0 {
+		s.Elapsed = time.Since(time.Unix(0, started)).Seconds()
+	}
+	done := s.Processed + s.Failed
+	if s.Elapsed > 0 {
+		s.Throughput = float64(done) / s.Elapsed
+	}
+	if remaining := s.Total - done - s.Skipped; s.Total > 0 && remaining > 0 && s.Throughput > 0 {
+		s.ETA = float64(remaining) / s.Throughput
+	}
+	return s
+}
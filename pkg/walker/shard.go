@@ -0,0 +1,108 @@
+package walker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"classifier/pkg/archive"
+)
+
+// Shard selects a stable subset of the files under a root, so that several processes or
+// machines can split one walk between them. Shards are numbered from 1 to Count, and every
+// file belongs to exactly one of them. The zero Shard contains every file.
+type Shard struct {
+	Index int
+	Count int
+}
+
+// ParseShard parses a shard written as "i/n", such as "2/4". An empty string returns the zero Shard.
+func ParseShard(s string) (Shard, error) {
+	if s == "" {
+		return Shard{}, nil
+	}
+	index, count, ok := strings.Cut(s, "/")
+	if !ok {
+		return Shard{}, fmt.Errorf("invalid shard %q, expected i/n", s)
+	}
+	var (
+		shard Shard
+		err   error
+	)
+	if shard.Index, err = strconv.Atoi(index); err != nil {
+		return Shard{}, fmt.Errorf("invalid shard index %q: %w", index, err)
+	}
+	if shard.Count, err = strconv.Atoi(count); err != nil {
+		return Shard{}, fmt.Errorf("invalid shard count %q: %w", count, err)
+	}
+	return shard, shard.Validate()
+}
+
+// Validate reports whether the shard is the zero Shard or 1 <= Index <= Count.
+func (s Shard) Validate() error {
+	if s == (Shard{}) {
+		return nil
+	}
+	if s.Count < 1 || s.Index < 1 || s.Index > s.Count {
+		return fmt.Errorf("invalid shard %d/%d, expected 1 <= i <= n", s.Index, s.Count)
+	}
+	return nil
+}
+
+func (s Shard) String() string {
+	if s.Count < 1 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+func (s Shard) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+func (s *Shard) UnmarshalText(text []byte) error {
+	shard, err := ParseShard(string(text))
+	if err != nil {
+		return err
+	}
+	*s = shard
+	return nil
+}
+
+// Contains reports whether the file at the slash separated path name belongs to the shard.
+// Files inside an archive belong to the same shard as the archive, so that each archive is only
+// opened by one shard.
+func (s Shard) Contains(name string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	if outer, _, ok := archive.Split(name); ok {
+		name = outer
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(s.Count)) == s.Index-1
+}
+
+// Compare orders two slash separated paths the way WalkFS visits them: folders are walked
+// in lexical order and each folder's contents come before its next sibling. Paths inside
+// archives sort as if the archive was a folder.
+func Compare(a, b string) int {
+	a = strings.ReplaceAll(a, archive.Separator, "/")
+	b = strings.ReplaceAll(b, archive.Separator, "/")
+	for a != "" && b != "" {
+		var ea, eb string
+		ea, a, _ = strings.Cut(a, "/")
+		eb, b, _ = strings.Cut(b, "/")
+		if c := strings.Compare(ea, eb); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
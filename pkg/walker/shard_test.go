@@ -0,0 +1,52 @@
+package walker
+
+import (
+	"testing"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Shard
+		wantErr bool
+	}{
+		{"", Shard{}, false},
+		{"1/1", Shard{Index: 1, Count: 1}, false},
+		{"2/4", Shard{Index: 2, Count: 4}, false},
+		{"0/4", Shard{}, true},
+		{"5/4", Shard{}, true},
+		{"2", Shard{}, true},
+		{"a/b", Shard{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseShard(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseShard(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseShard(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"a.png", "a.png", 0},
+		{"a.png", "b.png", -1},
+		{"a/z.png", "a.png", -1},
+		{"a/z.png", "a-b.png", -1},
+		{"a/b/c.png", "a/b.png", -1},
+		{"x.cbz!/p1.png", "x.cbz!/p2.png", -1},
+		{"x.cbz!/p1.png", "x.cbz.png", -1},
+		{"b.png", "a/z.png", 1},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
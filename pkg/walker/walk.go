@@ -4,28 +4,85 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 
 	"github.com/charmbracelet/log"
+
+	"classifier/pkg/archive"
 )
 
+// ErrNoResult can be returned by Do when a file was processed without anything to report, such as
+// an image below the threshold. The file is committed to the Manifest like any other, without a result.
+var ErrNoResult = errors.New("no results found")
+
 type Config[R any, A any] struct {
-	Enabled     bool
-	Max         int
-	Semaphore   chan struct{}
-	Skipper     func(path string) bool
+	Enabled   bool
+	Max       int
+	Semaphore chan struct{}
+	Skipper   func(path string) bool
+	Filter    Filter
+	// Archives descends into zip, cbz and tar archives, visiting the files inside them
+	// with virtual paths such as "comics/issue1.cbz!/page03.png". Args.Open resolves these paths.
+	Archives    bool
 	Do          func(Args[A]) (R, error)
 	Args        A
 	ConfigCheck func(*A)
+
+	// Manifest, when set, skips files that did not change since the last walk.
+	// Files are committed to it after Do succeeds, and once the whole root was visited,
+	// OnDelete is called for each recorded file that no longer exists.
+	Manifest *Manifest
+	OnDelete func(path string) (R, error)
+
+	// Shard restricts the walk to one part of the root, see Shard.Contains.
+	Shard Shard
+	// Checkpoint, when set, skips every file up to its last completed path
+	// and advances as results are sent. It is reset once the whole root was visited.
+	Checkpoint *Checkpoint
+
+	// Progress, when set, is updated as files are discovered and processed.
+	// Count pre-scans the root before walking it, so that Progress knows the total and can estimate an ETA.
+	Progress *Progress
+	Count    bool
 }
 
 type Args[A any] struct {
 	Context context.Context
-	Path    string
-	Args    A
+	// FS is the file system the walk runs over, able to open paths inside archives.
+	FS fs.FS
+	// Name is the slash separated path of the file inside FS.
+	Name string
+	// Path is Name joined with the walked root, used to report results and as a cache key.
+	Path string
+	Args A
+
+	// Status is how the file compares to the Manifest, or New when no manifest is used.
+	Status Status
+	// Previous is the path the content was recorded under when Status is Moved.
+	Previous string
+}
+
+// Open opens the file being visited. Without an FS, Path is opened from the local disk.
+func (a Args[A]) Open() (io.ReadSeekCloser, error) {
+	if a.FS == nil {
+		return archive.OpenFile(a.Path)
+	}
+	return archive.OpenSeeker(a.FS, a.Name)
+}
+
+// pending is a file handed to Do, waiting for its turn to be sent in walk order.
+type pending[R any] struct {
+	name      string
+	done      chan struct{}
+	completed bool
+	ok        bool
+	result    R
 }
 
 type Result[R any] struct {
@@ -33,9 +90,17 @@ type Result[R any] struct {
 	Result R
 }
 
-// WalkDir traverses the folder rooted at "root" and, for each image file,
-// spawns a goroutine (limited by a semaphore of size runtime.NumCPU by default)
+// WalkDir traverses the folder rooted at "root" on the local disk using WalkFS.
 func WalkDir[R any, A any](ctx context.Context, root string, results chan<- R, config Config[R, A]) error {
+	return WalkFS(ctx, os.DirFS(root), root, results, config)
+}
+
+// WalkFS traverses fsys and, for each file, spawns a goroutine (limited by a semaphore
+// of size runtime.NumCPU by default) calling Do. Reported paths are joined with root,
+// which can be left empty when fsys is not on the local disk.
+// Files are visited in lexical order (see Compare) and results are sent in that same order,
+// regardless of which Do finishes first, so that Max, Shard and Checkpoint are deterministic.
+func WalkFS[R any, A any](ctx context.Context, fsys fs.FS, root string, results chan<- R, config Config[R, A]) error {
 	if results == nil {
 		return errors.New("results must not be nil")
 	}
@@ -49,6 +114,10 @@ func WalkDir[R any, A any](ctx context.Context, root string, results chan<- R, c
 		return errors.New("do function must not be nil")
 	}
 
+	if fsys == nil {
+		return errors.New("file system must not be nil")
+	}
+
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -61,21 +130,144 @@ func WalkDir[R any, A any](ctx context.Context, root string, results chan<- R, c
 		config.ConfigCheck(&config.Args)
 	}
 
+	if err := config.Filter.Validate(); err != nil {
+		return err
+	}
+
+	if err := config.Shard.Validate(); err != nil {
+		return err
+	}
+
+	// Archives are held while their entries are walked and processed, so that each is only opened once.
+	afs := archive.FS{FS: fsys, Root: root}
+	fsys = afs
+	display := func(name string) string {
+		return filepath.Join(root, filepath.FromSlash(name))
+	}
+
 	var (
-		count int
-		wg    sync.WaitGroup
+		count     int
+		truncated bool
+		resume    string
+		wg        sync.WaitGroup
+		ignore    = ignorer{fsys: fsys}
+		queue     = make(chan *pending[R], 4*cap(config.Semaphore))
+		emitted   = make(chan struct{})
 	)
+	if config.Checkpoint != nil {
+		resume = config.Checkpoint.Resume()
+		if resume != "" {
+			log.Infof("Resuming walk of %s after %s", root, display(resume))
+		}
+	}
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if config.Skipper != nil && config.Skipper(path) {
-			return nil
+	// Results are sent in the order files were queued. The checkpoint only advances past files whose
+	// Do completed, and stops advancing at the first file that was cancelled.
+	go func() {
+		defer close(emitted)
+		advance := config.Checkpoint != nil
+		for p := range queue {
+			<-p.done
+			if !p.completed {
+				advance = false
+				continue
+			}
+			if p.ok {
+				select {
+				case results <- p.result:
+				case <-ctx.Done():
+					advance = false
+					continue
+				}
+			}
+			if advance {
+				config.Checkpoint.Advance(p.name)
+			}
+		}
+	}()
+
+	// accept reports whether the file at name passes the checkpoint, shard, skipper, ignore files and filter.
+	accept := func(name string, info fs.FileInfo) bool {
+		switch {
+		case resume != "" && Compare(name, resume) <= 0:
+			return false
+		case !config.Shard.Contains(name):
+			return false
+		case config.Skipper != nil && config.Skipper(display(name)):
+			return false
+		case ignore.ignored(name, false):
+			return false
+		default:
+			return config.Filter.Match(name, info)
+		}
+	}
+
+	// walk calls visit for every file in fsys, descending into archives when enabled.
+	walk := func(visit func(name string, info fs.FileInfo) error) error {
+		return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if name != "." && ignore.ignored(name, true) {
+					return fs.SkipDir
+				}
+				// Folders that were completely walked before the checkpoint are only needed by the manifest.
+				if resume != "" && config.Manifest == nil && name != "." && Compare(name, resume) < 0 && !strings.HasPrefix(resume, name+"/") {
+					return fs.SkipDir
+				}
+				ignore.load(name)
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if config.Archives && archive.IsArchive(name) && !ignore.ignored(name, false) {
+				return walkArchive(afs, name, visit)
+			}
+			return visit(name, info)
+		})
+	}
+
+	progress := config.Progress
+	if progress == nil {
+		progress = new(Progress)
+	}
+	if config.Count {
+		var total int64
+		err := walk(func(name string, info fs.FileInfo) error {
+			if !accept(name, info) {
+				return nil
+			}
+			total++
+			if config.Max > 0 && config.Manifest == nil && total >= int64(config.Max) {
+				return fs.SkipAll
+			}
+			return ctx.Err()
+		})
+		if err != nil {
+			return fmt.Errorf("error counting the path %s: %w", root, err)
+		}
+		progress.total.Store(total)
+		log.Debugf("Counted %d files in %s", total, root)
+	}
+	progress.start()
+
+	// visit filters a single file and, if it passes, hands it to Do in a new goroutine.
+	visit := func(name string, info fs.FileInfo) error {
+		path := display(name)
+		if config.Manifest != nil {
+			config.Manifest.See(name)
 		}
-		if err != nil || info.IsDir() {
+		if !accept(name, info) {
 			return nil
 		}
 		if config.Max > 0 && count >= config.Max {
-			return filepath.SkipDir
+			truncated = true
+			return fs.SkipAll
 		}
+		progress.discovered.Add(1)
 
 		select {
 		case <-ctx.Done():
@@ -83,12 +275,43 @@ func WalkDir[R any, A any](ctx context.Context, root string, results chan<- R, c
 		default:
 		}
 
+		var (
+			status   Status
+			previous string
+			entry    *Entry
+			err      error
+		)
+		if config.Manifest != nil {
+			status, previous, entry, err = config.Manifest.Check(fsys, name, info)
+			if err != nil {
+				log.Warnf("could not check %s against manifest: %v", path, err)
+			}
+			if status == Unchanged {
+				progress.skipped.Add(1)
+				log.Debugf("Skipping unchanged %s", path)
+				return nil
+			}
+			if previous != "" {
+				previous = display(previous)
+			}
+		}
+
 		count++
 		wg.Add(1)
 
+		// The archive is still held by walkArchive, so holding it until Do returns does not open it again.
+		release := func() {}
+		if outer, _, ok := archive.Split(name); ok && root != "" {
+			if _, r, err := afs.Hold(outer); err == nil {
+				release = r
+			}
+		}
+
+		p := &pending[R]{name: name, done: make(chan struct{})}
+		queue <- p
 		config.Semaphore <- struct{}{}
-		go func(path string) {
-			defer func() { <-config.Semaphore; wg.Done() }()
+		go func() {
+			defer func() { release(); <-config.Semaphore; close(p.done); wg.Done() }()
 			if !config.Enabled {
 				return
 			}
@@ -98,32 +321,111 @@ func WalkDir[R any, A any](ctx context.Context, root string, results chan<- R, c
 			default:
 			}
 			result, err := config.Do(Args[A]{
-				Context: ctx,
-				Path:    path,
-				Args:    config.Args,
+				Context:  ctx,
+				FS:       fsys,
+				Name:     name,
+				Path:     path,
+				Args:     config.Args,
+				Status:   status,
+				Previous: previous,
 			})
 			select {
 			case <-ctx.Done():
 				return
 			default:
+				p.completed = true
+				if errors.Is(err, ErrNoResult) {
+					progress.processed.Add(1)
+					if config.Manifest != nil {
+						config.Manifest.Commit(name, entry)
+					}
+					log.Debugf("Nothing found for %s", path)
+					return
+				}
 				if err != nil {
+					progress.failed.Add(1)
 					log.Warnf("%s not found, %v", path, err)
 					return
 				}
-				results <- result
+				progress.processed.Add(1)
+				if config.Manifest != nil {
+					config.Manifest.Commit(name, entry)
+				}
+				p.result, p.ok = result, true
 				log.Debugf("Found %s %#v", path, result)
 			}
-		}(path)
+		}()
 
 		return nil
-	})
+	}
+
+	err := walk(visit)
+	wg.Wait()
+	close(queue)
+	<-emitted
+
+	// The checkpoint is saved even when the walk was cut short, so that it resumes after the files it completed.
+	complete := err == nil && !truncated && ctx.Err() == nil
+	if config.Checkpoint != nil {
+		if complete {
+			config.Checkpoint.Reset()
+		}
+		if err := config.Checkpoint.Save(); err != nil {
+			log.Warnf("could not save checkpoint for %s: %v", root, err)
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("error walking the path %s: %w", root, err)
 	}
-	wg.Wait()
+
+	if config.Manifest != nil && complete {
+		for _, name := range config.Manifest.Deleted() {
+			path := display(name)
+			log.Infof("%s was deleted", path)
+			if config.OnDelete == nil {
+				continue
+			}
+			result, err := config.OnDelete(path)
+			if err != nil {
+				log.Warnf("could not handle deleted %s: %v", path, err)
+				continue
+			}
+			results <- result
+		}
+	}
 	return nil
 }
 
+// walkArchive visits every file inside the archive at name, holding it open meanwhile. Errors reading
+// the archive are logged and skipped, while errors from visit such as fs.SkipAll are returned.
+func walkArchive(fsys archive.FS, name string, visit func(name string, info fs.FileInfo) error) error {
+	inner, release, err := fsys.Hold(name)
+	if err != nil {
+		log.Warnf("could not open archive %s: %v", name, err)
+		return nil
+	}
+	defer release()
+
+	var visitErr error
+	err = fs.WalkDir(inner, ".", func(entry string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if visitErr = visit(archive.Join(name, entry), info); visitErr != nil {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("could not walk archive %s: %v", name, err)
+	}
+	return visitErr
+}
+
 func Skippers(skippers ...func(path string) bool) func(path string) bool {
 	return func(path string) bool {
 		for _, skipper := range skippers {
@@ -0,0 +1,397 @@
+package walker
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"classifier/pkg/archive"
+)
+
+func zipBytes(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		part, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(part, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func notPNG(p string) bool { return path.Ext(p) != ".png" }
+
+// read is a Do function that returns the path and content of every file it is handed.
+func read(args Args[struct{}]) (string, error) {
+	file, err := args.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	return args.Path + "=" + string(data), nil
+}
+
+func collect(t *testing.T, fsys fstest.MapFS, config Config[string, struct{}]) []string {
+	t.Helper()
+	got := walk(t, fsys, config)
+	slices.Sort(got)
+	return got
+}
+
+// walk returns the results in the order WalkFS sent them.
+func walk(t *testing.T, fsys fstest.MapFS, config Config[string, struct{}]) []string {
+	t.Helper()
+	config.Enabled = true
+	if config.Do == nil {
+		config.Do = read
+	}
+	results := make(chan string)
+	errs := make(chan error, 1)
+	go func() { errs <- WalkFS(context.Background(), fsys, "", results, config) }()
+	var got []string
+	for result := range results {
+		got = append(got, result)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestWalkFS(t *testing.T) {
+	now := time.Now()
+	fsys := fstest.MapFS{
+		"a.png":                    {Data: []byte("a"), ModTime: now},
+		"b.png":                    {Data: []byte("bbbb"), ModTime: now.Add(-48 * time.Hour)},
+		"notes.txt":                {Data: []byte("text")},
+		"nested/c.png":             {Data: []byte("c"), ModTime: now},
+		"nested/.classifierignore": {Data: []byte("skip.png\ndrafts/\n")},
+		"nested/skip.png":          {Data: []byte("skip")},
+		"nested/drafts/d.png":      {Data: []byte("d")},
+		"comics/issue1.cbz":        {Data: zipBytes(t, map[string]string{"page01.png": "p1", "page02.png": "p2", "info.txt": "x"})},
+	}
+
+	tests := []struct {
+		name   string
+		config Config[string, struct{}]
+		want   []string
+	}{
+		{
+			name:   "images",
+			config: Config[string, struct{}]{Skipper: notPNG},
+			want:   []string{"a.png=a", "b.png=bbbb", "nested/c.png=c"},
+		},
+		{
+			name:   "archives",
+			config: Config[string, struct{}]{Skipper: notPNG, Archives: true},
+			want:   []string{"a.png=a", "b.png=bbbb", "comics/issue1.cbz!/page01.png=p1", "comics/issue1.cbz!/page02.png=p2", "nested/c.png=c"},
+		},
+		{
+			name:   "include",
+			config: Config[string, struct{}]{Skipper: notPNG, Filter: Filter{Include: []string{"nested/**"}}},
+			want:   []string{"nested/c.png=c"},
+		},
+		{
+			name:   "exclude",
+			config: Config[string, struct{}]{Skipper: notPNG, Filter: Filter{Exclude: []string{"*.png"}}},
+			want:   []string{"nested/c.png=c"},
+		},
+		{
+			name:   "size",
+			config: Config[string, struct{}]{Skipper: notPNG, Filter: Filter{MinSize: 2}},
+			want:   []string{"b.png=bbbb"},
+		},
+		{
+			name:   "modified",
+			config: Config[string, struct{}]{Skipper: notPNG, Filter: Filter{ModifiedBefore: now.Add(-time.Hour)}},
+			want:   []string{"b.png=bbbb"},
+		},
+		{
+			name:   "max",
+			config: Config[string, struct{}]{Skipper: notPNG, Max: 2},
+			want:   []string{"a.png=a", "b.png=bbbb"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := collect(t, fsys, tt.config); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkFS_Manifest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png": {Data: []byte("a")},
+		"b.png": {Data: []byte("b")},
+	}
+	manifest := NewManifest("")
+	config := Config[string, struct{}]{
+		Skipper:  notPNG,
+		Manifest: manifest,
+		OnDelete: func(path string) (string, error) { return "deleted " + path, nil },
+	}
+
+	if got := collect(t, fsys, config); len(got) != 2 {
+		t.Fatalf("expected both files on the first walk, got %v", got)
+	}
+	if got := collect(t, fsys, config); len(got) != 0 {
+		t.Fatalf("expected no files on the second walk, got %v", got)
+	}
+
+	fsys["a.png"] = &fstest.MapFile{Data: []byte("changed"), ModTime: time.Now()}
+	delete(fsys, "b.png")
+	fsys["c.png"] = &fstest.MapFile{Data: []byte("b")}
+	config.Do = func(args Args[struct{}]) (string, error) {
+		return strings.Join([]string{args.Path, args.Status.String(), args.Previous}, " "), nil
+	}
+	want := []string{"a.png modified ", "c.png moved b.png"}
+	if got := collect(t, fsys, config); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	delete(fsys, "c.png")
+	want = []string{"deleted c.png"}
+	if got := collect(t, fsys, config); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestWalkFS_NoResult(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png": {Data: []byte("a")},
+		"b.png": {Data: []byte("below the threshold")},
+	}
+	config := Config[string, struct{}]{
+		Skipper:  notPNG,
+		Manifest: NewManifest(""),
+		Do: func(args Args[struct{}]) (string, error) {
+			if args.Name == "b.png" {
+				return "", ErrNoResult
+			}
+			return args.Name, nil
+		},
+	}
+	if got := collect(t, fsys, config); !slices.Equal(got, []string{"a.png"}) {
+		t.Fatalf("got %v, want only a.png", got)
+	}
+	if got := collect(t, fsys, config); len(got) != 0 {
+		t.Fatalf("expected files without results to be committed to the manifest, got %v", got)
+	}
+}
+
+// countingFS counts how many times each file is opened.
+type countingFS struct {
+	fs.FS
+	mu    sync.Mutex
+	opens map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.mu.Lock()
+	c.opens[name]++
+	c.mu.Unlock()
+	return c.FS.Open(name)
+}
+
+func TestWalkFS_ArchiveOpenedOnce(t *testing.T) {
+	root := t.TempDir()
+	files := make(map[string]string)
+	for i := range 20 {
+		files[fmt.Sprintf("page%02d.png", i)] = strconv.Itoa(i)
+	}
+	if err := os.WriteFile(filepath.Join(root, "issue.cbz"), zipBytes(t, files), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fsys := &countingFS{FS: os.DirFS(root), opens: make(map[string]int)}
+	// Another stage opens every entry again from its own FS over the same folder.
+	stage := archive.FS{FS: fsys, Root: root}
+	config := Config[string, struct{}]{
+		Enabled:  true,
+		Skipper:  notPNG,
+		Archives: true,
+		Manifest: NewManifest(root),
+		Do: func(args Args[struct{}]) (string, error) {
+			if _, err := fs.ReadFile(stage, args.Name); err != nil {
+				return "", err
+			}
+			return read(args)
+		},
+	}
+	results := make(chan string)
+	errs := make(chan error, 1)
+	go func() { errs <- WalkFS(context.Background(), fsys, root, results, config) }()
+	var got int
+	for range results {
+		got++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if got != len(files) {
+		t.Fatalf("got %d results, want %d", got, len(files))
+	}
+	if n := fsys.opens["issue.cbz"]; n != 1 {
+		t.Fatalf("the archive was opened %d times, want once per walk", n)
+	}
+}
+
+func TestWalkFS_Order(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png":          {Data: []byte("30")},
+		"b/c.png":        {Data: []byte("0")},
+		"b.png":          {Data: []byte("20")},
+		"comics/01.cbz":  {Data: zipBytes(t, map[string]string{"2.png": "0", "1.png": "10"})},
+		"comics/02/.png": {Data: []byte("5")},
+	}
+	config := Config[string, struct{}]{
+		Skipper:  notPNG,
+		Archives: true,
+		// Later files finish first, so that results only come out in order if WalkFS reorders them.
+		Do: func(args Args[struct{}]) (string, error) {
+			file, err := args.Open()
+			if err != nil {
+				return "", err
+			}
+			defer file.Close()
+			data, _ := io.ReadAll(file)
+			delay, _ := strconv.Atoi(string(data))
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+			return args.Name, nil
+		},
+	}
+	want := []string{"a.png", "b/c.png", "b.png", "comics/01.cbz!/1.png", "comics/01.cbz!/2.png", "comics/02/.png"}
+	if !slices.IsSortedFunc(want, Compare) {
+		t.Fatalf("%v is not in walk order", want)
+	}
+	if got := walk(t, fsys, config); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestWalkFS_Shard(t *testing.T) {
+	fsys := fstest.MapFS{}
+	var want []string
+	for i := range 50 {
+		name := fmt.Sprintf("%02d/%02d.png", i%7, i)
+		fsys[name] = &fstest.MapFile{Data: []byte(strconv.Itoa(i))}
+		want = append(want, name+"="+strconv.Itoa(i))
+	}
+	slices.Sort(want)
+
+	var merged []string
+	for i := 1; i <= 3; i++ {
+		got := collect(t, fsys, Config[string, struct{}]{Skipper: notPNG, Shard: Shard{Index: i, Count: 3}})
+		if len(got) == 0 {
+			t.Errorf("shard %d/3 is empty", i)
+		}
+		merged = append(merged, got...)
+	}
+	slices.Sort(merged)
+	if !slices.Equal(merged, want) {
+		t.Fatalf("shards do not cover every file exactly once:\ngot  %v\nwant %v", merged, want)
+	}
+}
+
+func TestWalkFS_Checkpoint(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png":   {Data: []byte("a")},
+		"b/c.png": {Data: []byte("c")},
+		"b/d.png": {Data: []byte("d")},
+		"e.png":   {Data: []byte("e")},
+		"f.png":   {Data: []byte("f")},
+	}
+	name := filepath.Join(t.TempDir(), "checkpoint.json")
+	checkpoint, err := LoadCheckpoint(name, "", Shard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config[string, struct{}]{Skipper: notPNG, Max: 2, Checkpoint: checkpoint}
+
+	batches := [][]string{
+		{"a.png=a", "b/c.png=c"},
+		{"b/d.png=d", "e.png=e"},
+		{"f.png=f"},
+	}
+	for i, want := range batches {
+		if got := walk(t, fsys, config); !slices.Equal(got, want) {
+			t.Fatalf("batch %d: got %v, want %v", i, got, want)
+		}
+		// Load the checkpoint back from disk, as a restarted process would.
+		if config.Checkpoint, err = LoadCheckpoint(name, "", Shard{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last := config.Checkpoint.Resume(); last != "" {
+		t.Fatalf("expected the checkpoint to be reset after a complete walk, got %q", last)
+	}
+}
+
+func TestWalkFS_Progress(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png":     {Data: []byte("a")},
+		"b.png":     {Data: []byte("b")},
+		"c.png":     {Data: []byte("fail")},
+		"d.png":     {Data: []byte("nothing")},
+		"notes.txt": {Data: []byte("text")},
+	}
+	manifest := NewManifest("")
+	progress := new(Progress)
+	config := Config[string, struct{}]{
+		Skipper:  notPNG,
+		Manifest: manifest,
+		Progress: progress,
+		Count:    true,
+		Do: func(args Args[struct{}]) (string, error) {
+			switch args.Name {
+			case "c.png":
+				return "", errors.New("failed")
+			case "d.png":
+				return "", ErrNoResult
+			}
+			return args.Name, nil
+		},
+	}
+	walk(t, fsys, config)
+	got := progress.Snapshot()
+	want := Snapshot{Total: 4, Discovered: 4, Processed: 3, Failed: 1}
+	if got.Total != want.Total || got.Discovered != want.Discovered || got.Processed != want.Processed || got.Failed != want.Failed || got.Skipped != 0 {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got.Throughput <= 0 {
+		t.Fatalf("expected a throughput, got %+v", got)
+	}
+
+	progress = new(Progress)
+	config.Progress = progress
+	walk(t, fsys, config)
+	if got := progress.Snapshot(); got.Skipped != 3 || got.Failed != 1 || got.Processed != 0 {
+		t.Fatalf("expected unchanged files to be skipped, got %+v", got)
+	}
+}
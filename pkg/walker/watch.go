@@ -0,0 +1,126 @@
+package walker
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+type WatchConfig struct {
+	// Interval is how often the root is polled. Defaults to 5 seconds.
+	Interval time.Duration
+	// Settle is how long a file's size and mtime must stay the same before it is reported,
+	// so that files still being written are not picked up. Defaults to 2 seconds.
+	Settle  time.Duration
+	Skipper func(path string) bool
+	// Existing also reports files that were already present when the watch started.
+	Existing bool
+}
+
+type Change struct {
+	Path   string
+	Status Status
+}
+
+type polled struct {
+	size     int64
+	modTime  time.Time
+	changed  time.Time
+	reported bool
+	status   Status
+}
+
+// Watch polls fsys, the folder rooted at "root", until ctx is done and sends every new or modified file
+// once its writes have settled, with its path joined to root. It uses polling instead of file system
+// notifications so that it works the same everywhere without cgo.
+func Watch(ctx context.Context, fsys fs.FS, root string, changes chan<- Change, config WatchConfig) error {
+	if changes == nil {
+		return errors.New("changes must not be nil")
+	}
+	defer close(changes)
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if config.Interval <= 0 {
+		config.Interval = 5 * time.Second
+	}
+	if config.Settle <= 0 {
+		config.Settle = 2 * time.Second
+	}
+
+	known := make(map[string]*polled)
+	first := true
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		seen := make(map[string]struct{}, len(known))
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			path := filepath.Join(root, filepath.FromSlash(name))
+			if config.Skipper != nil && config.Skipper(path) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			seen[path] = struct{}{}
+
+			state, ok := known[path]
+			switch {
+			case !ok:
+				known[path] = &polled{
+					size:     info.Size(),
+					modTime:  info.ModTime(),
+					changed:  now,
+					reported: first && !config.Existing,
+					status:   New,
+				}
+			case state.size != info.Size() || !state.modTime.Equal(info.ModTime()):
+				state.size, state.modTime, state.changed = info.Size(), info.ModTime(), now
+				if state.reported {
+					state.status = Modified
+				}
+				state.reported = false
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("error polling the path %s: %v", root, err)
+		}
+
+		for path, state := range known {
+			if _, ok := seen[path]; !ok {
+				delete(known, path)
+				continue
+			}
+			if state.reported || now.Sub(state.changed) < config.Settle {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case changes <- Change{Path: path, Status: state.status}:
+				state.reported = true
+			}
+		}
+		first = false
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
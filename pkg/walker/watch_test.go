@@ -0,0 +1,51 @@
+package walker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "existing.png"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changes := make(chan Change)
+	go Watch(ctx, os.DirFS(root), root, changes, WatchConfig{
+		Interval: 20 * time.Millisecond,
+		Settle:   50 * time.Millisecond,
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	added := filepath.Join(root, "added.png")
+	if err := os.WriteFile(added, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case change := <-changes:
+		if change.Path != added || change.Status != New {
+			t.Fatalf("expected %s to be new, got %+v", added, change)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for new file")
+	}
+
+	if err := os.WriteFile(added, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-changes:
+		if change.Path != added || change.Status != Modified {
+			t.Fatalf("expected %s to be modified, got %+v", added, change)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for modified file")
+	}
+}